@@ -0,0 +1,478 @@
+package samltools
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/beevik/etree"
+	perrors "github.com/pkg/errors"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+)
+
+const (
+	SOAPEnvelopeNamespace = "http://schemas.xmlsoap.org/soap/envelope/"
+	// SAMLArtParam is the query string and form parameter of the HTTP-Artifact binding.
+	SAMLArtParam = "SAMLart"
+
+	artifactTypeCode = 0x0004
+	artifactLength   = 44
+	// maxSOAPMessageSize bounds the SOAP requests and responses read from the back-channel.
+	maxSOAPMessageSize = 1 << 20
+)
+
+// Artifact is a type 0x0004 SAML artifact: the index of the ArtifactResolutionService
+// of its issuer, the SHA-1 hash of the issuer entityID and a random message handle.
+type Artifact struct {
+	EndpointIndex uint16
+	SourceID      [20]byte
+	MessageHandle [20]byte
+}
+
+// NewArtifact returns an artifact for a message held by the entity, to be resolved
+// at its ArtifactResolutionService with the given index.
+func NewArtifact(entityID string, endpointIndex int) (*Artifact, error) {
+	a := &Artifact{EndpointIndex: uint16(endpointIndex), SourceID: sha1.Sum([]byte(entityID))}
+	if _, err := rand.Read(a.MessageHandle[:]); err != nil {
+		return nil, perrors.Wrap(err, "Failed to generate message handle")
+	}
+	return a, nil
+}
+
+// ParseArtifact decodes a SAMLart value.
+func ParseArtifact(encoded string) (*Artifact, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, perrors.Wrap(err, "Base64 decoding of artifact failed")
+	}
+	if len(data) != artifactLength {
+		return nil, fmt.Errorf("artifact is %d bytes long, expected %d", len(data), artifactLength)
+	}
+	if code := binary.BigEndian.Uint16(data[0:2]); code != artifactTypeCode {
+		return nil, fmt.Errorf("unsupported artifact type %#04x", code)
+	}
+	a := &Artifact{EndpointIndex: binary.BigEndian.Uint16(data[2:4])}
+	copy(a.SourceID[:], data[4:24])
+	copy(a.MessageHandle[:], data[24:44])
+	return a, nil
+}
+
+// IssuedBy reports whether the source ID of the artifact is the one of the entity.
+func (a *Artifact) IssuedBy(entityID string) bool {
+	return a.SourceID == sha1.Sum([]byte(entityID))
+}
+
+// String returns the SAMLart value of the artifact.
+func (a *Artifact) String() string {
+	data := make([]byte, artifactLength)
+	binary.BigEndian.PutUint16(data[0:2], artifactTypeCode)
+	binary.BigEndian.PutUint16(data[2:4], a.EndpointIndex)
+	copy(data[4:24], a.SourceID[:])
+	copy(data[24:44], a.MessageHandle[:])
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// ArtifactStore holds the messages referenced by artifacts until they are resolved,
+// once, by the entity they were issued to, or until they expire.
+type ArtifactStore struct {
+	TTL time.Duration
+
+	mu       sync.Mutex
+	messages map[string]artifactMessage
+}
+
+type artifactMessage struct {
+	recipient string
+	message   []byte
+	expires   time.Time
+}
+
+func NewArtifactStore() *ArtifactStore {
+	return &ArtifactStore{TTL: 2 * time.Minute, messages: map[string]artifactMessage{}}
+}
+
+// Put stores the message referenced by the artifact, to be resolved by recipient.
+func (s *ArtifactStore) Put(artifact string, recipient string, message []byte) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for a, m := range s.messages {
+		if now.After(m.expires) {
+			delete(s.messages, a)
+		}
+	}
+	s.messages[artifact] = artifactMessage{recipient: recipient, message: message, expires: now.Add(s.TTL)}
+}
+
+// Take removes and returns the message referenced by the artifact. The message is
+// left in place when requester isn't the entity it was issued to.
+func (s *ArtifactStore) Take(artifact string, requester string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.messages[artifact]
+	if !ok || time.Now().After(m.expires) {
+		delete(s.messages, artifact)
+		return nil, fmt.Errorf("unknown or expired artifact")
+	}
+	if m.recipient != requester {
+		return nil, fmt.Errorf("artifact wasn't issued to %s", requester)
+	}
+	delete(s.messages, artifact)
+	return m.message, nil
+}
+
+// readSOAPMessage reads at most maxSOAPMessageSize bytes of a SOAP message.
+func readSOAPMessage(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSOAPMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSOAPMessageSize {
+		return nil, fmt.Errorf("SOAP message exceeds %d bytes", maxSOAPMessageSize)
+	}
+	return data, nil
+}
+
+// ArtifactResolve is the samlp:ArtifactResolve protocol message.
+type ArtifactResolve struct {
+	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:protocol ArtifactResolve"`
+	ID           string    `xml:"ID,attr"`
+	Version      string    `xml:"Version,attr"`
+	IssueInstant time.Time `xml:"IssueInstant,attr"`
+	Destination  string    `xml:"Destination,attr,omitempty"`
+	Issuer       *Issuer   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Artifact     string    `xml:"urn:oasis:names:tc:SAML:2.0:protocol Artifact"`
+}
+
+func NewArtifactResolve(issuer string, destination string, artifact string) *ArtifactResolve {
+	return &ArtifactResolve{
+		ID:           NewID(),
+		Version:      "2.0",
+		IssueInstant: time.Now().UTC().Truncate(time.Second),
+		Destination:  destination,
+		Issuer:       &Issuer{Value: issuer},
+		Artifact:     artifact,
+	}
+}
+
+// Bytes marshals the message.
+func (r *ArtifactResolve) Bytes() ([]byte, error) {
+	return xml.Marshal(r)
+}
+
+// SOAPEnvelope wraps a protocol message in a SOAP 1.1 envelope.
+func SOAPEnvelope(message []byte) ([]byte, error) {
+	body := etree.NewDocument()
+	if err := body.ReadFromBytes(message); err != nil {
+		return nil, perrors.Wrap(err, "Failed to parse message")
+	}
+	if body.Root() == nil {
+		return nil, fmt.Errorf("empty message")
+	}
+	doc := etree.NewDocument()
+	env := doc.CreateElement("soap:Envelope")
+	env.CreateAttr("xmlns:soap", SOAPEnvelopeNamespace)
+	env.CreateElement("soap:Body").AddChild(body.Root())
+	return doc.WriteToBytes()
+}
+
+// SOAPBody returns the protocol message carried by a SOAP envelope, with the
+// namespace declarations it inherits from the envelope.
+func SOAPBody(envelope []byte) ([]byte, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(envelope); err != nil {
+		return nil, perrors.Wrap(err, "Failed to parse SOAP envelope")
+	}
+	if doc.Root() == nil {
+		return nil, fmt.Errorf("empty SOAP envelope")
+	}
+	body, err := etreeutils.NSFindOneChild(doc.Root(), SOAPEnvelopeNamespace, "Body")
+	if err != nil {
+		return nil, err
+	}
+	if body == nil || len(body.ChildElements()) == 0 {
+		return nil, fmt.Errorf("SOAP envelope doesn't contain a message")
+	}
+	return detachedBytes(body.ChildElements()[0])
+}
+
+func detachedBytes(el *etree.Element) ([]byte, error) {
+	ctx, err := etreeutils.NSBuildParentContext(el)
+	if err != nil {
+		return nil, err
+	}
+	detached, err := etreeutils.NSDetatch(ctx, el)
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(detached)
+	return doc.WriteToBytes()
+}
+
+// ArtifactResolutionService answers the ArtifactResolve requests of Service Providers
+// with the messages held in Store. Requesters authenticate either by signing the
+// ArtifactResolve or with a TLS client certificate, in both cases with a certificate
+// of their metadata.
+type ArtifactResolutionService struct {
+	EntityID       string
+	Store          *ArtifactStore
+	SigningContext *dsig.SigningContext
+	LookupSP       func(entityID string) (*SPSSODescriptor, error)
+}
+
+func (s *ArtifactResolutionService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	envelope, err := readSOAPMessage(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	message, err := SOAPBody(envelope)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resolve, status := s.authenticate(req, message)
+	var resolved []byte
+	if status == nil {
+		if resolved, err = s.Store.Take(resolve.Artifact, resolve.Issuer.Value); err != nil {
+			// The response to an artifact that can't be resolved is successful but empty
+			fmt.Printf("Failed to resolve artifact for %s: %s\n", resolve.Issuer.Value, err)
+		}
+	} else {
+		fmt.Printf("Rejecting ArtifactResolve: %s\n", status)
+	}
+	inResponseTo := ""
+	if resolve != nil {
+		inResponseTo = resolve.ID
+	}
+	resp, err := CreateArtifactResponse(s.EntityID, inResponseTo, status, resolved, s.SigningContext)
+	if err == nil {
+		resp, err = SOAPEnvelope(resp)
+	}
+	if err != nil {
+		fmt.Printf("Failed to create ArtifactResponse: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(resp)
+}
+
+func (s *ArtifactResolutionService) authenticate(req *http.Request, message []byte) (*ArtifactResolve, *StatusError) {
+	resolve := &ArtifactResolve{}
+	if err := xml.Unmarshal(message, resolve); err != nil || resolve.ID == "" {
+		return nil, RequesterError("", "invalid ArtifactResolve")
+	}
+	if resolve.Issuer == nil || resolve.Issuer.Value == "" {
+		return resolve, RequesterError("", "ArtifactResolve element doesn't contain Issuer")
+	}
+	sp, err := s.LookupSP(resolve.Issuer.Value)
+	if err != nil {
+		return resolve, RequesterError(StatusRequestDenied, "%s", err)
+	}
+	certs, err := sp.SigningCertificates()
+	if err != nil {
+		return resolve, &StatusError{Code: StatusResponder, Message: err.Error()}
+	}
+	if IsSigned(message) {
+		validated, err := VerifyMessageSignature(message, certs)
+		if err != nil {
+			return resolve, RequesterError(StatusRequestDenied, "%s", err)
+		}
+		signed := &ArtifactResolve{}
+		if err := xml.Unmarshal(validated, signed); err != nil {
+			return resolve, RequesterError("", "invalid ArtifactResolve")
+		}
+		return signed, nil
+	}
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		for _, cert := range certs {
+			if cert.Equal(req.TLS.PeerCertificates[0]) {
+				return resolve, nil
+			}
+		}
+		return resolve, RequesterError(StatusRequestDenied, "TLS client certificate isn't one of %s", resolve.Issuer.Value)
+	}
+	return resolve, RequesterError(StatusRequestDenied, "ArtifactResolve isn't authenticated")
+}
+
+// CreateArtifactResponse returns a samlp:ArtifactResponse carrying the resolved message,
+// if any, or the status of the error when status is set. It is signed when signingCtx is set.
+func CreateArtifactResponse(issuer string, inResponseTo string, status *StatusError, message []byte, signingCtx *dsig.SigningContext) ([]byte, error) {
+	doc := etree.NewDocument()
+	resp := doc.CreateElement("samlp:ArtifactResponse")
+	resp.CreateAttr("xmlns:samlp", ProtocolNamespace)
+	resp.CreateAttr("xmlns:saml", AssertionNamespace)
+	resp.CreateAttr("ID", NewID())
+	resp.CreateAttr("Version", "2.0")
+	resp.CreateAttr("IssueInstant", time.Now().UTC().Format(time.RFC3339))
+	if inResponseTo != "" {
+		resp.CreateAttr("InResponseTo", inResponseTo)
+	}
+	resp.CreateElement("saml:Issuer").CreateText(issuer)
+	st := resp.CreateElement("samlp:Status")
+	code := st.CreateElement("samlp:StatusCode")
+	if status == nil {
+		code.CreateAttr("Value", StatusSuccess)
+	} else {
+		code.CreateAttr("Value", status.Code)
+		if status.SubCode != "" {
+			code.CreateElement("samlp:StatusCode").CreateAttr("Value", status.SubCode)
+		}
+		st.CreateElement("samlp:StatusMessage").CreateText(status.Message)
+	}
+	if status == nil && message != nil {
+		resolved := etree.NewDocument()
+		if err := resolved.ReadFromBytes(message); err != nil {
+			return nil, perrors.Wrap(err, "Failed to parse resolved message")
+		}
+		resp.AddChild(resolved.Root())
+	}
+	if signingCtx != nil {
+		signed, err := signEnvelopedAfter(signingCtx, resp, "Issuer")
+		if err != nil {
+			return nil, err
+		}
+		doc.SetRoot(signed)
+	}
+	return doc.WriteToBytes()
+}
+
+// ArtifactResolver resolves artifacts received by a Service Provider over the SOAP
+// back-channel to the ArtifactResolutionService of the Identity Provider.
+type ArtifactResolver struct {
+	EntityID string
+	Client   *http.Client
+	// SigningContext, when set, signs ArtifactResolve requests.
+	SigningContext *dsig.SigningContext
+	// ValidationContext verifies the signature ArtifactResponses are required to have.
+	ValidationContext *dsig.ValidationContext
+}
+
+// NewArtifactResolver returns a resolver for the Service Provider entityID. tlsConfig,
+// when set, configures the back-channel connections, e.g. with a client certificate
+// for mutual TLS and the CAs trusted for the Identity Provider.
+func NewArtifactResolver(entityID string, signingCtx *dsig.SigningContext, tlsConfig *tls.Config) *ArtifactResolver {
+	client := &http.Client{Timeout: 10 * time.Second}
+	if tlsConfig != nil {
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	return &ArtifactResolver{EntityID: entityID, Client: client, SigningContext: signingCtx}
+}
+
+// Resolve exchanges the artifact for the message it references at the given
+// ArtifactResolutionService location.
+func (r *ArtifactResolver) Resolve(location string, artifact string) ([]byte, error) {
+	if r.ValidationContext == nil {
+		return nil, fmt.Errorf("ArtifactResponses can't be trusted without a ValidationContext")
+	}
+	resolve := NewArtifactResolve(r.EntityID, location, artifact)
+	message, err := resolve.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if r.SigningContext != nil {
+		if message, err = SignMessage(message, r.SigningContext); err != nil {
+			return nil, err
+		}
+	}
+	data, err := soapCall(r.Client, location, "ArtifactResolve", message)
+	if err != nil {
+		return nil, err
+	}
+	return r.resolved(data, resolve.ID)
+}
+
+// soapCall posts a protocol message, named kind in errors, in a SOAP envelope to location
+// and returns the protocol message of the SOAP response.
+func soapCall(client *http.Client, location string, kind string, message []byte) ([]byte, error) {
+	envelope, err := SOAPEnvelope(message)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, location, bytes.NewReader(envelope))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	req.Header.Set("SOAPAction", "http://www.oasis-open.org/committees/security")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, perrors.Wrap(err, fmt.Sprintf("%s request failed", kind))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s request returned %s", kind, resp.Status)
+	}
+	data, err := readSOAPMessage(resp.Body)
+	if err != nil {
+		return nil, perrors.Wrap(err, fmt.Sprintf("Failed to read response to %s", kind))
+	}
+	return SOAPBody(data)
+}
+
+func (r *ArtifactResolver) resolved(data []byte, requestID string) ([]byte, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, perrors.Wrap(err, "Failed to parse ArtifactResponse")
+	}
+	root := doc.Root()
+	if root == nil || root.Tag != "ArtifactResponse" {
+		return nil, fmt.Errorf("ArtifactResponse element not found")
+	}
+	if !IsSigned(data) {
+		return nil, fmt.Errorf("ArtifactResponse isn't signed")
+	}
+	validated, err := r.ValidationContext.Validate(root)
+	if err != nil {
+		return nil, perrors.Wrap(err, "ArtifactResponse signature validation failed")
+	}
+	root = validated
+	if root.SelectAttrValue("InResponseTo", "") != requestID {
+		return nil, fmt.Errorf("ArtifactResponse isn't a response to %s", requestID)
+	}
+	if status := responseStatus(root); status.Code != StatusSuccess {
+		return nil, status
+	}
+	for _, child := range root.ChildElements() {
+		switch child.Tag {
+		case "Issuer", "Signature", "Extensions", "Status":
+			continue
+		}
+		return detachedBytes(child)
+	}
+	return nil, fmt.Errorf("artifact couldn't be resolved")
+}
+
+// responseStatus reads the samlp:Status of a response element.
+func responseStatus(resp *etree.Element) *StatusError {
+	status := &StatusError{}
+	if st := resp.SelectElement("Status"); st != nil {
+		if code := st.SelectElement("StatusCode"); code != nil {
+			status.Code = code.SelectAttrValue("Value", "")
+			if sub := code.SelectElement("StatusCode"); sub != nil {
+				status.SubCode = sub.SelectAttrValue("Value", "")
+			}
+		}
+		if msg := st.SelectElement("StatusMessage"); msg != nil {
+			status.Message = msg.Text()
+		}
+	}
+	return status
+}
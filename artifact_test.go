@@ -0,0 +1,169 @@
+package samltools
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+func TestArtifactEncoding(t *testing.T) {
+	a, err := NewArtifact("http://idp.samltools.com", 1)
+	if err != nil {
+		t.Fatalf("failed to create artifact %s", err)
+	}
+	encoded := a.String()
+	if len(encoded) != 60 || !strings.HasPrefix(encoded, "AAQAA") {
+		t.Fatalf("unexpected artifact %s", encoded)
+	}
+	parsed, err := ParseArtifact(encoded)
+	if err != nil {
+		t.Fatalf("failed to parse artifact %s", err)
+	}
+	if *parsed != *a || parsed.EndpointIndex != 1 || !parsed.IssuedBy("http://idp.samltools.com") || parsed.IssuedBy("urn:other") {
+		t.Fatalf("artifact not preserved %#v", parsed)
+	}
+	if _, err := ParseArtifact("AAQ="); err == nil {
+		t.Fatalf("expected short artifact to be rejected")
+	}
+}
+
+// artifactServiceForTest starts an ArtifactResolutionService holding one message for the SP
+// and returns the artifact, the key store of the SP and the validation context of the IdP.
+func artifactServiceForTest(t *testing.T, startTLS bool) (*httptest.Server, string, dsig.X509KeyStore, *dsig.ValidationContext) {
+	spKeyStore := dsig.RandomKeyStoreForTest()
+	_, certDER, _ := spKeyStore.GetKeyPair()
+	cert, _ := x509.ParseCertificate(certDER)
+	sp := &SPSSODescriptor{}
+	sp.KeyDescriptors = []KeyDescriptor{NewKeyDescriptor("signing", cert)}
+
+	idpKeyStore := dsig.RandomKeyStoreForTest()
+	_, idpCertDER, _ := idpKeyStore.GetKeyPair()
+	idpCert, _ := x509.ParseCertificate(idpCertDER)
+	idpSigningCtx := dsig.NewDefaultSigningContext(idpKeyStore)
+	idpSigningCtx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	service := &ArtifactResolutionService{
+		EntityID:       "http://idp.samltools.com",
+		Store:          NewArtifactStore(),
+		SigningContext: idpSigningCtx,
+		LookupSP: func(entityID string) (*SPSSODescriptor, error) {
+			if entityID != "urn:msingh.samltools:sp" {
+				return nil, fmt.Errorf("unknown Service Provider %s", entityID)
+			}
+			return sp, nil
+		},
+	}
+	artifact, _ := NewArtifact(service.EntityID, 0)
+	service.Store.Put(artifact.String(), "urn:msingh.samltools:sp",
+		[]byte(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_resp1" Version="2.0"/>`))
+
+	server := httptest.NewUnstartedServer(service)
+	if startTLS {
+		server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+	return server, artifact.String(), spKeyStore, CreateValidationContext([]*x509.Certificate{idpCert})
+}
+
+func TestResolveSignedArtifact(t *testing.T) {
+	server, artifact, spKeyStore, vc := artifactServiceForTest(t, false)
+	defer server.Close()
+
+	unsigned := NewArtifactResolver("urn:msingh.samltools:sp", nil, nil)
+	unsigned.ValidationContext = vc
+	if _, err := unsigned.Resolve(server.URL, artifact); err == nil || !strings.Contains(err.Error(), StatusRequestDenied) {
+		t.Fatalf("expected unauthenticated ArtifactResolve to be denied, got %v", err)
+	}
+
+	signingCtx := dsig.NewDefaultSigningContext(spKeyStore)
+	signingCtx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	resolver := NewArtifactResolver("urn:msingh.samltools:sp", signingCtx, nil)
+	resolver.ValidationContext = vc
+	message, err := resolver.Resolve(server.URL, artifact)
+	if err != nil {
+		t.Fatalf("failed to resolve artifact %s", err)
+	}
+	if !strings.Contains(string(message), `ID="_resp1"`) {
+		t.Fatalf("unexpected message %s", message)
+	}
+	if _, err := resolver.Resolve(server.URL, artifact); err == nil {
+		t.Fatalf("expected artifact to be resolved only once")
+	}
+}
+
+func TestResolveArtifactWithMutualTLS(t *testing.T) {
+	server, artifact, spKeyStore, vc := artifactServiceForTest(t, true)
+	defer server.Close()
+
+	key, certDER, _ := spKeyStore.GetKeyPair()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	resolver := NewArtifactResolver("urn:msingh.samltools:sp", nil, &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: key}},
+	})
+	resolver.ValidationContext = vc
+	message, err := resolver.Resolve(server.URL, artifact)
+	if err != nil {
+		t.Fatalf("failed to resolve artifact %s", err)
+	}
+	if !strings.Contains(string(message), `ID="_resp1"`) {
+		t.Fatalf("unexpected message %s", message)
+	}
+}
+
+func TestArtifactStoreKeepsMessageForRecipient(t *testing.T) {
+	store := NewArtifactStore()
+	store.Put("art1", "urn:msingh.samltools:sp", []byte("message"))
+	if _, err := store.Take("art1", "urn:other"); err == nil {
+		t.Fatalf("expected artifact issued to another entity to be refused")
+	}
+	if message, err := store.Take("art1", "urn:msingh.samltools:sp"); err != nil || string(message) != "message" {
+		t.Fatalf("expected the recipient to still resolve the artifact, got %q %v", message, err)
+	}
+}
+
+func TestResolveArtifactRequiresSignedResponse(t *testing.T) {
+	artifact := "AAQAAA"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		message, _ := readSOAPMessage(req.Body)
+		resolve := &ArtifactResolve{}
+		xml.Unmarshal(message, resolve)
+		resp, _ := CreateArtifactResponse("http://idp.samltools.com", resolve.ID, nil,
+			[]byte(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_resp1" Version="2.0"/>`), nil)
+		envelope, _ := SOAPEnvelope(resp)
+		w.Write(envelope)
+	}))
+	defer server.Close()
+
+	resolver := NewArtifactResolver("urn:msingh.samltools:sp", nil, nil)
+	if _, err := resolver.Resolve(server.URL, artifact); err == nil {
+		t.Fatalf("expected a resolver without ValidationContext to refuse ArtifactResponses")
+	}
+	resolver.ValidationContext = CreateValidationContext(nil)
+	if _, err := resolver.Resolve(server.URL, artifact); err == nil || !strings.Contains(err.Error(), "isn't signed") {
+		t.Fatalf("expected unsigned ArtifactResponse to be rejected, got %v", err)
+	}
+}
+
+func TestArtifactResolutionServiceLimitsRequestSize(t *testing.T) {
+	server, _, _, _ := artifactServiceForTest(t, false)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "text/xml", strings.NewReader(strings.Repeat(" ", maxSOAPMessageSize+1)))
+	if err != nil {
+		t.Fatalf("request failed %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected oversized ArtifactResolve to be rejected, got %s", resp.Status)
+	}
+}
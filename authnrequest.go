@@ -0,0 +1,271 @@
+package samltools
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"time"
+
+	perrors "github.com/pkg/errors"
+)
+
+const (
+	NameIDFormatUnspecified  = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+	NameIDFormatEmailAddress = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	NameIDFormatPersistent   = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	NameIDFormatTransient    = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+)
+
+// Issuer is the saml:Issuer of a protocol message.
+type Issuer struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Format  string   `xml:"Format,attr,omitempty"`
+	Value   string   `xml:",chardata"`
+}
+
+// AuthnRequest is the samlp:AuthnRequest protocol message. Elements are bound to
+// their SAML namespaces, so requests using any prefix unmarshal into it and it
+// marshals with the namespaces declared on the elements that need them.
+type AuthnRequest struct {
+	XMLName                        xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID                             string    `xml:"ID,attr"`
+	Version                        string    `xml:"Version,attr"`
+	IssueInstant                   time.Time `xml:"IssueInstant,attr"`
+	Destination                    string    `xml:"Destination,attr,omitempty"`
+	Consent                        string    `xml:"Consent,attr,omitempty"`
+	ForceAuthn                     bool      `xml:"ForceAuthn,attr,omitempty"`
+	IsPassive                      bool      `xml:"IsPassive,attr,omitempty"`
+	ProtocolBinding                string    `xml:"ProtocolBinding,attr,omitempty"`
+	AssertionConsumerServiceIndex  *int      `xml:"AssertionConsumerServiceIndex,attr,omitempty"`
+	AssertionConsumerServiceURL    string    `xml:"AssertionConsumerServiceURL,attr,omitempty"`
+	AttributeConsumingServiceIndex *int      `xml:"AttributeConsumingServiceIndex,attr,omitempty"`
+	ProviderName                   string    `xml:"ProviderName,attr,omitempty"`
+
+	Issuer                *Issuer                `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Extensions            *Extensions            `xml:"urn:oasis:names:tc:SAML:2.0:protocol Extensions"`
+	NameIDPolicy          *NameIDPolicy          `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+	RequestedAuthnContext *RequestedAuthnContext `xml:"urn:oasis:names:tc:SAML:2.0:protocol RequestedAuthnContext"`
+	Scoping               *Scoping               `xml:"urn:oasis:names:tc:SAML:2.0:protocol Scoping"`
+}
+
+// Extensions carries arbitrary, already serialized, extension elements.
+type Extensions struct {
+	InnerXML string `xml:",innerxml"`
+}
+
+type NameIDPolicy struct {
+	Format          string `xml:"Format,attr,omitempty"`
+	SPNameQualifier string `xml:"SPNameQualifier,attr,omitempty"`
+	AllowCreate     *bool  `xml:"AllowCreate,attr,omitempty"`
+}
+
+type RequestedAuthnContext struct {
+	// Comparison is one of exact (the default), minimum, maximum or better.
+	Comparison            string   `xml:"Comparison,attr,omitempty"`
+	AuthnContextClassRefs []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContextClassRef"`
+	AuthnContextDeclRefs  []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContextDeclRef"`
+}
+
+type Scoping struct {
+	ProxyCount   *int     `xml:"ProxyCount,attr,omitempty"`
+	IDPList      *IDPList `xml:"urn:oasis:names:tc:SAML:2.0:protocol IDPList"`
+	RequesterIDs []string `xml:"urn:oasis:names:tc:SAML:2.0:protocol RequesterID"`
+}
+
+type IDPList struct {
+	IDPEntries  []IDPEntry `xml:"urn:oasis:names:tc:SAML:2.0:protocol IDPEntry"`
+	GetComplete string     `xml:"urn:oasis:names:tc:SAML:2.0:protocol GetComplete,omitempty"`
+}
+
+type IDPEntry struct {
+	ProviderID string `xml:"ProviderID,attr"`
+	Name       string `xml:"Name,attr,omitempty"`
+	Loc        string `xml:"Loc,attr,omitempty"`
+}
+
+// NewAuthnRequest returns a request with a fresh ID, issued now by issuer.
+func NewAuthnRequest(issuer string, destination string) *AuthnRequest {
+	return &AuthnRequest{
+		ID:           NewID(),
+		Version:      "2.0",
+		IssueInstant: time.Now().UTC().Truncate(time.Second),
+		Destination:  destination,
+		Issuer:       &Issuer{Value: issuer},
+	}
+}
+
+// ParseAuthnRequest unmarshals a samlp:AuthnRequest and checks the attributes every request must carry.
+func ParseAuthnRequest(data []byte) (*AuthnRequest, error) {
+	req := &AuthnRequest{}
+	if err := xml.Unmarshal(data, req); err != nil {
+		return nil, perrors.Wrap(err, "Can't read AuthnRequest element")
+	}
+	if req.ID == "" {
+		return nil, fmt.Errorf("AuthnRequest element doesn't contain ID attribute")
+	}
+	if req.Version != "2.0" {
+		return nil, fmt.Errorf("unsupported AuthnRequest version %q", req.Version)
+	}
+	return req, nil
+}
+
+// IssuerValue returns the text of the Issuer element, empty when there is none.
+func (r *AuthnRequest) IssuerValue() string {
+	if r.Issuer == nil {
+		return ""
+	}
+	return r.Issuer.Value
+}
+
+// Bytes marshals the request.
+func (r *AuthnRequest) Bytes() ([]byte, error) {
+	return xml.Marshal(r)
+}
+
+// AuthnRequestVerifier checks AuthnRequests received by an Identity Provider: the
+// sender must be a known Service Provider, signatures must verify with its
+// certificates, and the request must be addressed to the IdP, fresh and not replayed.
+// Failures are *StatusError values to be reported to the Service Provider.
+type AuthnRequestVerifier struct {
+	// SSOURLs are the locations the IdP receives AuthnRequests at. A Destination,
+	// mandatory in signed requests, must be one of them.
+	SSOURLs []string
+	// LookupSP returns the metadata of the Service Provider with the given entity ID,
+	// or an error when it isn't known.
+	LookupSP func(entityID string) (*SPSSODescriptor, error)
+	// WantAuthnRequestsSigned requires every request to be signed, not only those of
+	// Service Providers whose metadata sets AuthnRequestsSigned.
+	WantAuthnRequestsSigned bool
+	// MaxAge is how long after its IssueInstant a request is accepted, ClockSkew the
+	// tolerance allowed for the clock of the Service Provider.
+	MaxAge    time.Duration
+	ClockSkew time.Duration
+	Replay    *ReplayCache
+}
+
+func NewAuthnRequestVerifier(ssoURLs []string, lookupSP func(entityID string) (*SPSSODescriptor, error)) *AuthnRequestVerifier {
+	return &AuthnRequestVerifier{
+		SSOURLs:   ssoURLs,
+		LookupSP:  lookupSP,
+		MaxAge:    5 * time.Minute,
+		ClockSkew: 90 * time.Second,
+		Replay:    NewReplayCache(),
+	}
+}
+
+// VerifyRedirect verifies an AuthnRequest received with the HTTP-Redirect binding,
+// given the raw query string of the request. The Service Provider is returned as soon
+// as it is known, even when verification fails later on, so that the failure can be
+// reported to it.
+func (v *AuthnRequestVerifier) VerifyRedirect(rawQuery string) (*AuthnRequest, *SPSSODescriptor, error) {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, nil, RequesterError("", "invalid query string: %s", err)
+	}
+	message, err := DecodeAndInflate(values.Get(SAMLRequestParam))
+	if err != nil {
+		return nil, nil, RequesterError("", "%s", err)
+	}
+	authnReq, sp, err := v.parse(message)
+	if err != nil {
+		return authnReq, sp, err
+	}
+	signed := values.Get(SignatureParam) != ""
+	if IsSigned(message) {
+		return authnReq, sp, RequesterError(StatusRequestDenied, "the HTTP-Redirect binding doesn't allow enveloped signatures")
+	}
+	if signed {
+		certs, err := sp.SigningCertificates()
+		if err != nil {
+			return authnReq, sp, &StatusError{Code: StatusResponder, Message: err.Error()}
+		}
+		if err := VerifyRedirectSignature(rawQuery, certs); err != nil {
+			return authnReq, sp, RequesterError(StatusRequestDenied, "%s", err)
+		}
+	}
+	return authnReq, sp, v.check(authnReq, sp, signed)
+}
+
+// VerifyPOST verifies an AuthnRequest received with the HTTP-POST binding, given
+// the base64 encoded SAMLRequest form value. When the request is signed, the
+// returned request is built from the signed content only.
+func (v *AuthnRequestVerifier) VerifyPOST(samlRequest string) (*AuthnRequest, *SPSSODescriptor, error) {
+	message, err := base64.StdEncoding.DecodeString(samlRequest)
+	if err != nil {
+		return nil, nil, RequesterError("", "Base64 decoding failed: %s", err)
+	}
+	authnReq, sp, err := v.parse(message)
+	if err != nil {
+		return authnReq, sp, err
+	}
+	signed := IsSigned(message)
+	if signed {
+		certs, err := sp.SigningCertificates()
+		if err != nil {
+			return authnReq, sp, &StatusError{Code: StatusResponder, Message: err.Error()}
+		}
+		validated, err := VerifyMessageSignature(message, certs)
+		if err != nil {
+			return authnReq, sp, RequesterError(StatusRequestDenied, "%s", err)
+		}
+		if authnReq, err = ParseAuthnRequest(validated); err != nil {
+			return nil, sp, RequesterError("", "%s", err)
+		}
+	}
+	return authnReq, sp, v.check(authnReq, sp, signed)
+}
+
+func (v *AuthnRequestVerifier) parse(message []byte) (*AuthnRequest, *SPSSODescriptor, error) {
+	authnReq, err := ParseAuthnRequest(message)
+	if err != nil {
+		return nil, nil, RequesterError("", "%s", err)
+	}
+	if authnReq.IssuerValue() == "" {
+		return authnReq, nil, RequesterError("", "AuthnRequest element doesn't contain Issuer")
+	}
+	sp, err := v.LookupSP(authnReq.IssuerValue())
+	if err != nil {
+		return authnReq, nil, RequesterError(StatusRequestDenied, "%s", err)
+	}
+	return authnReq, sp, nil
+}
+
+func (v *AuthnRequestVerifier) check(authnReq *AuthnRequest, sp *SPSSODescriptor, signed bool) error {
+	if !signed && (v.WantAuthnRequestsSigned || sp.AuthnRequestsSigned) {
+		return RequesterError(StatusRequestDenied, "AuthnRequests from %s must be signed", authnReq.IssuerValue())
+	}
+	if authnReq.Destination == "" {
+		if signed {
+			return RequesterError("", "signed AuthnRequest doesn't contain Destination")
+		}
+	} else if !ContainsString(v.SSOURLs, authnReq.Destination) {
+		return RequesterError(StatusRequestDenied, "AuthnRequest was sent to %s", authnReq.Destination)
+	}
+
+	now := time.Now()
+	if authnReq.IssueInstant.IsZero() {
+		return RequesterError("", "AuthnRequest doesn't contain IssueInstant")
+	}
+	if authnReq.IssueInstant.After(now.Add(v.ClockSkew)) {
+		return RequesterError(StatusRequestDenied, "AuthnRequest issued in the future at %s", authnReq.IssueInstant)
+	}
+	expires := authnReq.IssueInstant.Add(v.MaxAge + v.ClockSkew)
+	if now.After(expires) {
+		return RequesterError(StatusRequestDenied, "AuthnRequest issued at %s is stale", authnReq.IssueInstant)
+	}
+	if v.Replay != nil && !v.Replay.Add(authnReq.IssuerValue()+" "+authnReq.ID, expires) {
+		return RequesterError(StatusRequestDenied, "AuthnRequest %s was already received", authnReq.ID)
+	}
+	return nil
+}
+
+// ContainsString reports whether s is one of values.
+func ContainsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
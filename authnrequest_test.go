@@ -0,0 +1,193 @@
+package samltools
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+func TestAuthnRequestRoundTrip(t *testing.T) {
+	index := 1
+	proxyCount := 2
+	allowCreate := true
+	req := NewAuthnRequest("urn:msingh.samltools:sp", "http://idp.samltools.com:5678/logon")
+	req.ForceAuthn = true
+	req.IsPassive = true
+	req.ProtocolBinding = HTTPPostBinding
+	req.AssertionConsumerServiceIndex = &index
+	req.ProviderName = "samltools"
+	req.Extensions = &Extensions{InnerXML: `<ext:Hint xmlns:ext="urn:example:ext">value</ext:Hint>`}
+	req.NameIDPolicy = &NameIDPolicy{Format: NameIDFormatEmailAddress, SPNameQualifier: "urn:msingh.samltools:sp", AllowCreate: &allowCreate}
+	req.RequestedAuthnContext = &RequestedAuthnContext{
+		Comparison:            "minimum",
+		AuthnContextClassRefs: []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"},
+	}
+	req.Scoping = &Scoping{
+		ProxyCount:   &proxyCount,
+		IDPList:      &IDPList{IDPEntries: []IDPEntry{{ProviderID: "http://idp.samltools.com", Name: "samltools"}}},
+		RequesterIDs: []string{"urn:requester"},
+	}
+
+	data, err := req.Bytes()
+	if err != nil {
+		t.Fatalf("failed to marshal %s", err)
+	}
+	for _, want := range []string{
+		`<AuthnRequest xmlns="urn:oasis:names:tc:SAML:2.0:protocol"`,
+		`<Issuer xmlns="urn:oasis:names:tc:SAML:2.0:assertion">urn:msingh.samltools:sp</Issuer>`,
+		`<AuthnContextClassRef xmlns="urn:oasis:names:tc:SAML:2.0:assertion">`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Fatalf("expected %s in %s", want, data)
+		}
+	}
+
+	parsed, err := ParseAuthnRequest(data)
+	if err != nil {
+		t.Fatalf("failed to parse %s", err)
+	}
+	parsed.XMLName = req.XMLName
+	parsed.Issuer.XMLName = req.Issuer.XMLName
+	if !reflect.DeepEqual(parsed.NameIDPolicy, req.NameIDPolicy) || !reflect.DeepEqual(parsed.Scoping, req.Scoping) ||
+		!reflect.DeepEqual(parsed.RequestedAuthnContext, req.RequestedAuthnContext) {
+		t.Fatalf("round trip mismatch\n%#v\n%#v", parsed, req)
+	}
+	if !parsed.IssueInstant.Equal(req.IssueInstant) || !parsed.ForceAuthn || !parsed.IsPassive || *parsed.AssertionConsumerServiceIndex != 1 {
+		t.Fatalf("round trip mismatch\n%#v\n%#v", parsed, req)
+	}
+	if parsed.Extensions == nil || !strings.Contains(parsed.Extensions.InnerXML, "value</ext:Hint>") {
+		t.Fatalf("extensions lost %#v", parsed.Extensions)
+	}
+}
+
+func TestParsePrefixedAuthnRequest(t *testing.T) {
+	data, err := ioutil.ReadFile("./samples/samlrequest.xml")
+	if err != nil {
+		t.Fatalf("failed to read sample %s", err)
+	}
+	req, err := ParseAuthnRequest(data)
+	if err != nil {
+		t.Fatalf("failed to parse %s", err)
+	}
+	if req.IssuerValue() != "urn:auth0:dev-ejtl988w:auth0-as-sp" || req.ProtocolBinding != HTTPPostBinding ||
+		req.Destination != "http://idp.samltools.com:5678/logon" {
+		t.Fatalf("unexpected request %#v", req)
+	}
+
+	if _, err := ParseAuthnRequest([]byte(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_1" Version="2.0"/>`)); err == nil {
+		t.Fatalf("expected a Response to be rejected")
+	}
+}
+
+func verifierForTest(t *testing.T) (*AuthnRequestVerifier, *dsig.SigningContext) {
+	keyStore := dsig.RandomKeyStoreForTest()
+	_, certDER, _ := keyStore.GetKeyPair()
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatalf("failed to parse certificate %s", err)
+	}
+	sp := &SPSSODescriptor{AuthnRequestsSigned: true}
+	sp.KeyDescriptors = []KeyDescriptor{NewKeyDescriptor("signing", cert)}
+	verifier := NewAuthnRequestVerifier([]string{"https://idp.example.com/sso"}, func(entityID string) (*SPSSODescriptor, error) {
+		if entityID != "urn:msingh.samltools:sp" {
+			return nil, fmt.Errorf("unknown Service Provider %s", entityID)
+		}
+		return sp, nil
+	})
+	signingCtx := dsig.NewDefaultSigningContext(keyStore)
+	signingCtx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	return verifier, signingCtx
+}
+
+func redirectQueryForTest(t *testing.T, req *AuthnRequest, signingCtx *dsig.SigningContext) string {
+	message, _ := req.Bytes()
+	location, err := RedirectURL("https://idp.example.com/sso", SAMLRequestParam, message, "state", signingCtx)
+	if err != nil {
+		t.Fatalf("failed to build redirect %s", err)
+	}
+	u, _ := url.Parse(location)
+	return u.RawQuery
+}
+
+func TestVerifyRedirectAuthnRequest(t *testing.T) {
+	verifier, signingCtx := verifierForTest(t)
+	req := NewAuthnRequest("urn:msingh.samltools:sp", "https://idp.example.com/sso")
+	query := redirectQueryForTest(t, req, signingCtx)
+	if _, _, err := verifier.VerifyRedirect(query); err != nil {
+		t.Fatalf("expected request to verify %s", err)
+	}
+	if _, _, err := verifier.VerifyRedirect(query); err == nil {
+		t.Fatalf("expected replayed request to be rejected")
+	}
+
+	tampered := strings.Replace(redirectQueryForTest(t, NewAuthnRequest("urn:msingh.samltools:sp", "https://idp.example.com/sso"), signingCtx),
+		"RelayState=state", "RelayState=other", 1)
+	if _, sp, err := verifier.VerifyRedirect(tampered); err == nil || sp == nil {
+		t.Fatalf("expected tampered request to be rejected with the SP known, err=%v", err)
+	}
+
+	unsigned := redirectQueryForTest(t, NewAuthnRequest("urn:msingh.samltools:sp", "https://idp.example.com/sso"), nil)
+	_, _, err := verifier.VerifyRedirect(unsigned)
+	if se, ok := err.(*StatusError); !ok || se.SubCode != StatusRequestDenied {
+		t.Fatalf("expected unsigned request to be denied, got %v", err)
+	}
+
+	unknown := redirectQueryForTest(t, NewAuthnRequest("urn:unknown", "https://idp.example.com/sso"), signingCtx)
+	if _, sp, err := verifier.VerifyRedirect(unknown); err == nil || sp != nil {
+		t.Fatalf("expected request from unknown SP to be rejected, err=%v", err)
+	}
+
+	misdirected := redirectQueryForTest(t, NewAuthnRequest("urn:msingh.samltools:sp", "https://other.example.com/sso"), signingCtx)
+	if _, _, err := verifier.VerifyRedirect(misdirected); err == nil {
+		t.Fatalf("expected request with another Destination to be rejected")
+	}
+
+	stale := NewAuthnRequest("urn:msingh.samltools:sp", "https://idp.example.com/sso")
+	stale.IssueInstant = stale.IssueInstant.Add(-time.Hour)
+	if _, _, err := verifier.VerifyRedirect(redirectQueryForTest(t, stale, signingCtx)); err == nil {
+		t.Fatalf("expected stale request to be rejected")
+	}
+}
+
+func TestVerifyPOSTAuthnRequest(t *testing.T) {
+	verifier, signingCtx := verifierForTest(t)
+	message, _ := NewAuthnRequest("urn:msingh.samltools:sp", "https://idp.example.com/sso").Bytes()
+	signed, err := SignMessage(message, signingCtx)
+	if err != nil {
+		t.Fatalf("failed to sign %s", err)
+	}
+	req, _, err := verifier.VerifyPOST(base64.StdEncoding.EncodeToString(signed))
+	if err != nil {
+		t.Fatalf("expected request to verify %s", err)
+	}
+	if req.IssuerValue() != "urn:msingh.samltools:sp" {
+		t.Fatalf("unexpected issuer %s", req.IssuerValue())
+	}
+
+	tampered := strings.Replace(string(signed), "https://idp.example.com/sso", "https://idp.example.com/sso2", 1)
+	if _, _, err := verifier.VerifyPOST(base64.StdEncoding.EncodeToString([]byte(tampered))); err == nil {
+		t.Fatalf("expected tampered request to be rejected")
+	}
+}
+
+func TestCreateErrorResponse(t *testing.T) {
+	encoded, err := CreateErrorResponse("http://idp.samltools.com", "_req1", "http://sp.samltools.com:4567/assertion",
+		RequesterError(StatusRequestDenied, "denied"), nil)
+	if err != nil {
+		t.Fatalf("failed to create response %s", err)
+	}
+	data, _ := base64.StdEncoding.DecodeString(encoded)
+	for _, want := range []string{`InResponseTo="_req1"`, `<samlp:StatusCode Value="` + StatusRequestDenied + `"/>`, "<samlp:StatusMessage>denied</samlp:StatusMessage>"} {
+		if !strings.Contains(string(data), want) {
+			t.Fatalf("expected %s in %s", want, data)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package samltools
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/beevik/etree"
+	perrors "github.com/pkg/errors"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// Query string and form parameters of the HTTP-Redirect and HTTP-POST bindings.
+const (
+	SAMLRequestParam  = "SAMLRequest"
+	SAMLResponseParam = "SAMLResponse"
+	RelayStateParam   = "RelayState"
+	SigAlgParam       = "SigAlg"
+	SignatureParam    = "Signature"
+)
+
+// BindingURI returns the URI of a binding named redirect, post, artifact or soap, or already given
+// by its URI. An empty name gives an empty URI.
+func BindingURI(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return "", nil
+	case "redirect", strings.ToLower(HTTPRedirectBinding):
+		return HTTPRedirectBinding, nil
+	case "post", strings.ToLower(HTTPPostBinding):
+		return HTTPPostBinding, nil
+	case "artifact", strings.ToLower(HTTPArtifactBinding):
+		return HTTPArtifactBinding, nil
+	case "soap", strings.ToLower(SOAPBinding):
+		return SOAPBinding, nil
+	}
+	return "", fmt.Errorf("unsupported binding %s", name)
+}
+
+// DeflateAndEncode applies the DEFLATE encoding of the HTTP-Redirect binding to a message.
+func DeflateAndEncode(message []byte) (string, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(message); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// DecodeAndInflate reverses DeflateAndEncode.
+func DecodeAndInflate(encoded string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, perrors.Wrap(err, "Base64 decoding failed")
+	}
+	zr := flate.NewReader(bytes.NewReader(data))
+	defer zr.Close()
+	message, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, perrors.Wrap(err, "Inflating message failed")
+	}
+	return message, nil
+}
+
+// RedirectURL returns location with the message added to its query string as the
+// HTTP-Redirect binding expects. param is SAMLRequestParam or SAMLResponseParam.
+// When signingCtx is set, the SAMLRequest (or SAMLResponse), RelayState and SigAlg
+// parameters are signed exactly as encoded and the signature added as Signature.
+func RedirectURL(location string, param string, message []byte, relayState string, signingCtx *dsig.SigningContext) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", perrors.Wrap(err, "Invalid redirect location")
+	}
+	encoded, err := DeflateAndEncode(message)
+	if err != nil {
+		return "", err
+	}
+	query := param + "=" + url.QueryEscape(encoded)
+	if relayState != "" {
+		query += "&" + RelayStateParam + "=" + url.QueryEscape(relayState)
+	}
+	if signingCtx != nil {
+		sigAlg := signingCtx.GetSignatureMethodIdentifier()
+		if sigAlg == "" {
+			return "", fmt.Errorf("unsupported signature hash %v", signingCtx.Hash)
+		}
+		query += "&" + SigAlgParam + "=" + url.QueryEscape(sigAlg)
+		signature, err := signingCtx.SignString(query)
+		if err != nil {
+			return "", perrors.Wrap(err, "Signing redirect query failed")
+		}
+		query += "&" + SignatureParam + "=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+	}
+	if u.RawQuery != "" {
+		query = strings.TrimSuffix(u.RawQuery, "&") + "&" + query
+	}
+	u.RawQuery = query
+	return u.String(), nil
+}
+
+// SignMessage adds an enveloped signature to a protocol message, placed right
+// after its Issuer, for the bindings that carry the XML as is, like HTTP-POST.
+// The root element of the message must have an ID attribute.
+func SignMessage(message []byte, signingCtx *dsig.SigningContext) ([]byte, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(message); err != nil {
+		return nil, perrors.Wrap(err, "Failed to parse message")
+	}
+	root := doc.Root()
+	if root == nil {
+		return nil, fmt.Errorf("empty message")
+	}
+	if root.SelectAttrValue("ID", "") == "" {
+		return nil, fmt.Errorf("message element doesn't contain ID attribute")
+	}
+	signed, err := signEnvelopedAfter(signingCtx, root, "Issuer")
+	if err != nil {
+		return nil, err
+	}
+	sdoc := etree.NewDocument()
+	sdoc.SetRoot(signed)
+	return sdoc.WriteToBytes()
+}
+
+var redirectSignatureHashes = map[string]crypto.Hash{
+	dsig.RSASHA1SignatureMethod:   crypto.SHA1,
+	dsig.RSASHA256SignatureMethod: crypto.SHA256,
+	dsig.RSASHA512SignatureMethod: crypto.SHA512,
+}
+
+// VerifyRedirectSignature checks the Signature of an HTTP-Redirect binding query
+// string against the certificates of its sender. The signed content is rebuilt from
+// the parameters as they were encoded by the sender, not from their decoded values.
+func VerifyRedirectSignature(rawQuery string, certs []*x509.Certificate) error {
+	raw := map[string]string{}
+	for _, part := range strings.Split(rawQuery, "&") {
+		kv := strings.SplitN(part, "=", 2)
+		key, err := url.QueryUnescape(kv[0])
+		if err != nil || len(kv) != 2 {
+			continue
+		}
+		if _, ok := raw[key]; !ok {
+			raw[key] = kv[1]
+		}
+	}
+	param := SAMLRequestParam
+	if _, ok := raw[param]; !ok {
+		param = SAMLResponseParam
+	}
+	if _, ok := raw[param]; !ok {
+		return fmt.Errorf("query string doesn't contain a SAML message")
+	}
+	if raw[SignatureParam] == "" || raw[SigAlgParam] == "" {
+		return fmt.Errorf("query string isn't signed")
+	}
+	signed := param + "=" + raw[param]
+	if relayState, ok := raw[RelayStateParam]; ok {
+		signed += "&" + RelayStateParam + "=" + relayState
+	}
+	signed += "&" + SigAlgParam + "=" + raw[SigAlgParam]
+
+	sigAlg, err := url.QueryUnescape(raw[SigAlgParam])
+	if err != nil {
+		return perrors.Wrap(err, "Invalid SigAlg")
+	}
+	hash, ok := redirectSignatureHashes[sigAlg]
+	if !ok {
+		return fmt.Errorf("unsupported signature algorithm %s", sigAlg)
+	}
+	encodedSignature, err := url.QueryUnescape(raw[SignatureParam])
+	if err != nil {
+		return perrors.Wrap(err, "Invalid Signature")
+	}
+	signature, err := base64.StdEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return perrors.Wrap(err, "Base64 decoding of Signature failed")
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	for _, cert := range certs {
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature doesn't verify with any certificate of the sender")
+}
+
+// IsSigned reports whether the root element of a protocol message carries an enveloped signature.
+func IsSigned(message []byte) bool {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(message); err != nil || doc.Root() == nil {
+		return false
+	}
+	for _, child := range doc.Root().ChildElements() {
+		if child.Tag == "Signature" && child.NamespaceURI() == dsig.Namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyMessageSignature checks the enveloped signature of a protocol message
+// against the certificates of its sender and returns the signed content, which
+// is what should be used from then on.
+func VerifyMessageSignature(message []byte, certs []*x509.Certificate) ([]byte, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(message); err != nil {
+		return nil, perrors.Wrap(err, "Failed to parse message")
+	}
+	if doc.Root() == nil {
+		return nil, fmt.Errorf("empty message")
+	}
+	validated, err := CreateValidationContext(certs).Validate(doc.Root())
+	if err != nil {
+		return nil, perrors.Wrap(err, "Message signature validation failed")
+	}
+	vdoc := etree.NewDocument()
+	vdoc.SetRoot(validated)
+	return vdoc.WriteToBytes()
+}
+
+// InboundMessage is a SAML protocol message received through the browser with the
+// HTTP-Redirect or HTTP-POST binding.
+type InboundMessage struct {
+	Binding string
+	// Param is SAMLRequestParam or SAMLResponseParam, telling requests from responses.
+	Param      string
+	Message    []byte
+	RelayState string
+	rawQuery   string
+}
+
+// ReadInboundMessage reads the SAMLRequest or SAMLResponse of a request, from the
+// form of a POST or the query string of anything else.
+func ReadInboundMessage(req *http.Request) (*InboundMessage, error) {
+	msg := &InboundMessage{Binding: HTTPRedirectBinding, rawQuery: req.URL.RawQuery}
+	values := req.URL.Query()
+	if req.Method == http.MethodPost {
+		if err := req.ParseForm(); err != nil {
+			return nil, perrors.Wrap(err, "Can't read form")
+		}
+		msg.Binding = HTTPPostBinding
+		values = req.PostForm
+	}
+	msg.Param = SAMLRequestParam
+	encoded := values.Get(SAMLRequestParam)
+	if encoded == "" {
+		msg.Param = SAMLResponseParam
+		encoded = values.Get(SAMLResponseParam)
+	}
+	if encoded == "" {
+		return nil, fmt.Errorf("no SAML message in %s request", req.Method)
+	}
+	msg.RelayState = values.Get(RelayStateParam)
+	var err error
+	if msg.Binding == HTTPPostBinding {
+		msg.Message, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, perrors.Wrap(err, "Base64 decoding failed")
+		}
+		return msg, nil
+	}
+	if msg.Message, err = DecodeAndInflate(encoded); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// IsRequest reports whether the message is a request rather than a response.
+func (m *InboundMessage) IsRequest() bool {
+	return m.Param == SAMLRequestParam
+}
+
+// Signed reports whether the message is signed as its binding allows.
+func (m *InboundMessage) Signed() bool {
+	if m.Binding == HTTPRedirectBinding {
+		values, _ := url.ParseQuery(m.rawQuery)
+		return values.Get(SignatureParam) != ""
+	}
+	return IsSigned(m.Message)
+}
+
+// Verify checks the signature of the message against the certificates of its sender and
+// returns the content to use from then on. Unsigned messages are only accepted, as is,
+// when requireSigned is false.
+func (m *InboundMessage) Verify(certs []*x509.Certificate, requireSigned bool) ([]byte, error) {
+	if !m.Signed() {
+		if requireSigned {
+			return nil, fmt.Errorf("message isn't signed")
+		}
+		return m.Message, nil
+	}
+	if m.Binding == HTTPRedirectBinding {
+		if err := VerifyRedirectSignature(m.rawQuery, certs); err != nil {
+			return nil, err
+		}
+		return m.Message, nil
+	}
+	return VerifyMessageSignature(m.Message, certs)
+}
+
+// PostFormTemplate renders the auto-submitting form of the HTTP-POST binding. Its script
+// runs with the Nonce of SetPostFormHeaders.
+var PostFormTemplate = template.Must(template.New("postform").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Form Post</title>
+</head>
+<body>
+  <form action="{{.Location}}" method="post">
+    <input type="hidden" name="{{.Param}}" value="{{.Message}}">
+    {{if .RelayState}}<input type="hidden" name="RelayState" value="{{.RelayState}}">{{end}}
+    <noscript>
+      <p>Your browser doesn't run scripts, please continue by hand.</p>
+      <div><button type="submit">Continue</button></div>
+    </noscript>
+  </form>
+  <script nonce="{{.Nonce}}">document.forms[0].submit()</script>
+</body>
+</html>
+`))
+
+// SetPostFormHeaders sets the headers of a page posting a message through the browser: it
+// isn't cached, can't be framed, doesn't leak its address and only runs the scripts with
+// the nonce it returns. There is no form-action directive, as browsers apply it to the
+// redirects following the POST too and Assertion Consumer Services commonly redirect to
+// another origin once they have read the message.
+func SetPostFormHeaders(w http.ResponseWriter) string {
+	nonce := strings.TrimPrefix(NewID(), "_")
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "no-cache, no-store")
+	h.Set("Pragma", "no-cache")
+	h.Set("Referrer-Policy", "no-referrer")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", fmt.Sprintf("default-src 'none'; script-src 'nonce-%s'; style-src 'nonce-%s'; frame-ancestors 'none'; base-uri 'none'", nonce, nonce))
+	return nonce
+}
+
+// SendMessage sends a protocol message to location through the browser, redirecting it
+// for the HTTP-Redirect binding and rendering PostFormTemplate for the HTTP-POST binding.
+// param is SAMLRequestParam or SAMLResponseParam. The message is signed as the binding
+// requires when signingCtx is set.
+func SendMessage(w http.ResponseWriter, req *http.Request, binding string, location string, param string, message []byte, relayState string, signingCtx *dsig.SigningContext) error {
+	switch binding {
+	case HTTPRedirectBinding:
+		redirectURL, err := RedirectURL(location, param, message, relayState, signingCtx)
+		if err != nil {
+			return err
+		}
+		http.Redirect(w, req, redirectURL, http.StatusFound)
+		return nil
+	case HTTPPostBinding:
+		if signingCtx != nil {
+			var err error
+			if message, err = SignMessage(message, signingCtx); err != nil {
+				return err
+			}
+		}
+		var page bytes.Buffer
+		err := PostFormTemplate.Execute(&page, map[string]string{
+			"Location":   location,
+			"Param":      param,
+			"Message":    base64.StdEncoding.EncodeToString(message),
+			"RelayState": relayState,
+			"Nonce":      SetPostFormHeaders(w),
+		})
+		if err != nil {
+			return perrors.Wrap(err, "Failed to render the HTTP-POST form")
+		}
+		_, err = w.Write(page.Bytes())
+		return err
+	}
+	return fmt.Errorf("unsupported binding %s", binding)
+}
@@ -0,0 +1,161 @@
+package samltools
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+func TestSignedRedirectURL(t *testing.T) {
+	keyStore := dsig.RandomKeyStoreForTest()
+	signingCtx := dsig.NewDefaultSigningContext(keyStore)
+	req := NewAuthnRequest("urn:msingh.samltools:sp", "https://idp.example.com/sso")
+	message, _ := req.Bytes()
+
+	location, err := RedirectURL("https://idp.example.com/sso?tenant=a", SAMLRequestParam, message, "state 1", signingCtx)
+	if err != nil {
+		t.Fatalf("failed to build redirect %s", err)
+	}
+	u, _ := url.Parse(location)
+	if !strings.HasPrefix(u.RawQuery, "tenant=a&SAMLRequest=") {
+		t.Fatalf("unexpected query %s", u.RawQuery)
+	}
+	q := u.Query()
+	if q.Get(SigAlgParam) != dsig.RSASHA256SignatureMethod || q.Get(RelayStateParam) != "state 1" {
+		t.Fatalf("unexpected query %s", u.RawQuery)
+	}
+	decoded, err := DecodeAndInflate(q.Get(SAMLRequestParam))
+	if err != nil || string(decoded) != string(message) {
+		t.Fatalf("message not preserved, err=%v", err)
+	}
+
+	// The signature covers the parameters exactly as they appear in the query string
+	signed := u.RawQuery[strings.Index(u.RawQuery, "SAMLRequest="):strings.Index(u.RawQuery, "&Signature=")]
+	signature, _ := base64.StdEncoding.DecodeString(q.Get(SignatureParam))
+	key, _, _ := keyStore.GetKeyPair()
+	digest := sha256.Sum256([]byte(signed))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Fatalf("signature doesn't verify %s", err)
+	}
+}
+
+func TestSignMessage(t *testing.T) {
+	keyStore := dsig.RandomKeyStoreForTest()
+	signingCtx := dsig.NewDefaultSigningContext(keyStore)
+	signingCtx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	req := NewAuthnRequest("urn:msingh.samltools:sp", "https://idp.example.com/sso")
+	req.NameIDPolicy = &NameIDPolicy{Format: NameIDFormatPersistent}
+	message, _ := req.Bytes()
+
+	signed, err := SignMessage(message, signingCtx)
+	if err != nil {
+		t.Fatalf("failed to sign %s", err)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(signed); err != nil {
+		t.Fatalf("failed to parse signed message %s", err)
+	}
+	children := doc.Root().ChildElements()
+	if len(children) < 2 || children[0].Tag != "Issuer" || children[1].Tag != "Signature" {
+		t.Fatalf("expected the Signature right after the Issuer in %s", signed)
+	}
+	_, certDER, _ := keyStore.GetKeyPair()
+	cert, _ := x509.ParseCertificate(certDER)
+	if _, err := CreateValidationContext([]*x509.Certificate{cert}).Validate(doc.Root()); err != nil {
+		t.Fatalf("signature doesn't validate %s", err)
+	}
+	if _, err := ParseAuthnRequest(signed); err != nil {
+		t.Fatalf("signed request doesn't parse %s", err)
+	}
+}
+
+func TestBindingURI(t *testing.T) {
+	cases := map[string]string{"": "", "post": HTTPPostBinding, "Redirect": HTTPRedirectBinding, HTTPPostBinding: HTTPPostBinding, "soap": SOAPBinding}
+	for name, want := range cases {
+		if got, err := BindingURI(name); err != nil || got != want {
+			t.Fatalf("BindingURI(%q) = %s, %v; want %s", name, got, err, want)
+		}
+	}
+	if _, err := BindingURI("paos"); err == nil {
+		t.Fatalf("expected unsupported binding to be rejected")
+	}
+}
+
+func TestSendMessagePostForm(t *testing.T) {
+	rec := httptest.NewRecorder()
+	err := SendMessage(rec, httptest.NewRequest(http.MethodGet, "/login", nil), HTTPPostBinding, "https://idp.samltools.com/sso?x=1", SAMLRequestParam, []byte("<AuthnRequest/>"), `"><script>`, nil)
+	if err != nil {
+		t.Fatalf("failed to send message %s", err)
+	}
+	csp := rec.Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "default-src 'none'") || rec.Header().Get("Cache-Control") != "no-cache, no-store" {
+		t.Fatalf("unexpected headers %v", rec.Header())
+	}
+	nonce := regexp.MustCompile(`script-src 'nonce-([0-9a-f]+)'`).FindStringSubmatch(csp)
+	body := rec.Body.String()
+	if nonce == nil || !strings.Contains(body, `<script nonce="`+nonce[1]+`">`) || strings.Contains(body, `"><script>`) {
+		t.Fatalf("unexpected form %s", body)
+	}
+}
+
+// formActionAllows reports whether the form-action directive of the Content-Security-Policy,
+// if any, lets a form be submitted to target.
+func formActionAllows(csp string, target string) bool {
+	for _, directive := range strings.Split(csp, ";") {
+		fields := strings.Fields(directive)
+		if len(fields) == 0 || fields[0] != "form-action" {
+			continue
+		}
+		u, err := url.Parse(target)
+		if err != nil {
+			return false
+		}
+		for _, source := range fields[1:] {
+			if source == "*" || source == u.Scheme+"://"+u.Host {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func TestPostFormAllowsRedirectingACS(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer app.Close()
+	// Like the Auth0 /login/callback, the ACS redirects to the application once it has read the Response
+	acs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, app.URL+"/home", http.StatusFound)
+	}))
+	defer acs.Close()
+
+	rec := httptest.NewRecorder()
+	err := SendMessage(rec, httptest.NewRequest(http.MethodGet, "/sso", nil), HTTPPostBinding, acs.URL+"/login/callback", SAMLResponseParam, []byte("<Response/>"), "", nil)
+	if err != nil {
+		t.Fatalf("failed to send message %s", err)
+	}
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.PostForm(acs.URL+"/login/callback", url.Values{SAMLResponseParam: {"PFJlc3BvbnNlLz4="}})
+	if err != nil {
+		t.Fatalf("POST to the ACS failed %s", err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	csp := rec.Header().Get("Content-Security-Policy")
+	if !formActionAllows(csp, acs.URL) || !formActionAllows(csp, location) {
+		t.Fatalf("expected the form to be allowed to reach %s through %s, got %s", location, acs.URL, csp)
+	}
+}
@@ -0,0 +1,164 @@
+package samltools
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	perrors "github.com/pkg/errors"
+)
+
+// DevCAName is the name of the certificate and key files of the development CA in the
+// directory of DevCertificate.
+const DevCAName = "samltools-dev-ca"
+
+// DevCertificate returns the certificate and key files of a TLS server certificate for
+// the hosts, for development. The certificate is issued by a development CA, both being
+// created in dir when they don't exist yet. Servers sharing dir share the CA, which only
+// has to be trusted once by the browser.
+func DevCertificate(dir string, hosts ...string) (string, string, error) {
+	if len(hosts) == 0 {
+		return "", "", perrors.New("no host to issue a certificate for")
+	}
+	certFile := filepath.Join(dir, hosts[0]+".crt")
+	keyFile := filepath.Join(dir, hosts[0]+".key")
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if cert, err := x509.ParseCertificate(pair.Certificate[0]); err == nil && time.Now().Before(cert.NotAfter) && coversHosts(cert, hosts) {
+			return certFile, keyFile, nil
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+	ca, caKey, err := devCA(dir)
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"samltools development"}, CommonName: hosts[0]},
+		DNSNames:    hosts,
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.AddDate(1, 0, 0),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if err := writeDevCertificate(template, ca, caKey, certFile, keyFile); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// ServeOptions are the TLS settings of ListenAndServe.
+type ServeOptions struct {
+	HTTPS    bool
+	CertFile string
+	KeyFile  string
+	// DevDir, when there is no CertFile, holds the development certificate of Host
+	// returned by DevCertificate. No development certificate is used when it is empty.
+	DevDir string
+	Host   string
+}
+
+// ListenAndServe serves handler on addr, over TLS with the certificate of opts when
+// opts.HTTPS is set.
+func ListenAndServe(addr string, handler http.Handler, opts ServeOptions) error {
+	if !opts.HTTPS {
+		return http.ListenAndServe(addr, handler)
+	}
+	certFile, keyFile := opts.CertFile, opts.KeyFile
+	if certFile == "" && opts.DevDir != "" {
+		var err error
+		if certFile, keyFile, err = DevCertificate(opts.DevDir, opts.Host); err != nil {
+			return err
+		}
+		fmt.Printf("Using development certificate %s, trust %s in the browser\n", certFile, filepath.Join(opts.DevDir, DevCAName+".crt"))
+	}
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("https needs a certificate and its key, or a development certificate")
+	}
+	return http.ListenAndServeTLS(addr, certFile, keyFile, handler)
+}
+
+// devCA returns the development CA of dir, creating it when there is none.
+func devCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile := filepath.Join(dir, DevCAName+".crt")
+	keyFile := filepath.Join(dir, DevCAName+".key")
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		now := time.Now()
+		template := &x509.Certificate{
+			Subject:               pkix.Name{Organization: []string{"samltools development"}, CommonName: "samltools development CA"},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.AddDate(10, 0, 0),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			MaxPathLenZero:        true,
+		}
+		if err := writeDevCertificate(template, nil, nil, certFile, keyFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, perrors.Wrap(err, "Failed to read the development CA")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, perrors.Wrap(err, "Failed to read the development CA")
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, perrors.New("the development CA key isn't an ECDSA key")
+	}
+	return cert, key, nil
+}
+
+// writeDevCertificate creates a key and the certificate for it from template, issued by
+// the CA or self-signed when ca is nil, and writes them in PEM files.
+func writeDevCertificate(template *x509.Certificate, ca *x509.Certificate, caKey *ecdsa.PrivateKey, certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template.SerialNumber = serial
+	if ca == nil {
+		ca, caKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return perrors.Wrap(err, "Failed to create certificate")
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func coversHosts(cert *x509.Certificate, hosts []string) bool {
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
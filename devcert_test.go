@@ -0,0 +1,52 @@
+package samltools
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDevCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devtls")
+	if err != nil {
+		t.Fatalf("failed to create directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, err := DevCertificate(dir, "sp.samltools.com")
+	if err != nil {
+		t.Fatalf("failed to create certificate %s", err)
+	}
+	if _, _, err := DevCertificate(dir, "idp.samltools.com"); err != nil {
+		t.Fatalf("failed to create certificate %s", err)
+	}
+	ca, err := ReadCertificateFile(filepath.Join(dir, DevCAName+".crt"))
+	if err != nil {
+		t.Fatalf("failed to read the CA %s", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for _, host := range []string{"sp.samltools.com", "idp.samltools.com"} {
+		pair, err := tls.LoadX509KeyPair(filepath.Join(dir, host+".crt"), filepath.Join(dir, host+".key"))
+		if err != nil {
+			t.Fatalf("failed to read certificate %s", err)
+		}
+		cert, _ := x509.ParseCertificate(pair.Certificate[0])
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Fatalf("expected certificate of %s to be issued by the CA %s", host, err)
+		}
+	}
+
+	before, _ := ioutil.ReadFile(certFile)
+	if again, _, err := DevCertificate(dir, "sp.samltools.com"); err != nil || again != certFile {
+		t.Fatalf("failed to reuse certificate %s", err)
+	}
+	if after, _ := ioutil.ReadFile(certFile); string(after) != string(before) {
+		t.Fatalf("expected the certificate to be reused")
+	}
+	if info, _ := os.Stat(keyFile); info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the key to only be readable by its owner, got %s", info.Mode())
+	}
+}
@@ -6,7 +6,9 @@ require (
 	github.com/beevik/etree v1.1.0
 	github.com/pkg/errors v0.8.1
 	github.com/russellhaering/goxmldsig v1.1.0
-	github.com/spf13/cobra v1.2.1 // indirect
+	github.com/spf13/cobra v1.2.1
 	github.com/spf13/viper v1.8.1
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
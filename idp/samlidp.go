@@ -1,89 +1,89 @@
 package main
 
 import (
-	"bytes"
-	"compress/flate"
-	"encoding/base64"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
 	"net/http"
-	"os"
 
-	"github.com/beevik/etree"
 	"github.com/monmohan/samltools"
-	perrors "github.com/pkg/errors"
+	"github.com/monmohan/samltools/samlidp"
 	dsig "github.com/russellhaering/goxmldsig"
 	"github.com/spf13/viper"
 )
 
 var defaultSigningContext *dsig.SigningContext
 
-func handleLogonRequest(w http.ResponseWriter, req *http.Request) {
+// spMetadata keeps the metadata of the Service Providers this IdP accepts requests
+// from up to date, nil when sp_metadata isn't configured.
+var spMetadata *samltools.MetadataRefresher
 
-	authnReq := req.URL.Query().Get("SAMLRequest")
-	relayState := req.URL.Query().Get("RelayState")
+// spMDQ resolves Service Providers missing from spMetadata, nil when no MDQ responder is configured.
+var spMDQ *samltools.MDQClient
 
-	athnReqBytes, err := decodeSAMLRequest(authnReq)
-	if err != nil {
-		badRequest(err, w)
-		return
+// registry holds the Service Providers configured through sp_registry and sp_entity_id.
+var registry *samlidp.Registry
 
-	}
-	doc := etree.NewDocument()
-	if err := doc.ReadFromBytes(athnReqBytes); err != nil {
-		badRequest(err, w)
-		return
-	}
-	//DEBUG LOG
-	doc.WriteTo(os.Stdout)
-	fmt.Println()
+// idp is this Identity Provider, authenticating users as set up by setAuthenticator.
+var idp *samlidp.IdentityProvider
 
-	reqEl := doc.FindElement("./samlp:AuthnRequest")
-	if reqEl == nil {
-		badRequest(perrors.New("Can't read AuthnRequest element"), w)
-		return
+// ssoBindings returns the bindings AuthnRequests may be received with, listed by
+// sso_bindings. Both HTTP-Redirect and HTTP-POST are by default.
+func ssoBindings() []string {
+	var bindings []string
+	for _, name := range viper.GetStringSlice("sso_bindings") {
+		b, err := samltools.BindingURI(name)
+		if err != nil {
+			fmt.Printf("Ignoring sso_bindings entry: %s\n", err)
+			continue
+		}
+		bindings = append(bindings, b)
 	}
+	return bindings
+}
 
-	inResponseTo := reqEl.SelectAttr("ID")
-	if inResponseTo == nil {
-		badRequest(perrors.New("AuthnRequest element doesn't contain ID attribute"), w)
-		return
+// setAuthenticator has users log in with the login page, as the users of users_file,
+// or as IDPUser1 without asking when it isn't set.
+func setAuthenticator(loginPath string) error {
+	usersFile := viper.GetString("users_file")
+	if usersFile == "" {
+		idp.Authenticator = samlidp.FixedUser(samlidp.User{Name: "IDPUser1"})
+		idp.AttributeSource = samlidp.AttributeSourceFunc(sampleAttributes)
+		return nil
 	}
-	issuerEl := reqEl.FindElement("./saml:Issuer")
-	if issuerEl == nil {
-		badRequest(perrors.New("Can't read Issuer element"), w)
-		return
+	users, err := samlidp.LoadUserStore(usersFile)
+	if err != nil {
+		return err
 	}
-	audience := issuerEl.Text()
-	if len(audience) == 0 {
-		badRequest(perrors.New("AuthnRequest element doesn't contain Issuer"), w)
-		return
+	form := &samlidp.LoginForm{Users: users, Action: loginPath}
+	if form.Template, err = template.ParseFiles("../pages/idplogin.html"); err != nil {
+		return err
 	}
-	fmt.Printf("Generating response for request ID = %s, audience=%s\n", inResponseTo.Value, audience)
+	idp.Authenticator = form
+	idp.AttributeSource = users
+	return nil
+}
 
-	acsUrl := viper.GetString("acs_url")
-	idpIssuer := fmt.Sprintf("%s//%s", viper.GetString("protocol"), viper.GetString("host"))
+// sampleAttributes are the attributes of IDPUser1.
+func sampleAttributes(user *samlidp.User, spEntityID string) (map[string][]string, error) {
+	return map[string][]string{
+		"name":   {user.Name},
+		"email":  {"dev.null.dump.1@gmail.com"},
+		"userid": {user.Name},
+	}, nil
+}
 
-	assertion, err := samltools.CreateSAMLResponse(idpIssuer, inResponseTo.Value, acsUrl, audience, defaultSigningContext)
-	if err != nil {
-		badRequest(err, w)
-		return
-	}
-	fmt.Printf("\n------Assertion------\n\n%s\n--------END-----\n\n", assertion)
-	if err != nil {
-		fmt.Printf("Error generating assertion %s", err.Error())
-	}
-	t, err := template.ParseFiles("../pages/idpresp.html")
-	if err != nil {
-		fmt.Printf("Error generating template %s", err.Error())
-	}
-	t.Execute(w, map[string]string{
-		"Base64Assertion": template.HTMLEscapeString(assertion),
-		"RelayState":      relayState,
-		"ACSUrl":          acsUrl})
+func idpIssuer() string {
+	return fmt.Sprintf("%s://%s", viper.GetString("protocol"), viper.GetString("host"))
+}
 
+// ssoURL returns the location AuthnRequests must be addressed to.
+func ssoURL() string {
+	if ssoURL := viper.GetString("sso_url"); ssoURL != "" {
+		return ssoURL
+	}
+	return fmt.Sprintf("%s://%s:%v%s", viper.GetString("protocol"), viper.GetString("host"),
+		viper.GetInt("port"), viper.GetString("logon_path"))
 }
 
 func main() {
@@ -92,16 +92,75 @@ func main() {
 	if err != nil {
 		log.Fatalf("Unable to read config file, %s", err.Error())
 	}
-	http.HandleFunc(viper.GetString("logon_path"), handleLogonRequest)
+	if err := loadTrustedSPs(); err != nil {
+		log.Fatalf("Unable to read SP metadata, %s", err.Error())
+	}
+	idp = samlidp.NewIdentityProvider(idpIssuer(), ssoURL(), defaultSigningContext, registry)
+	loginPath := viper.GetString("login_path")
+	if loginPath == "" {
+		loginPath = "/login"
+	}
+	if err := setAuthenticator(loginPath); err != nil {
+		log.Fatalf("Unable to read users, %s", err.Error())
+	}
+	idp.SSOBindings = ssoBindings()
+	idp.AuthnRequestVerifier.WantAuthnRequestsSigned = viper.GetBool("want_authn_requests_signed")
+	if maxAge := viper.GetDuration("authn_request_max_age"); maxAge > 0 {
+		idp.AuthnRequestVerifier.MaxAge = maxAge
+	}
+	if lifetime := viper.GetDuration("session_lifetime"); lifetime > 0 {
+		idp.Sessions.Lifetime = lifetime
+	}
+	if idp.ResponseTemplate, err = template.ParseFiles("../pages/idpresp.html"); err != nil {
+		log.Fatalf("Unable to read the Response page, %s", err.Error())
+	}
+	idp.DebugResponses = viper.GetBool("debug_responses")
+	artifactPath := viper.GetString("artifact_resolution_path")
+	if artifactPath == "" {
+		artifactPath = "/artifact"
+	}
+	http.Handle(artifactPath, idp.Artifacts)
+	sloPath := viper.GetString("slo_path")
+	if sloPath == "" {
+		sloPath = "/slo"
+	}
+	idp.SLOURL = fmt.Sprintf("%s://%s:%v%s", viper.GetString("protocol"), viper.GetString("host"), viper.GetInt("port"), sloPath)
+	http.HandleFunc(loginPath, idp.Login)
+	http.HandleFunc(sloPath, idp.SLO)
+	http.HandleFunc("/logout", idp.Logout)
+	initiatePath := viper.GetString("idp_initiated_path")
+	if initiatePath == "" {
+		initiatePath = "/initiate"
+	}
+	http.HandleFunc(initiatePath, idp.IdPInitiated)
+	http.HandleFunc(viper.GetString("logon_path"), idp.SSO)
 	fs := http.FileServer(http.Dir("../pages"))
 	http.Handle("/pages/", http.StripPrefix("/pages/", fs))
 	serverUrl := fmt.Sprintf("%s:%v", viper.GetString("host"), viper.GetInt("port"))
-	fmt.Printf("Server URL : %s\n", serverUrl)
-	fmt.Printf("Logon URL : %s", fmt.Sprintf("%s%s\n", serverUrl, viper.GetString("logon_path")))
-	log.Fatal(http.ListenAndServe(serverUrl, nil))
+	fmt.Printf("Server URL : %s://%s\n", viper.GetString("protocol"), serverUrl)
+	fmt.Printf("Logon URL : %s", fmt.Sprintf("%s://%s%s\n", viper.GetString("protocol"), serverUrl, viper.GetString("logon_path")))
+	log.Fatal(samltools.ListenAndServe(serverUrl, nil, serveOptions()))
 
 }
 
+// serveOptions returns the TLS settings of protocol, tls_cert and tls_key, or tls_dev and
+// tls_dev_dir for a development certificate.
+func serveOptions() samltools.ServeOptions {
+	opts := samltools.ServeOptions{
+		HTTPS:    viper.GetString("protocol") == "https",
+		CertFile: viper.GetString("tls_cert"),
+		KeyFile:  viper.GetString("tls_key"),
+		Host:     viper.GetString("host"),
+	}
+	if viper.GetBool("tls_dev") {
+		opts.DevDir = viper.GetString("tls_dev_dir")
+		if opts.DevDir == "" {
+			opts.DevDir = "../config/dev-tls"
+		}
+	}
+	return opts
+}
+
 func createDefaultSigningContext() {
 	keyStore := samltools.NewIDPKeyStore(viper.GetString("private_key_file"))
 	defaultSigningContext = dsig.NewDefaultSigningContext(keyStore)
@@ -109,30 +168,94 @@ func createDefaultSigningContext() {
 
 }
 
-func config() error {
-	viper.SetConfigName("idpconfig")
-	viper.SetConfigFile("../config/idpconfig.yaml")
-	return viper.ReadInConfig()
+func loadTrustedSPs() error {
+	registry = samlidp.NewRegistry()
+	if file := viper.GetString("sp_registry"); file != "" {
+		r, err := samlidp.LoadRegistry(file, map[string]string{"protocol": viper.GetString("protocol")})
+		if err != nil {
+			return err
+		}
+		registry = r
+	}
+	if entityID := viper.GetString("sp_entity_id"); entityID != "" {
+		if err := registry.Add(configuredSP(entityID)); err != nil {
+			return err
+		}
+	}
+	registry.Fallback = samlidp.ServiceProviderFunc(lookupSP)
+	if mdqURL := viper.GetString("mdq_url"); mdqURL != "" {
+		client, err := createMDQClient(mdqURL)
+		if err != nil {
+			return err
+		}
+		spMDQ = client
+	}
+	source := viper.GetString("sp_metadata")
+	if source == "" {
+		return nil
+	}
+	filters := samltools.MetadataFilters(viper.GetString("metadata_registration_authority"),
+		viper.GetStringMapString("metadata_entity_attributes"))
+	spMetadata = samltools.NewMetadataRefresher(source, viper.GetString("sp_metadata_cache"), filters...)
+	if certFile := viper.GetString("sp_metadata_cert"); certFile != "" {
+		vc, err := samltools.CreateValidationContextFromCertFile(certFile)
+		if err != nil {
+			return err
+		}
+		spMetadata.ValidationContext = vc
+	}
+	if err := spMetadata.Load(); err != nil {
+		return err
+	}
+	go spMetadata.Run(nil)
+	return nil
 }
 
-func decodeSAMLRequest(req string) (decoded []byte, err error) {
-	fmt.Printf("\nRaw SAML Request %s\n", req)
-
-	data, err := base64.StdEncoding.DecodeString(string(req))
-	if err != nil {
-		return []byte{}, perrors.Wrap(err, "Base64 decoding failed")
+func createMDQClient(mdqURL string) (*samltools.MDQClient, error) {
+	certFile := viper.GetString("mdq_cert")
+	if certFile == "" {
+		return nil, fmt.Errorf("mdq_cert is required to verify the responses of %s", mdqURL)
 	}
-	zr := flate.NewReader(bytes.NewReader([]byte(data)))
-	var b bytes.Buffer
-	if _, err := io.Copy(&b, zr); err != nil {
-		return []byte{}, perrors.Wrap(err, "Copy() while decoding request failed")
+	validationContext, err := samltools.CreateValidationContextFromCertFile(certFile)
+	if err != nil {
+		return nil, err
 	}
-	if err := zr.Close(); err != nil {
-		return []byte{}, perrors.Wrap(err, "Close() while decoding request failed")
+	return samltools.NewMDQClient(mdqURL, validationContext), nil
+}
+
+// configuredSP is the Service Provider configured through sp_entity_id, acs_url,
+// sp_slo_url and sp_cert, a shorthand for a registry of a single Service Provider.
+func configuredSP(entityID string) *samlidp.ServiceProviderConfig {
+	return &samlidp.ServiceProviderConfig{
+		EntityID:            entityID,
+		ACSURLs:             []string{viper.GetString("acs_url")},
+		ResponseBinding:     viper.GetString("sp_response_binding"),
+		SLOURL:              viper.GetString("sp_slo_url"),
+		SLOBinding:          viper.GetString("sp_slo_binding"),
+		SigningCert:         viper.GetString("sp_cert"),
+		AuthnRequestsSigned: viper.GetBool("sp_authn_requests_signed"),
+		ReleaseAll:          viper.GetBool("sp_release_all"),
 	}
+}
 
-	return b.Bytes(), nil
+// lookupSP returns the metadata of a Service Provider missing from the registry: one
+// found in sp_metadata or, failing that, one resolved by the MDQ responder.
+func lookupSP(entityID string) (*samltools.SPSSODescriptor, error) {
+	if spMetadata != nil {
+		if sp, ok := spMetadata.Index().SP(entityID); ok {
+			return sp, nil
+		}
+	}
+	if spMDQ != nil {
+		return spMDQ.SP(entityID)
+	}
+	return nil, fmt.Errorf("Service Provider %s not found in metadata", entityID)
+}
 
+func config() error {
+	viper.SetConfigName("idpconfig")
+	viper.SetConfigFile("../config/idpconfig.yaml")
+	return viper.ReadInConfig()
 }
 
 func badRequest(err error, w http.ResponseWriter) {
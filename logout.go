@@ -0,0 +1,394 @@
+package samltools
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	perrors "github.com/pkg/errors"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// LogoutRequest is the samlp:LogoutRequest protocol message of the Single Logout profile.
+type LogoutRequest struct {
+	XMLName        xml.Name   `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutRequest"`
+	ID             string     `xml:"ID,attr"`
+	Version        string     `xml:"Version,attr"`
+	IssueInstant   time.Time  `xml:"IssueInstant,attr"`
+	Destination    string     `xml:"Destination,attr,omitempty"`
+	NotOnOrAfter   *time.Time `xml:"NotOnOrAfter,attr,omitempty"`
+	Reason         string     `xml:"Reason,attr,omitempty"`
+	Issuer         *Issuer    `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	NameID         *NameID    `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+	SessionIndexes []string   `xml:"urn:oasis:names:tc:SAML:2.0:protocol SessionIndex"`
+}
+
+// LogoutResponse is the samlp:LogoutResponse protocol message answering a LogoutRequest.
+type LogoutResponse struct {
+	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutResponse"`
+	ID           string    `xml:"ID,attr"`
+	InResponseTo string    `xml:"InResponseTo,attr,omitempty"`
+	Version      string    `xml:"Version,attr"`
+	IssueInstant time.Time `xml:"IssueInstant,attr"`
+	Destination  string    `xml:"Destination,attr,omitempty"`
+	Issuer       *Issuer   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Status       Status    `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+}
+
+// Reasons a LogoutRequest may give for the logout.
+const (
+	LogoutReasonUser  = "urn:oasis:names:tc:SAML:2.0:logout:user"
+	LogoutReasonAdmin = "urn:oasis:names:tc:SAML:2.0:logout:admin"
+)
+
+// NewLogoutRequest returns a LogoutRequest for the session of the principal identified
+// by nameID, limited to the given session indexes when there are any.
+func NewLogoutRequest(issuer string, destination string, nameID NameID, sessionIndexes ...string) *LogoutRequest {
+	return &LogoutRequest{
+		ID:             NewID(),
+		Version:        "2.0",
+		IssueInstant:   time.Now().UTC().Truncate(time.Second),
+		Destination:    destination,
+		Reason:         LogoutReasonUser,
+		Issuer:         &Issuer{Value: issuer},
+		NameID:         &nameID,
+		SessionIndexes: sessionIndexes,
+	}
+}
+
+// ParseLogoutRequest unmarshals a samlp:LogoutRequest and checks the elements every request must carry.
+func ParseLogoutRequest(data []byte) (*LogoutRequest, error) {
+	req := &LogoutRequest{}
+	if err := xml.Unmarshal(data, req); err != nil {
+		return nil, perrors.Wrap(err, "Can't read LogoutRequest element")
+	}
+	if req.ID == "" {
+		return nil, fmt.Errorf("LogoutRequest element doesn't contain ID attribute")
+	}
+	if req.NameID == nil || req.NameID.Value == "" {
+		return nil, fmt.Errorf("LogoutRequest %s doesn't identify the principal with a NameID", req.ID)
+	}
+	return req, nil
+}
+
+// IssuerValue returns the entity ID of the sender of the request.
+func (r *LogoutRequest) IssuerValue() string {
+	if r.Issuer == nil {
+		return ""
+	}
+	return r.Issuer.Value
+}
+
+// Expired reports whether the request has passed its NotOnOrAfter time.
+func (r *LogoutRequest) Expired(now time.Time) bool {
+	return r.NotOnOrAfter != nil && !now.Before(*r.NotOnOrAfter)
+}
+
+// LogoutRequestMaxAge is how long after its IssueInstant a LogoutRequest is accepted,
+// besides ClockSkew.
+const LogoutRequestMaxAge = 5 * time.Minute
+
+// CheckLogoutRequest checks a LogoutRequest received at destination is addressed to it,
+// fresh and, with replay, not received before. Signed requests must give their Destination,
+// which is only checked when destination is set.
+func CheckLogoutRequest(r *LogoutRequest, destination string, signed bool, replay *ReplayCache, now time.Time) *StatusError {
+	if r.Destination == "" {
+		if signed {
+			return RequesterError("", "signed LogoutRequest doesn't contain Destination")
+		}
+	} else if destination != "" && r.Destination != destination {
+		return RequesterError(StatusRequestDenied, "LogoutRequest was sent to %s", r.Destination)
+	}
+	if r.Expired(now) {
+		return RequesterError(StatusRequestDenied, "LogoutRequest %s has expired", r.ID)
+	}
+	expires := r.IssueInstant.Add(LogoutRequestMaxAge + ClockSkew)
+	if r.IssueInstant.After(now.Add(ClockSkew)) || now.After(expires) {
+		return RequesterError(StatusRequestDenied, "LogoutRequest issued at %s is stale", r.IssueInstant)
+	}
+	if replay != nil && !replay.Add(r.IssuerValue()+" "+r.ID, expires) {
+		return RequesterError(StatusRequestDenied, "LogoutRequest %s was already received", r.ID)
+	}
+	return nil
+}
+
+func (r *LogoutRequest) Bytes() ([]byte, error) {
+	return xml.Marshal(r)
+}
+
+// NewLogoutResponse returns the LogoutResponse to the LogoutRequest with ID inResponseTo,
+// reporting status, or Success when status is nil.
+func NewLogoutResponse(issuer string, destination string, inResponseTo string, status *StatusError) *LogoutResponse {
+	return &LogoutResponse{
+		ID:           NewID(),
+		InResponseTo: inResponseTo,
+		Version:      "2.0",
+		IssueInstant: time.Now().UTC().Truncate(time.Second),
+		Destination:  destination,
+		Issuer:       &Issuer{Value: issuer},
+		Status:       NewStatus(status),
+	}
+}
+
+// ParseLogoutResponse unmarshals a samlp:LogoutResponse.
+func ParseLogoutResponse(data []byte) (*LogoutResponse, error) {
+	resp := &LogoutResponse{}
+	if err := xml.Unmarshal(data, resp); err != nil {
+		return nil, perrors.Wrap(err, "Can't read LogoutResponse element")
+	}
+	if resp.ID == "" {
+		return nil, fmt.Errorf("LogoutResponse element doesn't contain ID attribute")
+	}
+	return resp, nil
+}
+
+// IssuerValue returns the entity ID of the sender of the response.
+func (r *LogoutResponse) IssuerValue() string {
+	if r.Issuer == nil {
+		return ""
+	}
+	return r.Issuer.Value
+}
+
+func (r *LogoutResponse) Bytes() ([]byte, error) {
+	return xml.Marshal(r)
+}
+
+// LogoutPropagation is the progress of an Identity Provider ending a session at each of
+// its participants in turn, sending a LogoutRequest through the browser and waiting for
+// the LogoutResponse before going on to the next one.
+type LogoutPropagation struct {
+	// Initiator is the Service Provider whose LogoutRequest started the logout, empty
+	// when it started at the IdP.
+	Initiator          string
+	InitiatorRequestID string
+	InitiatorBinding   string
+	RelayState         string
+	// Pending are the participants still to be logged out.
+	Pending []SessionParticipant
+	// Current is the Service Provider the last LogoutRequest was sent to.
+	Current string
+	// Failed are the Service Providers whose session couldn't be ended.
+	Failed []string
+}
+
+// Next removes the next participant to log out from Pending.
+func (p *LogoutPropagation) Next() (SessionParticipant, bool) {
+	if len(p.Pending) == 0 {
+		return SessionParticipant{}, false
+	}
+	next := p.Pending[0]
+	p.Pending = p.Pending[1:]
+	p.Current = next.SPEntityID
+	return next, true
+}
+
+// Fail records that the session at the Service Provider couldn't be ended.
+func (p *LogoutPropagation) Fail(spEntityID string) {
+	p.Failed = append(p.Failed, spEntityID)
+}
+
+// Status returns the status to report to the initiator: nil for Success, or a
+// PartialLogout when the session couldn't be ended everywhere.
+func (p *LogoutPropagation) Status() *StatusError {
+	if len(p.Failed) == 0 {
+		return nil
+	}
+	return &StatusError{
+		Code:    StatusSuccess,
+		SubCode: StatusPartialLogout,
+		Message: fmt.Sprintf("Logout failed at %s", strings.Join(p.Failed, ", ")),
+	}
+}
+
+// LogoutTracker keeps the LogoutPropagations waiting for a LogoutResponse, by the ID of
+// the LogoutRequest they sent. Those left waiting longer than TTL are forgotten.
+type LogoutTracker struct {
+	TTL time.Duration
+
+	mu      sync.Mutex
+	waiting map[string]trackedLogout
+}
+
+type trackedLogout struct {
+	propagation *LogoutPropagation
+	expires     time.Time
+}
+
+func NewLogoutTracker() *LogoutTracker {
+	return &LogoutTracker{TTL: 5 * time.Minute, waiting: map[string]trackedLogout{}}
+}
+
+// Await records that the propagation waits for the response to the LogoutRequest requestID.
+func (t *LogoutTracker) Await(requestID string, p *LogoutPropagation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for id, tl := range t.waiting {
+		if !now.Before(tl.expires) {
+			delete(t.waiting, id)
+		}
+	}
+	t.waiting[requestID] = trackedLogout{propagation: p, expires: now.Add(t.TTL)}
+}
+
+// Take returns and forgets the propagation waiting for the response to requestID.
+func (t *LogoutTracker) Take(requestID string) (*LogoutPropagation, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tl, ok := t.waiting[requestID]
+	delete(t.waiting, requestID)
+	if !ok || !time.Now().Before(tl.expires) {
+		return nil, false
+	}
+	return tl.propagation, true
+}
+
+// SOAPLogoutClient sends the LogoutRequests of an Identity Provider to Service Providers
+// over the SOAP back-channel, which doesn't depend on the browser reaching them.
+type SOAPLogoutClient struct {
+	EntityID string
+	Client   *http.Client
+	// SigningContext, when set, signs LogoutRequests.
+	SigningContext *dsig.SigningContext
+}
+
+// NewSOAPLogoutClient returns a client for the Identity Provider entityID. tlsConfig,
+// when set, configures the back-channel connections.
+func NewSOAPLogoutClient(entityID string, signingCtx *dsig.SigningContext, tlsConfig *tls.Config) *SOAPLogoutClient {
+	client := &http.Client{Timeout: 10 * time.Second}
+	if tlsConfig != nil {
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	return &SOAPLogoutClient{EntityID: entityID, Client: client, SigningContext: signingCtx}
+}
+
+// Logout ends the session of the participant at its SOAP SingleLogoutService location.
+// The LogoutResponse must be signed with one of certs, the signing certificates of the
+// Service Provider, unless it has none.
+func (c *SOAPLogoutClient) Logout(location string, p SessionParticipant, certs []*x509.Certificate) error {
+	logoutRequest := NewLogoutRequest(c.EntityID, location, p.NameID, p.SessionIndex)
+	message, err := logoutRequest.Bytes()
+	if err != nil {
+		return err
+	}
+	if c.SigningContext != nil {
+		if message, err = SignMessage(message, c.SigningContext); err != nil {
+			return err
+		}
+	}
+	data, err := soapCall(c.Client, location, "LogoutRequest", message)
+	if err != nil {
+		return err
+	}
+	if IsSigned(data) || len(certs) > 0 {
+		if data, err = VerifyMessageSignature(data, certs); err != nil {
+			return err
+		}
+	}
+	logoutResponse, err := ParseLogoutResponse(data)
+	if err != nil {
+		return err
+	}
+	if logoutResponse.InResponseTo != logoutRequest.ID {
+		return fmt.Errorf("LogoutResponse isn't a response to %s", logoutRequest.ID)
+	}
+	if logoutResponse.IssuerValue() != p.SPEntityID {
+		return fmt.Errorf("LogoutResponse issued by %s", logoutResponse.IssuerValue())
+	}
+	if status := logoutResponse.Status.Err(); status != nil {
+		return status
+	}
+	return nil
+}
+
+// SOAPLogoutService ends the sessions of a Service Provider on the LogoutRequests an
+// Identity Provider sends over the SOAP back-channel. Requests must be signed, addressed
+// to Location when it is set, fresh and not replayed.
+type SOAPLogoutService struct {
+	EntityID string
+	Location string
+	Sessions *SPSessionStore
+	// Replay remembers the LogoutRequests received, NewReplayCache by default.
+	Replay *ReplayCache
+	// IDPCertificates returns the signing certificates of the Identity Provider, or an
+	// error when it isn't trusted.
+	IDPCertificates func(idpEntityID string) ([]*x509.Certificate, error)
+	// SigningContext, when set, signs LogoutResponses.
+	SigningContext *dsig.SigningContext
+
+	once sync.Once
+}
+
+func (s *SOAPLogoutService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	envelope, err := readSOAPMessage(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	message, err := SOAPBody(envelope)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logoutRequest, err := ParseLogoutRequest(message)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status := s.logout(logoutRequest.IssuerValue(), message)
+	if status != nil {
+		fmt.Printf("Rejecting LogoutRequest: %s\n", status)
+	}
+	resp, err := NewLogoutResponse(s.EntityID, "", logoutRequest.ID, status).Bytes()
+	if err == nil && s.SigningContext != nil {
+		resp, err = SignMessage(resp, s.SigningContext)
+	}
+	if err == nil {
+		resp, err = SOAPEnvelope(resp)
+	}
+	if err != nil {
+		fmt.Printf("Failed to create LogoutResponse: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(resp)
+}
+
+func (s *SOAPLogoutService) logout(issuer string, message []byte) *StatusError {
+	certs, err := s.IDPCertificates(issuer)
+	if err != nil {
+		return RequesterError(StatusRequestDenied, "%s", err)
+	}
+	if !IsSigned(message) {
+		return RequesterError(StatusRequestDenied, "LogoutRequest isn't signed")
+	}
+	validated, err := VerifyMessageSignature(message, certs)
+	if err != nil {
+		return RequesterError(StatusRequestDenied, "%s", err)
+	}
+	logoutRequest, err := ParseLogoutRequest(validated)
+	if err != nil {
+		return RequesterError("", "%s", err)
+	}
+	s.once.Do(func() {
+		if s.Replay == nil {
+			s.Replay = NewReplayCache()
+		}
+	})
+	if status := CheckLogoutRequest(logoutRequest, s.Location, true, s.Replay, time.Now()); status != nil {
+		return status
+	}
+	s.Sessions.DeleteMatching(issuer, logoutRequest)
+	return nil
+}
@@ -0,0 +1,275 @@
+package samltools
+
+import (
+	"crypto/x509"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+func signingContextForTest() (*dsig.SigningContext, []*x509.Certificate) {
+	keyStore := dsig.RandomKeyStoreForTest()
+	_, certDER, _ := keyStore.GetKeyPair()
+	cert, _ := x509.ParseCertificate(certDER)
+	ctx := dsig.NewDefaultSigningContext(keyStore)
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	return ctx, []*x509.Certificate{cert}
+}
+
+// receiveForTest sends a message with SendMessage and reads it back as the receiving
+// end would, following the redirect or submitting the form.
+func receiveForTest(t *testing.T, binding string, param string, message []byte, ctx *dsig.SigningContext) *InboundMessage {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://sp.samltools.com:4567/logout", nil)
+	if err := SendMessage(rec, req, binding, "http://idp.samltools.com:5678/slo", param, message, "state1", ctx); err != nil {
+		t.Fatalf("failed to send message %s", err)
+	}
+	var received *http.Request
+	if binding == HTTPRedirectBinding {
+		received = httptest.NewRequest(http.MethodGet, rec.Header().Get("Location"), nil)
+	} else {
+		m := regexp.MustCompile(`name="` + param + `" value="([^"]*)"`).FindStringSubmatch(rec.Body.String())
+		if m == nil {
+			t.Fatalf("no %s in form %s", param, rec.Body.String())
+		}
+		form := url.Values{param: {html.UnescapeString(m[1])}, RelayStateParam: {"state1"}}
+		received = httptest.NewRequest(http.MethodPost, "http://idp.samltools.com:5678/slo", strings.NewReader(form.Encode()))
+		received.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	msg, err := ReadInboundMessage(received)
+	if err != nil {
+		t.Fatalf("failed to read message %s", err)
+	}
+	if msg.Binding != binding || msg.Param != param || msg.RelayState != "state1" {
+		t.Fatalf("unexpected message %#v", msg)
+	}
+	return msg
+}
+
+func TestLogoutRequestBindings(t *testing.T) {
+	ctx, certs := signingContextForTest()
+	_, otherCerts := signingContextForTest()
+	nameID := NameID{Format: NameIDFormatUnspecified, Value: "IDPUser1"}
+	for _, binding := range []string{HTTPRedirectBinding, HTTPPostBinding} {
+		logoutRequest := NewLogoutRequest("urn:msingh.samltools:sp", "http://idp.samltools.com:5678/slo", nameID, "_session1")
+		data, _ := logoutRequest.Bytes()
+
+		msg := receiveForTest(t, binding, SAMLRequestParam, data, ctx)
+		if !msg.IsRequest() || !msg.Signed() {
+			t.Fatalf("%s: expected a signed request", binding)
+		}
+		if _, err := msg.Verify(otherCerts, true); err == nil {
+			t.Fatalf("%s: expected signature check with the wrong certificate to fail", binding)
+		}
+		verified, err := msg.Verify(certs, true)
+		if err != nil {
+			t.Fatalf("%s: signature check failed %s", binding, err)
+		}
+		parsed, err := ParseLogoutRequest(verified)
+		if err != nil {
+			t.Fatalf("%s: failed to parse LogoutRequest %s", binding, err)
+		}
+		if parsed.ID != logoutRequest.ID || parsed.IssuerValue() != "urn:msingh.samltools:sp" || parsed.NameID.Value != "IDPUser1" ||
+			len(parsed.SessionIndexes) != 1 || parsed.SessionIndexes[0] != "_session1" {
+			t.Fatalf("%s: LogoutRequest not preserved %#v", binding, parsed)
+		}
+
+		unsigned := receiveForTest(t, binding, SAMLRequestParam, data, nil)
+		if _, err := unsigned.Verify(certs, true); err == nil {
+			t.Fatalf("%s: expected unsigned request to be rejected", binding)
+		}
+		if _, err := unsigned.Verify(nil, false); err != nil {
+			t.Fatalf("%s: expected unsigned request to be accepted %s", binding, err)
+		}
+	}
+}
+
+func TestLogoutResponseStatus(t *testing.T) {
+	ctx, certs := signingContextForTest()
+	propagation := &LogoutPropagation{Pending: []SessionParticipant{{SPEntityID: "urn:sp1"}, {SPEntityID: "urn:sp2"}}}
+	for p, ok := propagation.Next(); ok; p, ok = propagation.Next() {
+		if p.SPEntityID == "urn:sp2" {
+			propagation.Fail(p.SPEntityID)
+		}
+	}
+	logoutResponse := NewLogoutResponse("http://idp.samltools.com", "http://sp.samltools.com:4567/slo", "_req1", propagation.Status())
+	data, _ := logoutResponse.Bytes()
+
+	msg := receiveForTest(t, HTTPPostBinding, SAMLResponseParam, data, ctx)
+	verified, err := msg.Verify(certs, true)
+	if err != nil {
+		t.Fatalf("signature check failed %s", err)
+	}
+	parsed, err := ParseLogoutResponse(verified)
+	if err != nil {
+		t.Fatalf("failed to parse LogoutResponse %s", err)
+	}
+	status := parsed.Status.Err()
+	if parsed.InResponseTo != "_req1" || status == nil || status.Code != StatusSuccess || status.SubCode != StatusPartialLogout ||
+		!strings.Contains(status.Message, "urn:sp2") {
+		t.Fatalf("unexpected LogoutResponse %#v, status %v", parsed, status)
+	}
+	if NewLogoutResponse("http://idp.samltools.com", "", "_req1", nil).Status.Err() != nil {
+		t.Fatalf("expected Success status")
+	}
+}
+
+func TestIDPSessionLogout(t *testing.T) {
+	store := NewIDPSessionStore()
+	rec := httptest.NewRecorder()
+	session := store.GetOrCreate(rec, httptest.NewRequest(http.MethodGet, "/logon", nil))
+	nameID := NameID{Value: "IDPUser1"}
+	store.AddParticipant(session, SessionParticipant{SPEntityID: "urn:sp1", NameID: nameID, SessionIndex: session.SessionIndex})
+	store.AddParticipant(session, SessionParticipant{SPEntityID: "urn:sp2", NameID: nameID, SessionIndex: session.SessionIndex})
+
+	req := httptest.NewRequest(http.MethodGet, "/logout", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	if s, ok := store.Get(req); !ok || s != session {
+		t.Fatalf("session not found from its cookie")
+	}
+	if _, ok := store.Find("urn:sp1", NewLogoutRequest("urn:sp1", "", nameID, "_other")); ok {
+		t.Fatalf("expected session not to match another SessionIndex")
+	}
+	found, ok := store.Find("urn:sp1", NewLogoutRequest("urn:sp1", "", nameID, session.SessionIndex))
+	if !ok || found != session {
+		t.Fatalf("session not found from LogoutRequest")
+	}
+	participants := store.Delete(nil, req, session)
+	if len(participants) != 2 {
+		t.Fatalf("unexpected participants %v", participants)
+	}
+	if _, ok := store.Get(req); ok {
+		t.Fatalf("expected session to be ended")
+	}
+
+	tracker := NewLogoutTracker()
+	propagation := &LogoutPropagation{Pending: participants}
+	tracker.Await("_req1", propagation)
+	if p, ok := tracker.Take("_req1"); !ok || p != propagation {
+		t.Fatalf("propagation not found")
+	}
+	if _, ok := tracker.Take("_req1"); ok {
+		t.Fatalf("expected propagation to be taken once")
+	}
+}
+
+func TestSPSessionLogout(t *testing.T) {
+	store := NewSPSessionStore()
+	assertion := &Assertion{
+		Subject:         &Subject{NameID: &NameID{Value: "IDPUser1"}},
+		AuthnStatements: []AuthnStatement{{SessionIndex: "_session1"}},
+	}
+	rec := httptest.NewRecorder()
+	store.Create(rec, httptest.NewRequest(http.MethodPost, "/assertion", nil), "http://idp.samltools.com", assertion)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	if s, ok := store.Get(req); !ok || s.NameID.Value != "IDPUser1" || s.SessionIndex != "_session1" {
+		t.Fatalf("session not found from its cookie")
+	}
+	if n := store.DeleteMatching("urn:other-idp", NewLogoutRequest("urn:other-idp", "", NameID{Value: "IDPUser1"})); n != 0 {
+		t.Fatalf("expected sessions of another IdP to be left alone")
+	}
+	if n := store.DeleteMatching("http://idp.samltools.com", NewLogoutRequest("http://idp.samltools.com", "", NameID{Value: "IDPUser1"}, "_session1")); n != 1 {
+		t.Fatalf("expected the session to be ended, ended %d", n)
+	}
+	if _, ok := store.Get(req); ok {
+		t.Fatalf("expected session to be ended")
+	}
+}
+
+func TestSOAPLogout(t *testing.T) {
+	idpCtx, idpCerts := signingContextForTest()
+	spCtx, spCerts := signingContextForTest()
+	sessions := NewSPSessionStore()
+	assertion := &Assertion{
+		Subject:         &Subject{NameID: &NameID{Value: "IDPUser1"}},
+		AuthnStatements: []AuthnStatement{{SessionIndex: "_session1"}},
+	}
+	rec := httptest.NewRecorder()
+	sessions.Create(rec, httptest.NewRequest(http.MethodPost, "/assertion", nil), "http://idp.samltools.com", assertion)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+
+	service := &SOAPLogoutService{
+		EntityID: "urn:msingh.samltools:sp",
+		Sessions: sessions,
+		IDPCertificates: func(idpEntityID string) ([]*x509.Certificate, error) {
+			if idpEntityID != "http://idp.samltools.com" {
+				return nil, fmt.Errorf("unknown IdP %s", idpEntityID)
+			}
+			return idpCerts, nil
+		},
+		SigningContext: spCtx,
+	}
+	sp := httptest.NewServer(service)
+	defer sp.Close()
+	service.Location = sp.URL
+	p := SessionParticipant{SPEntityID: "urn:msingh.samltools:sp", NameID: NameID{Value: "IDPUser1"}, SessionIndex: "_session1"}
+
+	unsigned := NewSOAPLogoutClient("http://idp.samltools.com", nil, nil)
+	err := unsigned.Logout(sp.URL, p, spCerts)
+	if status, ok := err.(*StatusError); !ok || status.SubCode != StatusRequestDenied {
+		t.Fatalf("expected unsigned LogoutRequest to be denied, got %v", err)
+	}
+	if _, ok := sessions.Get(req); !ok {
+		t.Fatalf("expected session to survive a denied LogoutRequest")
+	}
+	client := NewSOAPLogoutClient("http://idp.samltools.com", idpCtx, nil)
+	if err := client.Logout(sp.URL, p, idpCerts); err == nil {
+		t.Fatalf("expected LogoutResponse signed by another key to be rejected")
+	}
+	sessions.Create(rec, httptest.NewRequest(http.MethodPost, "/assertion", nil), "http://idp.samltools.com", assertion)
+	if err := client.Logout(sp.URL, p, spCerts); err != nil {
+		t.Fatalf("SOAP logout failed %s", err)
+	}
+	if n := sessions.DeleteMatching("http://idp.samltools.com", NewLogoutRequest("http://idp.samltools.com", "", NameID{Value: "IDPUser1"})); n != 0 {
+		t.Fatalf("expected sessions to be ended over SOAP, %d left", n)
+	}
+
+	sessions.Create(rec, httptest.NewRequest(http.MethodPost, "/assertion", nil), "http://idp.samltools.com", assertion)
+	if err := client.Logout(sp.URL+"/elsewhere", p, spCerts); err == nil {
+		t.Fatalf("expected LogoutRequest sent elsewhere to be denied")
+	}
+	send := func(logoutRequest *LogoutRequest) *StatusError {
+		message, _ := logoutRequest.Bytes()
+		message, _ = SignMessage(message, idpCtx)
+		data, err := soapCall(http.DefaultClient, sp.URL, "LogoutRequest", message)
+		if err != nil {
+			t.Fatalf("SOAP call failed %s", err)
+		}
+		logoutResponse, err := ParseLogoutResponse(data)
+		if err != nil {
+			t.Fatalf("failed to parse LogoutResponse %s", err)
+		}
+		return logoutResponse.Status.Err()
+	}
+	stale := NewLogoutRequest("http://idp.samltools.com", sp.URL, p.NameID, p.SessionIndex)
+	stale.IssueInstant = time.Now().Add(-time.Hour)
+	if status := send(stale); status == nil || status.SubCode != StatusRequestDenied {
+		t.Fatalf("expected stale LogoutRequest to be denied, got %v", status)
+	}
+	logoutRequest := NewLogoutRequest("http://idp.samltools.com", sp.URL, p.NameID, p.SessionIndex)
+	if status := send(logoutRequest); status != nil {
+		t.Fatalf("SOAP logout failed %s", status)
+	}
+	if status := send(logoutRequest); status == nil || !strings.Contains(status.Message, "already received") {
+		t.Fatalf("expected replayed LogoutRequest to be denied, got %v", status)
+	}
+
+	resp, err := http.Post(sp.URL, "text/xml", strings.NewReader(strings.Repeat(" ", maxSOAPMessageSize+1)))
+	if err != nil {
+		t.Fatalf("request failed %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected oversized LogoutRequest to be rejected, got %s", resp.Status)
+	}
+}
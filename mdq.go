@@ -0,0 +1,337 @@
+package samltools
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beevik/etree"
+	perrors "github.com/pkg/errors"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+)
+
+// MDQContentType is the media type of SAML metadata served by the Metadata Query Protocol.
+const MDQContentType = "application/samlmetadata+xml"
+
+// MDQEntityPath returns the request path of an entity on an MDQ responder, relative to its base URL.
+func MDQEntityPath(entityID string) string {
+	return "/entities/" + url.PathEscape(entityID)
+}
+
+// MDQSHA1Identifier returns the "{sha1}" transformed identifier of an entity.
+func MDQSHA1Identifier(entityID string) string {
+	sum := sha1.Sum([]byte(entityID))
+	return "{sha1}" + hex.EncodeToString(sum[:])
+}
+
+// MDQClient resolves entities one at a time through a Metadata Query Protocol
+// responder and caches them for CacheTTL, or less if the entity says so. Entities
+// that can't be resolved are remembered for NegativeTTL.
+type MDQClient struct {
+	BaseURL     string
+	Client      *http.Client
+	CacheTTL    time.Duration
+	NegativeTTL time.Duration
+	// ValidationContext holds the certificates responses must be signed by.
+	ValidationContext *dsig.ValidationContext
+
+	mu    sync.Mutex
+	cache map[string]*mdqCacheEntry
+}
+
+// mdqCacheEntry keeps the last entity resolved, and the error of the last lookup when it failed.
+type mdqCacheEntry struct {
+	entity     *EntityDescriptor
+	err        error
+	expires    time.Time
+	refreshing bool
+}
+
+func NewMDQClient(baseURL string, validationContext *dsig.ValidationContext) *MDQClient {
+	return &MDQClient{
+		BaseURL:           strings.TrimSuffix(baseURL, "/"),
+		Client:            &http.Client{Timeout: 10 * time.Second},
+		CacheTTL:          time.Hour,
+		NegativeTTL:       5 * time.Minute,
+		ValidationContext: validationContext,
+		cache:             map[string]*mdqCacheEntry{},
+	}
+}
+
+// Lookup returns the entity, from the cache when possible.
+func (c *MDQClient) Lookup(entityID string) (*EntityDescriptor, error) {
+	c.mu.Lock()
+	entry, ok := c.cache[entityID]
+	if ok && time.Now().Before(entry.expires) {
+		c.mu.Unlock()
+		return entry.entity, entry.err
+	}
+	c.mu.Unlock()
+	return c.refresh(entityID)
+}
+
+// refresh fetches the entity and caches the result, failures included.
+func (c *MDQClient) refresh(entityID string) (*EntityDescriptor, error) {
+	ed, err := c.fetch(entityID)
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.cache[entityID]
+	if !ok {
+		entry = &mdqCacheEntry{}
+		c.cache[entityID] = entry
+	}
+	entry.refreshing = false
+	if err != nil {
+		entry.err = err
+		entry.expires = now.Add(c.NegativeTTL)
+		return nil, err
+	}
+	entry.entity, entry.err = ed, nil
+	entry.expires = now.Add(c.CacheTTL)
+	if d, err := ParseDuration(ed.CacheDuration); err == nil && now.Add(d).Before(entry.expires) {
+		entry.expires = now.Add(d)
+	}
+	if ed.ValidUntil != nil && ed.ValidUntil.Before(entry.expires) {
+		entry.expires = *ed.ValidUntil
+	}
+	return ed, nil
+}
+
+// cached returns the last entity resolved while it is still valid, without waiting on
+// the responder. An expired cache entry is refreshed in the background.
+func (c *MDQClient) cached(entityID string) (*EntityDescriptor, error) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.cache[entityID]
+	if !ok || entry.entity == nil {
+		return nil, fmt.Errorf("%s hasn't been resolved", entityID)
+	}
+	if !now.Before(entry.expires) && !entry.refreshing {
+		entry.refreshing = true
+		go c.refresh(entityID)
+	}
+	if entry.entity.ValidUntil != nil && !now.Before(*entry.entity.ValidUntil) {
+		return nil, fmt.Errorf("metadata of %s has expired", entityID)
+	}
+	return entry.entity, nil
+}
+
+func (c *MDQClient) IDP(entityID string) (*IDPSSODescriptor, error) {
+	ed, err := c.Lookup(entityID)
+	if err != nil {
+		return nil, err
+	}
+	return idpOf(ed)
+}
+
+func (c *MDQClient) SP(entityID string) (*SPSSODescriptor, error) {
+	ed, err := c.Lookup(entityID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ed.SPSSODescriptors) == 0 {
+		return nil, fmt.Errorf("%s is not a service provider", entityID)
+	}
+	return &ed.SPSSODescriptors[0], nil
+}
+
+func idpOf(ed *EntityDescriptor) (*IDPSSODescriptor, error) {
+	if len(ed.IDPSSODescriptors) == 0 {
+		return nil, fmt.Errorf("%s is not an identity provider", ed.EntityID)
+	}
+	return &ed.IDPSSODescriptors[0], nil
+}
+
+// CertificateStore returns a certificate store trusting the signing certificates the
+// responder publishes for the Identity Provider. The store only reads the cache, so
+// signatures are validated without a request to the responder; the entity has to be
+// looked up first.
+func (c *MDQClient) CertificateStore(idpEntityID string) dsig.X509CertificateStore {
+	return &mdqCertificateStore{client: c, entityID: idpEntityID}
+}
+
+type mdqCertificateStore struct {
+	client   *MDQClient
+	entityID string
+}
+
+func (s *mdqCertificateStore) Certificates() ([]*x509.Certificate, error) {
+	ed, err := s.client.cached(s.entityID)
+	if err != nil {
+		return nil, err
+	}
+	idp, err := idpOf(ed)
+	if err != nil {
+		return nil, err
+	}
+	return idp.SigningCertificates()
+}
+
+func (c *MDQClient) fetch(entityID string) (*EntityDescriptor, error) {
+	if c.ValidationContext == nil {
+		return nil, fmt.Errorf("MDQ responses can't be trusted without a signing certificate")
+	}
+	req, err := http.NewRequest(http.MethodGet, c.BaseURL+MDQEntityPath(entityID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", MDQContentType)
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, perrors.Wrap(err, "MDQ request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("entity %s not found by MDQ responder", entityID)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("MDQ request for %s returned %s", entityID, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, perrors.Wrap(err, "Failed to read MDQ response")
+	}
+	if data, err = c.verify(data); err != nil {
+		return nil, err
+	}
+	var found *EntityDescriptor
+	err = StreamEntityDescriptors(bytes.NewReader(data), func(ed *EntityDescriptor) error {
+		if ed.EntityID == entityID {
+			found = ed
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("MDQ response doesn't describe %s", entityID)
+	}
+	return found, nil
+}
+
+// verify checks the enveloped signature of the response and returns only the signed content.
+func (c *MDQClient) verify(data []byte) ([]byte, error) {
+	verified, err := verifyMetadataSignature(data, c.ValidationContext)
+	return verified, perrors.Wrap(err, "Invalid MDQ response")
+}
+
+// MDQServer is a Metadata Query Protocol responder serving the entities of a
+// local aggregate, each signed on the way out.
+type MDQServer struct {
+	SigningContext *dsig.SigningContext
+	// ValidFor sets the validUntil of served entities, CacheDuration their cacheDuration.
+	ValidFor      time.Duration
+	CacheDuration time.Duration
+
+	entities map[string]*etree.Element
+	bySHA1   map[string]string
+}
+
+// NewMDQServer reads every EntityDescriptor of the aggregate. Entities are kept
+// with the namespace declarations they inherit from the aggregate.
+func NewMDQServer(aggregate io.Reader, signingCtx *dsig.SigningContext) (*MDQServer, error) {
+	doc := etree.NewDocument()
+	if _, err := doc.ReadFrom(aggregate); err != nil {
+		return nil, perrors.Wrap(err, "Failed to read aggregate")
+	}
+	if doc.Root() == nil {
+		return nil, fmt.Errorf("empty aggregate")
+	}
+	s := &MDQServer{
+		SigningContext: signingCtx,
+		ValidFor:       7 * 24 * time.Hour,
+		CacheDuration:  6 * time.Hour,
+		entities:       map[string]*etree.Element{},
+		bySHA1:         map[string]string{},
+	}
+	err := etreeutils.NSFindIterate(doc.Root(), MetadataNamespace, "EntityDescriptor", func(ctx etreeutils.NSContext, el *etree.Element) error {
+		entityID := el.SelectAttrValue("entityID", "")
+		if entityID == "" {
+			return fmt.Errorf("EntityDescriptor without entityID")
+		}
+		detached, err := etreeutils.NSDetatch(ctx, el)
+		if err != nil {
+			return err
+		}
+		s.entities[entityID] = detached
+		s.bySHA1[MDQSHA1Identifier(entityID)] = entityID
+		return nil
+	})
+	if err != nil {
+		return nil, perrors.Wrap(err, "Failed to index aggregate")
+	}
+	return s, nil
+}
+
+// Len returns the number of entities served.
+func (s *MDQServer) Len() int {
+	return len(s.entities)
+}
+
+func (s *MDQServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	path := req.URL.EscapedPath()
+	if !strings.HasPrefix(path, "/entities/") {
+		http.NotFound(w, req)
+		return
+	}
+	id, err := url.PathUnescape(strings.TrimPrefix(path, "/entities/"))
+	if err != nil {
+		http.Error(w, "Invalid entity identifier", http.StatusBadRequest)
+		return
+	}
+	if entityID, ok := s.bySHA1[strings.ToLower(id)]; ok {
+		id = entityID
+	}
+	el, ok := s.entities[id]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	signed, err := s.sign(el)
+	if err != nil {
+		fmt.Printf("Failed to sign metadata of %s: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", MDQContentType)
+	w.Write(signed)
+}
+
+func (s *MDQServer) sign(entity *etree.Element) ([]byte, error) {
+	el := entity.Copy()
+	for _, sig := range el.SelectElements("Signature") {
+		if sig.NamespaceURI() == dsig.Namespace {
+			el.RemoveChild(sig)
+		}
+	}
+	if el.SelectAttrValue("ID", "") == "" {
+		el.CreateAttr("ID", "_"+strings.TrimPrefix(MDQSHA1Identifier(el.SelectAttrValue("entityID", "")), "{sha1}"))
+	}
+	el.CreateAttr("validUntil", time.Now().Add(s.ValidFor).UTC().Format(time.RFC3339))
+	el.CreateAttr("cacheDuration", fmt.Sprintf("PT%dS", int(s.CacheDuration.Seconds())))
+	signed, err := signEnvelopedAfter(s.SigningContext, el, "")
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	doc.SetRoot(signed)
+	return doc.WriteToBytes()
+}
@@ -0,0 +1,111 @@
+package samltools
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+func newTestMDQServer(t *testing.T) (*httptest.Server, *dsig.ValidationContext, *int32) {
+	f, err := os.Open("./samples/federation-metadata.xml")
+	if err != nil {
+		t.Fatalf("failed to open aggregate %s", err)
+	}
+	defer f.Close()
+	keyStore := dsig.RandomKeyStoreForTest()
+	mdq, err := NewMDQServer(f, dsig.NewDefaultSigningContext(keyStore))
+	if err != nil {
+		t.Fatalf("failed to create MDQ server %s", err)
+	}
+	if mdq.Len() != 4 {
+		t.Fatalf("expected 4 entities, got %d", mdq.Len())
+	}
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		mdq.ServeHTTP(w, r)
+	}))
+	_, certBytes, _ := keyStore.GetKeyPair()
+	cert, _ := x509.ParseCertificate(certBytes)
+	return server, CreateValidationContext([]*x509.Certificate{cert}), &requests
+}
+
+func TestMDQLookup(t *testing.T) {
+	server, vc, requests := newTestMDQServer(t)
+	defer server.Close()
+
+	client := NewMDQClient(server.URL, vc)
+	sp, err := client.SP("urn:auth0:dev-ejtl988w:auth0-as-sp")
+	if err != nil {
+		t.Fatalf("failed to resolve SP %s", err)
+	}
+	if len(sp.AssertionConsumerServices) != 1 {
+		t.Fatalf("expected the SP's ACS to be resolved")
+	}
+	if _, err := client.SP("urn:auth0:dev-ejtl988w:auth0-as-sp"); err != nil {
+		t.Fatalf("failed to resolve cached SP %s", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Fatalf("expected the second lookup to be cached, got %d requests", n)
+	}
+
+	store := client.CertificateStore("urn:dev-ejtl988w.auth0.com")
+	if _, err := store.Certificates(); err == nil {
+		t.Fatalf("expected the certificate store to only read the cache")
+	}
+	if _, err := client.IDP("urn:dev-ejtl988w.auth0.com"); err != nil {
+		t.Fatalf("failed to resolve IdP %s", err)
+	}
+	requested := atomic.LoadInt32(requests)
+	certs, err := store.Certificates()
+	if err != nil || len(certs) != 1 {
+		t.Fatalf("expected the IdP signing certificate, got %d err=%v", len(certs), err)
+	}
+	if n := atomic.LoadInt32(requests); n != requested {
+		t.Fatalf("expected the certificates to be read from the cache, got %d requests", n-requested)
+	}
+
+	requested = atomic.LoadInt32(requests)
+	for i := 0; i < 2; i++ {
+		if _, err := client.Lookup("urn:unknown"); err == nil {
+			t.Fatalf("expected unknown entity lookup to fail")
+		}
+	}
+	if n := atomic.LoadInt32(requests); n != requested+1 {
+		t.Fatalf("expected the miss to be cached, got %d requests", n-requested)
+	}
+	client.NegativeTTL = 0
+	client.cache["urn:unknown"].expires = time.Time{}
+	if _, err := client.Lookup("urn:unknown"); err == nil || atomic.LoadInt32(requests) != requested+2 {
+		t.Fatalf("expected the miss to be looked up again once expired")
+	}
+
+	if _, err := NewMDQClient(server.URL, nil).Lookup("urn:msingh.samltools:sp"); err == nil {
+		t.Fatalf("expected a client without signing certificate to refuse responses")
+	}
+
+	untrusted := NewMDQClient(server.URL, CreateValidationContext(nil))
+	if _, err := untrusted.Lookup("urn:msingh.samltools:sp"); err == nil {
+		t.Fatalf("expected a response signed by an untrusted key to be rejected")
+	}
+}
+
+func TestMDQSHA1Identifier(t *testing.T) {
+	server, _, _ := newTestMDQServer(t)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/entities/" + MDQSHA1Identifier("http://idp.samltools.com"))
+	if err != nil {
+		t.Fatalf("request failed %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != MDQContentType {
+		t.Fatalf("unexpected response %s %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+}
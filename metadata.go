@@ -0,0 +1,672 @@
+package samltools
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	perrors "github.com/pkg/errors"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	MetadataNamespace   = "urn:oasis:names:tc:SAML:2.0:metadata"
+	AssertionNamespace  = "urn:oasis:names:tc:SAML:2.0:assertion"
+	ProtocolNamespace   = "urn:oasis:names:tc:SAML:2.0:protocol"
+	MDRPINamespace      = "urn:oasis:names:tc:SAML:metadata:rpi"
+	MDAttrNamespace     = "urn:oasis:names:tc:SAML:metadata:attribute"
+	HTTPRedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	HTTPPostBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	HTTPArtifactBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact"
+	SOAPBinding         = "urn:oasis:names:tc:SAML:2.0:bindings:SOAP"
+)
+
+// EntitiesDescriptor is a metadata aggregate as published by federations.
+// Large aggregates should be read with StreamEntityDescriptors instead of
+// being unmarshalled in one go.
+type EntitiesDescriptor struct {
+	XMLName             xml.Name             `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntitiesDescriptor"`
+	ID                  string               `xml:"ID,attr,omitempty"`
+	Name                string               `xml:"Name,attr,omitempty"`
+	ValidUntil          *time.Time           `xml:"validUntil,attr,omitempty"`
+	CacheDuration       string               `xml:"cacheDuration,attr,omitempty"`
+	EntitiesDescriptors []EntitiesDescriptor `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntitiesDescriptor"`
+	EntityDescriptors   []EntityDescriptor   `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+}
+
+type EntityDescriptor struct {
+	XMLName           xml.Name           `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID          string             `xml:"entityID,attr"`
+	ValidUntil        *time.Time         `xml:"validUntil,attr,omitempty"`
+	CacheDuration     string             `xml:"cacheDuration,attr,omitempty"`
+	Extensions        *EntityExtensions  `xml:"urn:oasis:names:tc:SAML:2.0:metadata Extensions,omitempty"`
+	IDPSSODescriptors []IDPSSODescriptor `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor"`
+	SPSSODescriptors  []SPSSODescriptor  `xml:"urn:oasis:names:tc:SAML:2.0:metadata SPSSODescriptor"`
+}
+
+// EntityExtensions holds the MDRPI and MDAttr extensions commonly used by
+// federations to describe who registered an entity and which categories it belongs to.
+type EntityExtensions struct {
+	RegistrationInfo *RegistrationInfo `xml:"urn:oasis:names:tc:SAML:metadata:rpi RegistrationInfo,omitempty"`
+	EntityAttributes *EntityAttributes `xml:"urn:oasis:names:tc:SAML:metadata:attribute EntityAttributes,omitempty"`
+}
+
+type RegistrationInfo struct {
+	RegistrationAuthority string `xml:"registrationAuthority,attr"`
+	RegistrationInstant   string `xml:"registrationInstant,attr,omitempty"`
+}
+
+type EntityAttributes struct {
+	Attributes []Attribute `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
+}
+
+type Attribute struct {
+	Name         string           `xml:"Name,attr"`
+	NameFormat   string           `xml:"NameFormat,attr,omitempty"`
+	FriendlyName string           `xml:"FriendlyName,attr,omitempty"`
+	Values       []AttributeValue `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeValue"`
+}
+
+type AttributeValue struct {
+	Type  string `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+// SSODescriptor carries the elements shared by the IdP and SP roles.
+type SSODescriptor struct {
+	ProtocolSupportEnumeration string            `xml:"protocolSupportEnumeration,attr"`
+	KeyDescriptors             []KeyDescriptor   `xml:"urn:oasis:names:tc:SAML:2.0:metadata KeyDescriptor"`
+	ArtifactResolutionServices []IndexedEndpoint `xml:"urn:oasis:names:tc:SAML:2.0:metadata ArtifactResolutionService"`
+	SingleLogoutServices       []Endpoint        `xml:"urn:oasis:names:tc:SAML:2.0:metadata SingleLogoutService"`
+	NameIDFormats              []string          `xml:"urn:oasis:names:tc:SAML:2.0:metadata NameIDFormat"`
+}
+
+type IDPSSODescriptor struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor"`
+	SSODescriptor
+	WantAuthnRequestsSigned bool        `xml:"WantAuthnRequestsSigned,attr,omitempty"`
+	SingleSignOnServices    []Endpoint  `xml:"urn:oasis:names:tc:SAML:2.0:metadata SingleSignOnService"`
+	Attributes              []Attribute `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
+}
+
+type SPSSODescriptor struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata SPSSODescriptor"`
+	SSODescriptor
+	AuthnRequestsSigned       bool              `xml:"AuthnRequestsSigned,attr,omitempty"`
+	WantAssertionsSigned      bool              `xml:"WantAssertionsSigned,attr,omitempty"`
+	AssertionConsumerServices []IndexedEndpoint `xml:"urn:oasis:names:tc:SAML:2.0:metadata AssertionConsumerService"`
+}
+
+type KeyDescriptor struct {
+	Use     string  `xml:"use,attr,omitempty"`
+	KeyInfo KeyInfo `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
+}
+
+type KeyInfo struct {
+	X509Data X509Data `xml:"http://www.w3.org/2000/09/xmldsig# X509Data"`
+}
+
+type X509Data struct {
+	X509Certificates []string `xml:"http://www.w3.org/2000/09/xmldsig# X509Certificate"`
+}
+
+type Endpoint struct {
+	Binding          string `xml:"Binding,attr"`
+	Location         string `xml:"Location,attr"`
+	ResponseLocation string `xml:"ResponseLocation,attr,omitempty"`
+}
+
+type IndexedEndpoint struct {
+	Binding   string `xml:"Binding,attr"`
+	Location  string `xml:"Location,attr"`
+	Index     int    `xml:"index,attr"`
+	IsDefault *bool  `xml:"isDefault,attr,omitempty"`
+}
+
+// Certificates parses every X509Certificate carried by the KeyDescriptor.
+func (kd KeyDescriptor) Certificates() ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, data := range kd.KeyInfo.X509Data.X509Certificates {
+		der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data), ""))
+		if err != nil {
+			return nil, perrors.Wrap(err, "Failed to decode X509Certificate")
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, perrors.Wrap(err, "x509 parse err")
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// SigningCertificates returns the certificates of all KeyDescriptors usable
+// for signing, i.e. with use="signing" or no use at all.
+func (d SSODescriptor) SigningCertificates() ([]*x509.Certificate, error) {
+	return d.certificates("signing")
+}
+
+// EncryptionCertificates returns the certificates of all KeyDescriptors usable for encryption.
+func (d SSODescriptor) EncryptionCertificates() ([]*x509.Certificate, error) {
+	return d.certificates("encryption")
+}
+
+func (d SSODescriptor) certificates(use string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, kd := range d.KeyDescriptors {
+		if kd.Use != "" && kd.Use != use {
+			continue
+		}
+		c, err := kd.Certificates()
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c...)
+	}
+	return certs, nil
+}
+
+// SingleSignOnService returns the location of the first SingleSignOnService with the given binding.
+func (d *IDPSSODescriptor) SingleSignOnService(binding string) (string, bool) {
+	for _, ep := range d.SingleSignOnServices {
+		if ep.Binding == binding {
+			return ep.Location, true
+		}
+	}
+	return "", false
+}
+
+// AssertionConsumerService returns the location of the default AssertionConsumerService
+// with the given binding: the one flagged isDefault, or else the first one listed.
+func (d *SPSSODescriptor) AssertionConsumerService(binding string) (string, bool) {
+	location, found := "", false
+	for _, ep := range d.AssertionConsumerServices {
+		if ep.Binding != binding {
+			continue
+		}
+		if ep.IsDefault != nil && *ep.IsDefault {
+			return ep.Location, true
+		}
+		if !found {
+			location, found = ep.Location, true
+		}
+	}
+	return location, found
+}
+
+// ResponseBindings are the bindings Responses can be sent to an AssertionConsumerService with.
+var ResponseBindings = []string{HTTPPostBinding, HTTPArtifactBinding}
+
+// ResponseEndpoint resolves the AssertionConsumerService the Response to an AuthnRequest
+// is sent to, nil for an unsolicited Response. The AssertionConsumerServiceIndex or
+// AssertionConsumerServiceURL and ProtocolBinding of the request must name one of the
+// registered endpoints, lest assertions be sent to whoever asks for them. The default
+// endpoint is used when the request names none. Failures are *StatusError values.
+func (d *SPSSODescriptor) ResponseEndpoint(authnRequest *AuthnRequest) (IndexedEndpoint, error) {
+	var candidates []IndexedEndpoint
+	for _, ep := range d.AssertionConsumerServices {
+		if ContainsString(ResponseBindings, ep.Binding) {
+			candidates = append(candidates, ep)
+		}
+	}
+	if authnRequest == nil {
+		authnRequest = &AuthnRequest{}
+	}
+	if index := authnRequest.AssertionConsumerServiceIndex; index != nil {
+		if authnRequest.AssertionConsumerServiceURL != "" || authnRequest.ProtocolBinding != "" {
+			return IndexedEndpoint{}, RequesterError("", "AssertionConsumerServiceIndex can't be used along AssertionConsumerServiceURL or ProtocolBinding")
+		}
+		for _, ep := range candidates {
+			if ep.Index == *index {
+				return ep, nil
+			}
+		}
+		return IndexedEndpoint{}, RequesterError(StatusRequestDenied, "no AssertionConsumerService with index %d", *index)
+	}
+	if binding := authnRequest.ProtocolBinding; binding != "" {
+		if !ContainsString(ResponseBindings, binding) {
+			return IndexedEndpoint{}, RequesterError(StatusUnsupportedBinding, "Responses can't be sent with %s", binding)
+		}
+		var withBinding []IndexedEndpoint
+		for _, ep := range candidates {
+			if ep.Binding == binding {
+				withBinding = append(withBinding, ep)
+			}
+		}
+		candidates = withBinding
+	}
+	if location := authnRequest.AssertionConsumerServiceURL; location != "" {
+		var atLocation []IndexedEndpoint
+		for _, ep := range candidates {
+			if ep.Location == location {
+				atLocation = append(atLocation, ep)
+			}
+		}
+		if len(atLocation) == 0 {
+			return IndexedEndpoint{}, RequesterError(StatusRequestDenied, "%s isn't a registered AssertionConsumerService", location)
+		}
+		candidates = atLocation
+	}
+	if len(candidates) == 0 {
+		if authnRequest.ProtocolBinding != "" {
+			return IndexedEndpoint{}, RequesterError(StatusUnsupportedBinding, "no AssertionConsumerService with %s", authnRequest.ProtocolBinding)
+		}
+		return IndexedEndpoint{}, &StatusError{Code: StatusResponder, Message: "no AssertionConsumerService to send the Response to"}
+	}
+	return defaultEndpoint(candidates), nil
+}
+
+// defaultEndpoint returns the default of indexed endpoints: the first one flagged
+// isDefault, else the first one not flagged otherwise, else the first one.
+func defaultEndpoint(endpoints []IndexedEndpoint) IndexedEndpoint {
+	for _, ep := range endpoints {
+		if ep.IsDefault != nil && *ep.IsDefault {
+			return ep
+		}
+	}
+	for _, ep := range endpoints {
+		if ep.IsDefault == nil {
+			return ep
+		}
+	}
+	return endpoints[0]
+}
+
+// NewKeyDescriptor returns a KeyDescriptor publishing cert for the given use, signing or encryption.
+func NewKeyDescriptor(use string, cert *x509.Certificate) KeyDescriptor {
+	return KeyDescriptor{
+		Use:     use,
+		KeyInfo: KeyInfo{X509Data: X509Data{X509Certificates: []string{base64.StdEncoding.EncodeToString(cert.Raw)}}},
+	}
+}
+
+// ArtifactResolutionService returns the location of the SOAP ArtifactResolutionService with the given index.
+func (d SSODescriptor) ArtifactResolutionService(index int) (string, bool) {
+	for _, ep := range d.ArtifactResolutionServices {
+		if ep.Binding == SOAPBinding && ep.Index == index {
+			return ep.Location, true
+		}
+	}
+	return "", false
+}
+
+// SingleLogoutService returns the first SingleLogoutService with one of the bindings,
+// tried in the order given.
+func (d SSODescriptor) SingleLogoutService(bindings ...string) (Endpoint, bool) {
+	for _, binding := range bindings {
+		for _, ep := range d.SingleLogoutServices {
+			if ep.Binding == binding {
+				return ep, true
+			}
+		}
+	}
+	return Endpoint{}, false
+}
+
+// ResponseURL returns where responses to messages sent to the endpoint go: its
+// ResponseLocation, or its Location when it has none.
+func (ep Endpoint) ResponseURL() string {
+	if ep.ResponseLocation != "" {
+		return ep.ResponseLocation
+	}
+	return ep.Location
+}
+
+// RegistrationAuthority returns the MDRPI registration authority of the entity, if any.
+func (ed *EntityDescriptor) RegistrationAuthority() string {
+	if ed.Extensions == nil || ed.Extensions.RegistrationInfo == nil {
+		return ""
+	}
+	return ed.Extensions.RegistrationInfo.RegistrationAuthority
+}
+
+// EntityAttributeValues returns the values of the named MDAttr entity attribute.
+func (ed *EntityDescriptor) EntityAttributeValues(name string) []string {
+	if ed.Extensions == nil || ed.Extensions.EntityAttributes == nil {
+		return nil
+	}
+	var values []string
+	for _, attr := range ed.Extensions.EntityAttributes.Attributes {
+		if attr.Name != name {
+			continue
+		}
+		for _, v := range attr.Values {
+			values = append(values, strings.TrimSpace(v.Value))
+		}
+	}
+	return values
+}
+
+// StreamEntityDescriptors reads metadata from r and calls handle for every
+// EntityDescriptor found, whether r holds a single entity or an arbitrarily
+// nested EntitiesDescriptor aggregate. Only one entity is held in memory at a time.
+func StreamEntityDescriptors(r io.Reader, handle func(*EntityDescriptor) error) error {
+	return streamMetadata(r, nil, handle)
+}
+
+// streamMetadata is StreamEntityDescriptors that also hands the document element,
+// whether an EntitiesDescriptor or an EntityDescriptor, to root before any entity.
+// Entities of an EntitiesDescriptor whose validUntil has passed are skipped.
+func streamMetadata(r io.Reader, root func(xml.StartElement) error, handle func(*EntityDescriptor) error) error {
+	decoder := xml.NewDecoder(r)
+	seenRoot := false
+	now := time.Now()
+	// expired tells, for every EntitiesDescriptor the decoder is in, whether it has expired
+	var expired []bool
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return perrors.Wrap(err, "Failed to read metadata")
+		}
+		if end, ok := tok.(xml.EndElement); ok && isEntitiesDescriptor(end.Name) && len(expired) > 0 {
+			expired = expired[:len(expired)-1]
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if isEntitiesDescriptor(start.Name) {
+			groupExpired := len(expired) > 0 && expired[len(expired)-1]
+			for _, attr := range start.Attr {
+				if attr.Name.Local != "validUntil" {
+					continue
+				}
+				validUntil, err := time.Parse(time.RFC3339, attr.Value)
+				if err != nil {
+					return perrors.Wrap(err, "Invalid validUntil")
+				}
+				groupExpired = groupExpired || now.After(validUntil)
+			}
+			expired = append(expired, groupExpired)
+		}
+		if !seenRoot {
+			seenRoot = true
+			if root != nil {
+				if err := root(start); err != nil {
+					return err
+				}
+			}
+		}
+		if start.Name.Space != MetadataNamespace || start.Name.Local != "EntityDescriptor" {
+			continue
+		}
+		if len(expired) > 0 && expired[len(expired)-1] {
+			if err := decoder.Skip(); err != nil {
+				return perrors.Wrap(err, "Failed to read metadata")
+			}
+			continue
+		}
+		ed := &EntityDescriptor{}
+		if err := decoder.DecodeElement(ed, &start); err != nil {
+			return perrors.Wrap(err, "Failed to decode EntityDescriptor")
+		}
+		if err := handle(ed); err != nil {
+			return err
+		}
+	}
+}
+
+func isEntitiesDescriptor(name xml.Name) bool {
+	return name.Space == MetadataNamespace && name.Local == "EntitiesDescriptor"
+}
+
+// EntityFilter decides whether an entity read from metadata is admitted into a MetadataIndex.
+type EntityFilter func(*EntityDescriptor) bool
+
+// RegisteredBy admits entities registered by the given MDRPI registration authority.
+func RegisteredBy(authority string) EntityFilter {
+	return func(ed *EntityDescriptor) bool {
+		return ed.RegistrationAuthority() == authority
+	}
+}
+
+// HasEntityAttribute admits entities carrying the MDAttr entity attribute name with
+// the given value, e.g. an entity category. An empty value matches any value.
+func HasEntityAttribute(name, value string) EntityFilter {
+	return func(ed *EntityDescriptor) bool {
+		for _, v := range ed.EntityAttributeValues(name) {
+			if value == "" || v == value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// HasEntityID admits only the listed entities.
+func HasEntityID(entityIDs ...string) EntityFilter {
+	return func(ed *EntityDescriptor) bool {
+		for _, id := range entityIDs {
+			if ed.EntityID == id {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MetadataFilters builds the filters matching a registration authority and a set of
+// entity attributes, skipping any criteria left empty.
+func MetadataFilters(registrationAuthority string, entityAttributes map[string]string) []EntityFilter {
+	var filters []EntityFilter
+	if registrationAuthority != "" {
+		filters = append(filters, RegisteredBy(registrationAuthority))
+	}
+	for name, value := range entityAttributes {
+		filters = append(filters, HasEntityAttribute(name, value))
+	}
+	return filters
+}
+
+// MetadataIndex holds the entities of one or more metadata sources, indexed
+// by entityID and role. It is the set of partners a provider trusts.
+type MetadataIndex struct {
+	// ValidUntil and CacheDuration are read from the document element of the
+	// last loaded metadata and are zero when it didn't declare them.
+	ValidUntil    time.Time
+	CacheDuration time.Duration
+
+	entities map[string]*EntityDescriptor
+	idps     map[string]*IDPSSODescriptor
+	sps      map[string]*SPSSODescriptor
+}
+
+func NewMetadataIndex() *MetadataIndex {
+	return &MetadataIndex{
+		entities: map[string]*EntityDescriptor{},
+		idps:     map[string]*IDPSSODescriptor{},
+		sps:      map[string]*SPSSODescriptor{},
+	}
+}
+
+// LoadMetadataIndex streams metadata from r into a new index, keeping only
+// the entities accepted by every filter.
+func LoadMetadataIndex(r io.Reader, filters ...EntityFilter) (*MetadataIndex, error) {
+	idx := NewMetadataIndex()
+	if err := idx.Load(r, filters...); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func LoadMetadataIndexFile(metadataFile string, filters ...EntityFilter) (*MetadataIndex, error) {
+	f, err := os.Open(metadataFile)
+	if err != nil {
+		return nil, perrors.Wrap(err, "Failed to open metadata file")
+	}
+	defer f.Close()
+	return LoadMetadataIndex(f, filters...)
+}
+
+// Load streams metadata from r into the index. Entities already present are replaced.
+// Metadata whose validUntil has passed is rejected and expired entities, or those of an
+// expired nested EntitiesDescriptor, are skipped.
+func (idx *MetadataIndex) Load(r io.Reader, filters ...EntityFilter) error {
+	now := time.Now()
+	root := func(start xml.StartElement) error {
+		for _, attr := range start.Attr {
+			switch attr.Name.Local {
+			case "validUntil":
+				validUntil, err := time.Parse(time.RFC3339, attr.Value)
+				if err != nil {
+					return perrors.Wrap(err, "Invalid validUntil")
+				}
+				if now.After(validUntil) {
+					return fmt.Errorf("metadata expired at %s", attr.Value)
+				}
+				idx.ValidUntil = validUntil
+			case "cacheDuration":
+				cacheDuration, err := ParseDuration(attr.Value)
+				if err != nil {
+					return err
+				}
+				idx.CacheDuration = cacheDuration
+			}
+		}
+		return nil
+	}
+	return streamMetadata(r, root, func(ed *EntityDescriptor) error {
+		if ed.ValidUntil != nil && now.After(*ed.ValidUntil) {
+			return nil
+		}
+		for _, accept := range filters {
+			if !accept(ed) {
+				return nil
+			}
+		}
+		idx.Add(ed)
+		return nil
+	})
+}
+
+// ParseDuration parses an xs:duration such as "PT6H" or "P1DT12H". Years and
+// months are approximated as 365 and 30 days.
+func ParseDuration(s string) (time.Duration, error) {
+	m := xsDurationRegexp.FindStringSubmatch(s)
+	if m == nil || s == "P" || strings.HasSuffix(s, "T") {
+		return 0, fmt.Errorf("invalid xs:duration %q", s)
+	}
+	units := []time.Duration{365 * 24 * time.Hour, 30 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute}
+	var d time.Duration
+	for i, unit := range units {
+		if m[i+2] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(m[i+2])
+		if err != nil {
+			return 0, fmt.Errorf("invalid xs:duration %q", s)
+		}
+		d += time.Duration(n) * unit
+	}
+	if m[7] != "" {
+		secs, err := strconv.ParseFloat(m[7], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid xs:duration %q", s)
+		}
+		d += time.Duration(secs * float64(time.Second))
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
+
+var xsDurationRegexp = regexp.MustCompile(`^(-)?P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// Add indexes an entity under each role it declares.
+func (idx *MetadataIndex) Add(ed *EntityDescriptor) {
+	delete(idx.idps, ed.EntityID)
+	delete(idx.sps, ed.EntityID)
+	idx.entities[ed.EntityID] = ed
+	if len(ed.IDPSSODescriptors) > 0 {
+		idx.idps[ed.EntityID] = &ed.IDPSSODescriptors[0]
+	}
+	if len(ed.SPSSODescriptors) > 0 {
+		idx.sps[ed.EntityID] = &ed.SPSSODescriptors[0]
+	}
+}
+
+func (idx *MetadataIndex) Entity(entityID string) (*EntityDescriptor, bool) {
+	ed, ok := idx.entities[entityID]
+	return ed, ok
+}
+
+func (idx *MetadataIndex) IDP(entityID string) (*IDPSSODescriptor, bool) {
+	d, ok := idx.idps[entityID]
+	return d, ok
+}
+
+func (idx *MetadataIndex) SP(entityID string) (*SPSSODescriptor, bool) {
+	d, ok := idx.sps[entityID]
+	return d, ok
+}
+
+func (idx *MetadataIndex) Len() int {
+	return len(idx.entities)
+}
+
+// EntityIDs returns the sorted entityIDs of every indexed entity.
+func (idx *MetadataIndex) EntityIDs() []string {
+	ids := make([]string, 0, len(idx.entities))
+	for id := range idx.entities {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// IDPEntityIDs returns the sorted entityIDs of entities acting as Identity Provider.
+func (idx *MetadataIndex) IDPEntityIDs() []string {
+	ids := make([]string, 0, len(idx.idps))
+	for id := range idx.idps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// SPEntityIDs returns the sorted entityIDs of entities acting as Service Provider.
+func (idx *MetadataIndex) SPEntityIDs() []string {
+	ids := make([]string, 0, len(idx.sps))
+	for id := range idx.sps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// CreateValidationContextFromMetadata builds a validation context trusting the
+// signing certificates the index holds for the given Identity Provider.
+func CreateValidationContextFromMetadata(idx *MetadataIndex, idpEntityID string) (*dsig.ValidationContext, error) {
+	certs, err := idpSigningCertificates(idx, idpEntityID)
+	if err != nil {
+		return nil, err
+	}
+	return CreateValidationContext(certs), nil
+}
+
+func idpSigningCertificates(idx *MetadataIndex, idpEntityID string) ([]*x509.Certificate, error) {
+	idp, ok := idx.IDP(idpEntityID)
+	if !ok {
+		return nil, fmt.Errorf("identity provider %s not found in metadata", idpEntityID)
+	}
+	certs, err := idp.SigningCertificates()
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("identity provider %s has no signing certificate in metadata", idpEntityID)
+	}
+	return certs, nil
+}
@@ -0,0 +1,298 @@
+package samltools
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/beevik/etree"
+	perrors "github.com/pkg/errors"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	DefaultMinMetadataRefresh = 5 * time.Minute
+	DefaultMaxMetadataRefresh = 24 * time.Hour
+)
+
+// MetadataRefresher loads partner metadata from an HTTP(S) URL or a file and
+// keeps it up to date, honouring the cacheDuration and validUntil of the metadata.
+// Every successful fetch is copied to CacheFile, which is used at startup when
+// the source can't be reached.
+type MetadataRefresher struct {
+	// Source is an http:// or https:// URL, anything else is read as a file path.
+	Source    string
+	CacheFile string
+	Filters   []EntityFilter
+	Client    *http.Client
+	// ValidationContext requires the metadata to be signed by one of its certificates.
+	// Metadata fetched from a URL is rejected without it, whoever is on the network
+	// path being able to change it.
+	ValidationContext *dsig.ValidationContext
+	// MinRefresh and MaxRefresh bound the interval between two refreshes.
+	MinRefresh time.Duration
+	MaxRefresh time.Duration
+	// OnUpdate is called with every new index before it replaces the current one.
+	// Returning an error rejects the update and keeps the current index.
+	OnUpdate func(*MetadataIndex) error
+
+	index atomic.Value // *MetadataIndex
+	mu    sync.Mutex
+	etag  string
+}
+
+func NewMetadataRefresher(source string, cacheFile string, filters ...EntityFilter) *MetadataRefresher {
+	return &MetadataRefresher{
+		Source:     source,
+		CacheFile:  cacheFile,
+		Filters:    filters,
+		Client:     &http.Client{Timeout: 30 * time.Second},
+		MinRefresh: DefaultMinMetadataRefresh,
+		MaxRefresh: DefaultMaxMetadataRefresh,
+	}
+}
+
+// Index returns the current metadata, nil until the first successful Load.
+func (m *MetadataRefresher) Index() *MetadataIndex {
+	idx, _ := m.index.Load().(*MetadataIndex)
+	return idx
+}
+
+// Load fetches the metadata from its source, falling back to the on-disk cache when
+// the source is unavailable or its metadata is invalid.
+func (m *MetadataRefresher) Load() error {
+	err := m.Refresh()
+	if err == nil {
+		return nil
+	}
+	if m.CacheFile == "" {
+		return err
+	}
+	fmt.Printf("Failed to load metadata from %s, using cache %s: %s\n", m.Source, m.CacheFile, err)
+	data, cerr := ioutil.ReadFile(m.CacheFile)
+	if cerr != nil {
+		return perrors.Wrap(err, "metadata source and cache both unavailable")
+	}
+	return m.update(data)
+}
+
+// Refresh fetches the metadata from its source and swaps it in. A source that
+// reports the metadata as not modified keeps the current index.
+func (m *MetadataRefresher) Refresh() error {
+	data, err := m.fetch()
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return nil
+	}
+	if err := m.update(data); err != nil {
+		return err
+	}
+	if m.CacheFile != "" {
+		if err := writeFileAtomic(m.CacheFile, data); err != nil {
+			fmt.Printf("Failed to write metadata cache %s: %s\n", m.CacheFile, err)
+		}
+	}
+	return nil
+}
+
+// Run refreshes the metadata until stop is closed. Failed refreshes are retried
+// after MinRefresh while the current metadata stays in use.
+func (m *MetadataRefresher) Run(stop <-chan struct{}) {
+	wait := m.NextRefresh()
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := m.Refresh(); err != nil {
+			fmt.Printf("Failed to refresh metadata from %s: %s\n", m.Source, err)
+			wait = m.MinRefresh
+			continue
+		}
+		wait = m.NextRefresh()
+	}
+}
+
+// NextRefresh returns how long the current metadata may be used before it is refreshed:
+// its cacheDuration, brought forward so that it is refreshed before validUntil.
+func (m *MetadataRefresher) NextRefresh() time.Duration {
+	idx := m.Index()
+	if idx == nil {
+		return m.MinRefresh
+	}
+	d := m.MaxRefresh
+	if idx.CacheDuration > 0 && idx.CacheDuration < d {
+		d = idx.CacheDuration
+	}
+	if !idx.ValidUntil.IsZero() {
+		if untilExpiry := time.Until(idx.ValidUntil) * 3 / 4; untilExpiry < d {
+			d = untilExpiry
+		}
+	}
+	if d < m.MinRefresh {
+		d = m.MinRefresh
+	}
+	return d
+}
+
+// remote reports whether the metadata is fetched from a URL.
+func (m *MetadataRefresher) remote() bool {
+	return strings.HasPrefix(m.Source, "http://") || strings.HasPrefix(m.Source, "https://")
+}
+
+func (m *MetadataRefresher) fetch() ([]byte, error) {
+	if !m.remote() {
+		data, err := ioutil.ReadFile(m.Source)
+		return data, perrors.Wrap(err, "Failed to read metadata file")
+	}
+	req, err := http.NewRequest(http.MethodGet, m.Source, nil)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	etag := m.etag
+	m.mu.Unlock()
+	if etag != "" && m.Index() != nil {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return nil, perrors.Wrap(err, "Failed to fetch metadata")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata fetch from %s returned %s", m.Source, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, perrors.Wrap(err, "Failed to read metadata response")
+	}
+	m.mu.Lock()
+	m.etag = resp.Header.Get("ETag")
+	m.mu.Unlock()
+	return data, nil
+}
+
+func (m *MetadataRefresher) update(data []byte) error {
+	if m.ValidationContext != nil {
+		verified, err := verifyMetadataSignature(data, m.ValidationContext)
+		if err != nil {
+			return err
+		}
+		data = verified
+	} else if m.remote() {
+		return fmt.Errorf("metadata from %s can't be trusted without a signing certificate", m.Source)
+	}
+	idx, err := LoadMetadataIndex(bytes.NewReader(data), m.Filters...)
+	if err != nil {
+		return err
+	}
+	if m.OnUpdate != nil {
+		if err := m.OnUpdate(idx); err != nil {
+			return perrors.Wrap(err, "Metadata update rejected")
+		}
+	}
+	m.index.Store(idx)
+	fmt.Printf("Loaded %d entities from %s\n", idx.Len(), m.Source)
+	return nil
+}
+
+// verifyMetadataSignature checks the enveloped signature of the document element of the
+// metadata and returns only the signed content.
+func verifyMetadataSignature(data []byte, validationContext *dsig.ValidationContext) ([]byte, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, perrors.Wrap(err, "Failed to parse metadata")
+	}
+	if doc.Root() == nil {
+		return nil, fmt.Errorf("empty metadata")
+	}
+	validated, err := validationContext.Validate(doc.Root())
+	if err != nil {
+		return nil, perrors.Wrap(err, "Metadata signature validation failed")
+	}
+	vdoc := etree.NewDocument()
+	vdoc.SetRoot(validated)
+	return vdoc.WriteToBytes()
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// CertificateStore is a dsig.X509CertificateStore whose certificates can be
+// swapped while validation contexts built on it are in use.
+type CertificateStore struct {
+	roots atomic.Value // []*x509.Certificate
+}
+
+func NewCertificateStore(certs []*x509.Certificate) *CertificateStore {
+	store := &CertificateStore{}
+	store.Swap(certs)
+	return store
+}
+
+func (s *CertificateStore) Certificates() ([]*x509.Certificate, error) {
+	roots, _ := s.roots.Load().([]*x509.Certificate)
+	return roots, nil
+}
+
+func (s *CertificateStore) Swap(certs []*x509.Certificate) {
+	s.roots.Store(certs)
+}
+
+// CreateRefreshingValidationContext loads the metadata and returns a validation context
+// trusting the signing certificates of the given Identity Provider. The certificates are
+// swapped whenever the refresher picks up new metadata; metadata no longer listing the
+// Identity Provider or its certificates is rejected.
+func CreateRefreshingValidationContext(m *MetadataRefresher, idpEntityID string) (*dsig.ValidationContext, error) {
+	store := NewCertificateStore(nil)
+	onUpdate := m.OnUpdate
+	m.OnUpdate = func(idx *MetadataIndex) error {
+		certs, err := idpSigningCertificates(idx, idpEntityID)
+		if err != nil {
+			return err
+		}
+		if onUpdate != nil {
+			if err := onUpdate(idx); err != nil {
+				return err
+			}
+		}
+		store.Swap(certs)
+		return nil
+	}
+	if err := m.Load(); err != nil {
+		return nil, err
+	}
+	validationContext := dsig.NewDefaultValidationContext(store)
+	validationContext.IdAttribute = "ID"
+	return validationContext, nil
+}
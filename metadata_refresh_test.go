@@ -0,0 +1,212 @@
+package samltools
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// idpMetadataForTest returns the metadata of an IdP, signed by signer unless it is nil,
+// and the signing certificate of the IdP.
+func idpMetadataForTest(t *testing.T, entityID string, cacheDuration string, signer *dsig.SigningContext) ([]byte, []byte) {
+	_, cert, _ := dsig.RandomKeyStoreForTest().GetKeyPair()
+	md := EntitiesDescriptor{
+		ID:            "_metadata",
+		CacheDuration: cacheDuration,
+		EntityDescriptors: []EntityDescriptor{{
+			EntityID: entityID,
+			IDPSSODescriptors: []IDPSSODescriptor{{
+				SSODescriptor: SSODescriptor{
+					ProtocolSupportEnumeration: ProtocolNamespace,
+					KeyDescriptors: []KeyDescriptor{{
+						Use:     "signing",
+						KeyInfo: KeyInfo{X509Data: X509Data{X509Certificates: []string{base64.StdEncoding.EncodeToString(cert)}}},
+					}},
+				},
+				SingleSignOnServices: []Endpoint{{Binding: HTTPRedirectBinding, Location: "https://idp.example.com/sso"}},
+			}},
+		}},
+	}
+	data, err := xml.Marshal(md)
+	if err != nil {
+		t.Fatalf("failed to marshal metadata %s", err)
+	}
+	if signer == nil {
+		return data, cert
+	}
+	doc := etree.NewDocument()
+	doc.ReadFromBytes(data)
+	signed, err := signEnvelopedAfter(signer, doc.Root(), "")
+	if err != nil {
+		t.Fatalf("failed to sign metadata %s", err)
+	}
+	doc.SetRoot(signed)
+	data, _ = doc.WriteToBytes()
+	return data, cert
+}
+
+func TestMetadataRefresherSwapsCertificates(t *testing.T) {
+	signer, signerCerts := signingContextForTest()
+	first, firstCert := idpMetadataForTest(t, "https://idp.example.com", "PT1H", signer)
+	second, secondCert := idpMetadataForTest(t, "https://idp.example.com", "PT1H", signer)
+	var current atomic.Value
+	current.Store(first)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(current.Load().([]byte))
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "metadata.xml")
+	refresher := NewMetadataRefresher(server.URL, cacheFile)
+	refresher.ValidationContext = CreateValidationContext(signerCerts)
+	vc, err := CreateRefreshingValidationContext(refresher, "https://idp.example.com")
+	if err != nil {
+		t.Fatalf("failed to load metadata %s", err)
+	}
+	roots, _ := vc.CertificateStore.Certificates()
+	if len(roots) != 1 || string(roots[0].Raw) != string(firstCert) {
+		t.Fatalf("expected the first certificate to be trusted")
+	}
+	if d := refresher.NextRefresh(); d != time.Hour {
+		t.Fatalf("expected refresh after cacheDuration, got %s", d)
+	}
+
+	current.Store(second)
+	if err := refresher.Refresh(); err != nil {
+		t.Fatalf("failed to refresh metadata %s", err)
+	}
+	roots, _ = vc.CertificateStore.Certificates()
+	if len(roots) != 1 || string(roots[0].Raw) != string(secondCert) {
+		t.Fatalf("expected the second certificate to be trusted after refresh")
+	}
+
+	// Metadata that no longer lists the IdP is rejected and the current certificates stay
+	other, _ := idpMetadataForTest(t, "https://other.example.com", "PT1H", signer)
+	current.Store(other)
+	if err := refresher.Refresh(); err == nil {
+		t.Fatalf("expected metadata without the IdP to be rejected")
+	}
+	roots, _ = vc.CertificateStore.Certificates()
+	if len(roots) != 1 || string(roots[0].Raw) != string(secondCert) {
+		t.Fatalf("expected the second certificate to be kept")
+	}
+
+	cached, err := ioutil.ReadFile(cacheFile)
+	if err != nil || string(cached) != string(second) {
+		t.Fatalf("expected the last accepted metadata in the cache, err=%v", err)
+	}
+}
+
+func TestMetadataRefresherFallsBackToCache(t *testing.T) {
+	signer, signerCerts := signingContextForTest()
+	data, _ := idpMetadataForTest(t, "https://idp.example.com", "", signer)
+	cacheFile := filepath.Join(t.TempDir(), "metadata.xml")
+	if err := ioutil.WriteFile(cacheFile, data, 0600); err != nil {
+		t.Fatalf("failed to write cache %s", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	refresher := NewMetadataRefresher(server.URL, cacheFile)
+	refresher.ValidationContext = CreateValidationContext(signerCerts)
+	if err := refresher.Load(); err != nil {
+		t.Fatalf("expected metadata to be loaded from cache %s", err)
+	}
+	if _, ok := refresher.Index().IDP("https://idp.example.com"); !ok {
+		t.Fatalf("expected IdP from cached metadata")
+	}
+	if err := NewMetadataRefresher(server.URL, "").Load(); err == nil {
+		t.Fatalf("expected load without cache to fail")
+	}
+}
+
+func TestMetadataRefresherRequiresSignature(t *testing.T) {
+	signer, signerCerts := signingContextForTest()
+	other, _ := signingContextForTest()
+	unsigned, _ := idpMetadataForTest(t, "https://idp.example.com", "", nil)
+	signed, _ := idpMetadataForTest(t, "https://idp.example.com", "", signer)
+	var current atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(current.Load().([]byte))
+	}))
+	defer server.Close()
+
+	current.Store(signed)
+	if err := NewMetadataRefresher(server.URL, "").Load(); err == nil {
+		t.Fatalf("expected metadata from a URL to be rejected without a signing certificate")
+	}
+	refresher := NewMetadataRefresher(server.URL, "")
+	refresher.ValidationContext = CreateValidationContext(signerCerts)
+	otherSigned, _ := idpMetadataForTest(t, "https://idp.example.com", "", other)
+	tampered := []byte(strings.Replace(string(signed), "https://idp.example.com/sso", "https://evil.example.com/sso", 1))
+	for name, data := range map[string][]byte{"unsigned": unsigned, "signed by another key": otherSigned, "tampered": tampered} {
+		current.Store(data)
+		if err := refresher.Refresh(); err == nil || refresher.Index() != nil {
+			t.Fatalf("expected %s metadata to be rejected", name)
+		}
+	}
+	current.Store(signed)
+	if err := refresher.Refresh(); err != nil {
+		t.Fatalf("failed to load signed metadata %s", err)
+	}
+	if _, ok := refresher.Index().IDP("https://idp.example.com"); !ok {
+		t.Fatalf("expected IdP from signed metadata")
+	}
+}
+
+func TestLoadMetadataIndexRejectsExpired(t *testing.T) {
+	md := `<EntitiesDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" validUntil="2020-01-01T00:00:00Z"></EntitiesDescriptor>`
+	if _, err := LoadMetadataIndex(strings.NewReader(md)); err == nil {
+		t.Fatalf("expected expired metadata to be rejected")
+	}
+	nested := `<EntitiesDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata">
+  <EntitiesDescriptor validUntil="2020-01-01T00:00:00Z">
+    <EntitiesDescriptor><EntityDescriptor entityID="urn:expired:nested"/></EntitiesDescriptor>
+    <EntityDescriptor entityID="urn:expired"/>
+  </EntitiesDescriptor>
+  <EntityDescriptor entityID="urn:valid"/>
+</EntitiesDescriptor>`
+	idx, err := LoadMetadataIndex(strings.NewReader(nested))
+	if err != nil {
+		t.Fatalf("failed to load metadata %s", err)
+	}
+	if ids := idx.EntityIDs(); strings.Join(ids, ",") != "urn:valid" {
+		t.Fatalf("expected the entities of the expired EntitiesDescriptor to be skipped, got %v", ids)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	cases := map[string]time.Duration{
+		"PT6H":     6 * time.Hour,
+		"P1DT12H":  36 * time.Hour,
+		"PT30M":    30 * time.Minute,
+		"PT1.5S":   1500 * time.Millisecond,
+		"P1Y":      365 * 24 * time.Hour,
+		"-PT1M":    -time.Minute,
+		"P0Y0M1DT": 0,
+	}
+	for s, want := range cases {
+		got, err := ParseDuration(s)
+		if want == 0 {
+			if err == nil {
+				t.Fatalf("expected %q to be invalid", s)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Fatalf("ParseDuration(%q) = %s, %v; want %s", s, got, err, want)
+		}
+	}
+}
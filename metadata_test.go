@@ -0,0 +1,115 @@
+package samltools
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadMetadataIndexAggregate(t *testing.T) {
+	idx, err := LoadMetadataIndexFile("./samples/federation-metadata.xml")
+	if err != nil {
+		t.Fatalf("failed to load aggregate %s", err)
+	}
+	if idx.Len() != 4 {
+		t.Fatalf("expected 4 entities, got %d", idx.Len())
+	}
+	if ids := idx.IDPEntityIDs(); strings.Join(ids, ",") != "http://idp.samltools.com,urn:dev-ejtl988w.auth0.com" {
+		t.Fatalf("unexpected IdPs %v", ids)
+	}
+	if ids := idx.SPEntityIDs(); strings.Join(ids, ",") != "urn:auth0:dev-ejtl988w:auth0-as-sp,urn:msingh.samltools:sp" {
+		t.Fatalf("unexpected SPs %v", ids)
+	}
+
+	sp, ok := idx.SP("urn:auth0:dev-ejtl988w:auth0-as-sp")
+	if !ok {
+		t.Fatalf("auth0 SP not indexed")
+	}
+	signing, err := sp.SigningCertificates()
+	if err != nil || len(signing) != 1 {
+		t.Fatalf("expected one signing cert, got %d err=%v", len(signing), err)
+	}
+	encryption, err := sp.EncryptionCertificates()
+	if err != nil || len(encryption) != 1 {
+		t.Fatalf("expected one encryption cert, got %d err=%v", len(encryption), err)
+	}
+
+	idp, _ := idx.IDP("urn:dev-ejtl988w.auth0.com")
+	if loc, ok := idp.SingleSignOnService(HTTPRedirectBinding); !ok || loc != "https://dev-ejtl988w.auth0.com/samlp/lqrbWWMYc25UrCiYA5Pt06U625c4K6DO" {
+		t.Fatalf("unexpected redirect SSO location %q", loc)
+	}
+}
+
+func TestLoadMetadataIndexSingleEntity(t *testing.T) {
+	idx, err := LoadMetadataIndexFile("./samples/dev-ejtl988w_auth0_com-metadata.xml")
+	if err != nil {
+		t.Fatalf("failed to load metadata %s", err)
+	}
+	if _, err := CreateValidationContextFromMetadata(idx, "urn:dev-ejtl988w.auth0.com"); err != nil {
+		t.Fatalf("failed to create validation context %s", err)
+	}
+	if _, err := CreateValidationContextFromMetadata(idx, "urn:unknown"); err == nil {
+		t.Fatalf("expected unknown IdP to fail")
+	}
+}
+
+func TestMetadataFilters(t *testing.T) {
+	idx, err := LoadMetadataIndexFile("./samples/federation-metadata.xml", RegisteredBy("https://local.samltools.com"))
+	if err != nil {
+		t.Fatalf("failed to load aggregate %s", err)
+	}
+	if ids := idx.EntityIDs(); strings.Join(ids, ",") != "http://idp.samltools.com,urn:msingh.samltools:sp" {
+		t.Fatalf("unexpected entities for registration authority %v", ids)
+	}
+
+	filters := MetadataFilters("", map[string]string{
+		"http://macedir.org/entity-category": "http://refeds.org/category/research-and-scholarship",
+	})
+	idx, err = LoadMetadataIndexFile("./samples/federation-metadata.xml", filters...)
+	if err != nil {
+		t.Fatalf("failed to load aggregate %s", err)
+	}
+	if ids := idx.EntityIDs(); strings.Join(ids, ",") != "urn:msingh.samltools:sp" {
+		t.Fatalf("unexpected entities for entity category %v", ids)
+	}
+}
+
+func TestResponseEndpoint(t *testing.T) {
+	isDefault := true
+	sp := &SPSSODescriptor{AssertionConsumerServices: []IndexedEndpoint{
+		{Binding: HTTPPostBinding, Location: "https://sp.example.com/acs/post", Index: 0},
+		{Binding: HTTPArtifactBinding, Location: "https://sp.example.com/acs/artifact", Index: 1, IsDefault: &isDefault},
+		{Binding: HTTPRedirectBinding, Location: "https://sp.example.com/acs/redirect", Index: 2},
+		{Binding: HTTPPostBinding, Location: "https://sp.example.com/acs/other", Index: 3},
+	}}
+	index := func(i int) *int { return &i }
+	tests := []struct {
+		name     string
+		request  *AuthnRequest
+		location string
+		subCode  string
+	}{
+		{"unsolicited", nil, "https://sp.example.com/acs/artifact", ""},
+		{"default", &AuthnRequest{}, "https://sp.example.com/acs/artifact", ""},
+		{"index", &AuthnRequest{AssertionConsumerServiceIndex: index(3)}, "https://sp.example.com/acs/other", ""},
+		{"unknown index", &AuthnRequest{AssertionConsumerServiceIndex: index(7)}, "", StatusRequestDenied},
+		{"unsupported index", &AuthnRequest{AssertionConsumerServiceIndex: index(2)}, "", StatusRequestDenied},
+		{"binding", &AuthnRequest{ProtocolBinding: HTTPPostBinding}, "https://sp.example.com/acs/post", ""},
+		{"unsupported binding", &AuthnRequest{ProtocolBinding: HTTPRedirectBinding}, "", StatusUnsupportedBinding},
+		{"url", &AuthnRequest{AssertionConsumerServiceURL: "https://sp.example.com/acs/other"}, "https://sp.example.com/acs/other", ""},
+		{"url and binding", &AuthnRequest{AssertionConsumerServiceURL: "https://sp.example.com/acs/post", ProtocolBinding: HTTPPostBinding}, "https://sp.example.com/acs/post", ""},
+		{"url with other binding", &AuthnRequest{AssertionConsumerServiceURL: "https://sp.example.com/acs/post", ProtocolBinding: HTTPArtifactBinding}, "", StatusRequestDenied},
+		{"unregistered url", &AuthnRequest{AssertionConsumerServiceURL: "https://attacker.example.com/acs"}, "", StatusRequestDenied},
+	}
+	for _, test := range tests {
+		ep, err := sp.ResponseEndpoint(test.request)
+		if test.location != "" {
+			if err != nil || ep.Location != test.location {
+				t.Fatalf("%s: expected %s, got %s %v", test.name, test.location, ep.Location, err)
+			}
+			continue
+		}
+		if status, ok := err.(*StatusError); !ok || status.SubCode != test.subCode {
+			t.Fatalf("%s: expected %s, got %v", test.name, test.subCode, err)
+		}
+	}
+}
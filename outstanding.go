@@ -0,0 +1,82 @@
+package samltools
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// OutstandingRequests remembers the AuthnRequests a Service Provider sent until the IdP
+// answers them, each bound to the browser it was sent through by a cookie. Responses
+// are only accepted in response to an outstanding request of the browser, and once.
+//
+// Browsers only send the cookie along the cross-site POST of an HTTP-POST Response when
+// it is SameSite=None, which requires it to be Secure: over plain HTTP, Responses must
+// be received with the HTTP-Artifact binding for SP-initiated SSO to work.
+type OutstandingRequests struct {
+	CookieName string
+	// TTL is how long the IdP has to answer an AuthnRequest.
+	TTL time.Duration
+
+	mu       sync.Mutex
+	requests map[string]outstandingRequest
+}
+
+type outstandingRequest struct {
+	browser string
+	expires time.Time
+}
+
+func NewOutstandingRequests() *OutstandingRequests {
+	return &OutstandingRequests{
+		CookieName: "samltools_sp_requests",
+		TTL:        10 * time.Minute,
+		requests:   map[string]outstandingRequest{},
+	}
+}
+
+// Add records the AuthnRequest as outstanding for the browser, identified by the
+// cookie it is given when it hasn't one.
+func (o *OutstandingRequests) Add(w http.ResponseWriter, req *http.Request, requestID string) {
+	now := time.Now()
+	expires := now.Add(o.TTL)
+	browser := ""
+	if c, err := req.Cookie(o.CookieName); err == nil && c.Value != "" {
+		browser = c.Value
+	} else {
+		browser = NewID()
+	}
+	setSessionCookie(w, req, o.CookieName, browser, expires)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for id, r := range o.requests {
+		if now.After(r.expires) {
+			delete(o.requests, id)
+		}
+	}
+	o.requests[requestID] = outstandingRequest{browser: browser, expires: expires}
+}
+
+// Consume checks the AuthnRequest a Response is in response to is outstanding for the
+// browser, and forgets it.
+func (o *OutstandingRequests) Consume(req *http.Request, inResponseTo string) error {
+	browser := ""
+	if c, err := req.Cookie(o.CookieName); err == nil {
+		browser = c.Value
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	r, ok := o.requests[inResponseTo]
+	if !ok {
+		return fmt.Errorf("no outstanding AuthnRequest %s", inResponseTo)
+	}
+	if browser == "" || r.browser != browser {
+		return fmt.Errorf("AuthnRequest %s wasn't sent through this browser", inResponseTo)
+	}
+	delete(o.requests, inResponseTo)
+	if time.Now().After(r.expires) {
+		return fmt.Errorf("AuthnRequest %s has expired", inResponseTo)
+	}
+	return nil
+}
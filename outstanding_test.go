@@ -0,0 +1,36 @@
+package samltools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOutstandingRequests(t *testing.T) {
+	o := NewOutstandingRequests()
+	rec := httptest.NewRecorder()
+	o.Add(rec, httptest.NewRequest(http.MethodGet, "/login", nil), "_req1")
+	cookie := rec.Result().Cookies()[0]
+
+	req := httptest.NewRequest(http.MethodPost, "/assertion", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	o.Add(rec, req, "_req2")
+	if c := rec.Result().Cookies()[0]; c.Value != cookie.Value {
+		t.Fatalf("expected the browser to keep its cookie, got %s", c.Value)
+	}
+	if err := o.Consume(httptest.NewRequest(http.MethodPost, "/assertion", nil), "_req1"); err == nil {
+		t.Fatalf("expected request without the cookie to be rejected")
+	}
+	if err := o.Consume(req, "_req1"); err != nil {
+		t.Fatalf("expected outstanding request to be consumed %s", err)
+	}
+	if err := o.Consume(req, "_req1"); err == nil {
+		t.Fatalf("expected request to be consumed once")
+	}
+	o.requests["_req2"] = outstandingRequest{browser: cookie.Value, expires: time.Now().Add(-time.Second)}
+	if err := o.Consume(req, "_req2"); err == nil {
+		t.Fatalf("expected expired request to be rejected")
+	}
+}
@@ -0,0 +1,34 @@
+package samltools
+
+import (
+	"sync"
+	"time"
+)
+
+// ReplayCache remembers the IDs of received messages until they expire, so that
+// a message received a second time can be rejected.
+type ReplayCache struct {
+	mu  sync.Mutex
+	ids map[string]time.Time
+}
+
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{ids: map[string]time.Time{}}
+}
+
+// Add records id until expires and reports whether it was new.
+func (c *ReplayCache) Add(id string, expires time.Time) bool {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for seen, until := range c.ids {
+		if now.After(until) {
+			delete(c.ids, seen)
+		}
+	}
+	if _, ok := c.ids[id]; ok {
+		return false
+	}
+	c.ids[id] = expires
+	return true
+}
@@ -0,0 +1,244 @@
+package samltools
+
+import (
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	perrors "github.com/pkg/errors"
+)
+
+// Response is the samlp:Response protocol message as received by a Service Provider.
+// Only unencrypted assertions are read.
+type Response struct {
+	XMLName      xml.Name    `xml:"urn:oasis:names:tc:SAML:2.0:protocol Response"`
+	ID           string      `xml:"ID,attr"`
+	InResponseTo string      `xml:"InResponseTo,attr,omitempty"`
+	Version      string      `xml:"Version,attr"`
+	IssueInstant time.Time   `xml:"IssueInstant,attr"`
+	Destination  string      `xml:"Destination,attr,omitempty"`
+	Issuer       *Issuer     `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Status       Status      `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+	Assertions   []Assertion `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+}
+
+type Status struct {
+	StatusCode    StatusCode `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
+	StatusMessage string     `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusMessage,omitempty"`
+}
+
+type StatusCode struct {
+	Value      string      `xml:"Value,attr"`
+	StatusCode *StatusCode `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
+}
+
+// NewStatus returns the Status reporting the error, Success when err is nil.
+func NewStatus(err *StatusError) Status {
+	if err == nil {
+		return Status{StatusCode: StatusCode{Value: StatusSuccess}}
+	}
+	st := Status{StatusCode: StatusCode{Value: err.Code}, StatusMessage: err.Message}
+	if err.SubCode != "" {
+		st.StatusCode.StatusCode = &StatusCode{Value: err.SubCode}
+	}
+	return st
+}
+
+// Err returns the status as a StatusError, nil when it is a plain Success.
+func (s Status) Err() *StatusError {
+	err := &StatusError{Code: s.StatusCode.Value, Message: s.StatusMessage}
+	if s.StatusCode.StatusCode != nil {
+		err.SubCode = s.StatusCode.StatusCode.Value
+	}
+	if err.Code == StatusSuccess && err.SubCode == "" {
+		return nil
+	}
+	return err
+}
+
+type Assertion struct {
+	XMLName             xml.Name             `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	ID                  string               `xml:"ID,attr"`
+	Version             string               `xml:"Version,attr"`
+	IssueInstant        time.Time            `xml:"IssueInstant,attr"`
+	Issuer              *Issuer              `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Subject             *Subject             `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject"`
+	Conditions          *Conditions          `xml:"urn:oasis:names:tc:SAML:2.0:assertion Conditions"`
+	AuthnStatements     []AuthnStatement     `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnStatement"`
+	AttributeStatements []AttributeStatement `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeStatement"`
+}
+
+type NameID struct {
+	XMLName         xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+	Format          string   `xml:"Format,attr,omitempty"`
+	NameQualifier   string   `xml:"NameQualifier,attr,omitempty"`
+	SPNameQualifier string   `xml:"SPNameQualifier,attr,omitempty"`
+	Value           string   `xml:",chardata"`
+}
+
+type Subject struct {
+	NameID               *NameID               `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+	SubjectConfirmations []SubjectConfirmation `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmation"`
+}
+
+type SubjectConfirmation struct {
+	Method                  string                   `xml:"Method,attr"`
+	SubjectConfirmationData *SubjectConfirmationData `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmationData"`
+}
+
+type SubjectConfirmationData struct {
+	NotOnOrAfter *time.Time `xml:"NotOnOrAfter,attr,omitempty"`
+	Recipient    string     `xml:"Recipient,attr,omitempty"`
+	InResponseTo string     `xml:"InResponseTo,attr,omitempty"`
+}
+
+type Conditions struct {
+	NotBefore            *time.Time            `xml:"NotBefore,attr,omitempty"`
+	NotOnOrAfter         *time.Time            `xml:"NotOnOrAfter,attr,omitempty"`
+	AudienceRestrictions []AudienceRestriction `xml:"urn:oasis:names:tc:SAML:2.0:assertion AudienceRestriction"`
+}
+
+type AudienceRestriction struct {
+	Audiences []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Audience"`
+}
+
+type AuthnStatement struct {
+	AuthnInstant         time.Time  `xml:"AuthnInstant,attr"`
+	SessionIndex         string     `xml:"SessionIndex,attr,omitempty"`
+	SessionNotOnOrAfter  *time.Time `xml:"SessionNotOnOrAfter,attr,omitempty"`
+	AuthnContextClassRef string     `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContext>AuthnContextClassRef"`
+}
+
+type AttributeStatement struct {
+	Attributes []Attribute `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
+}
+
+// ParseResponse unmarshals a samlp:Response. Signatures must have been checked before.
+func ParseResponse(data []byte) (*Response, error) {
+	resp := &Response{}
+	if err := xml.Unmarshal(data, resp); err != nil {
+		return nil, perrors.Wrap(err, "Can't read Response element")
+	}
+	if resp.ID == "" {
+		return nil, fmt.Errorf("Response element doesn't contain ID attribute")
+	}
+	return resp, nil
+}
+
+// Unsolicited reports whether the Response was sent without an AuthnRequest, as with IdP-initiated SSO.
+func (r *Response) Unsolicited() bool {
+	return r.InResponseTo == ""
+}
+
+// NameID returns the NameID of the subject, nil when there is none.
+func (a *Assertion) NameID() *NameID {
+	if a.Subject == nil {
+		return nil
+	}
+	return a.Subject.NameID
+}
+
+// SessionIndex returns the SessionIndex of the first AuthnStatement.
+func (a *Assertion) SessionIndex() string {
+	if len(a.AuthnStatements) == 0 {
+		return ""
+	}
+	return a.AuthnStatements[0].SessionIndex
+}
+
+// SessionNotOnOrAfter returns the earliest SessionNotOnOrAfter of the AuthnStatements,
+// nil when the IdP didn't limit the session.
+func (a *Assertion) SessionNotOnOrAfter() *time.Time {
+	var earliest *time.Time
+	for _, stmt := range a.AuthnStatements {
+		if stmt.SessionNotOnOrAfter != nil && (earliest == nil || stmt.SessionNotOnOrAfter.Before(*earliest)) {
+			earliest = stmt.SessionNotOnOrAfter
+		}
+	}
+	return earliest
+}
+
+// Attributes returns the values of all attributes, by attribute name.
+func (a *Assertion) Attributes() map[string][]string {
+	attrs := map[string][]string{}
+	for _, stmt := range a.AttributeStatements {
+		for _, attr := range stmt.Attributes {
+			for _, v := range attr.Values {
+				attrs[attr.Name] = append(attrs[attr.Name], v.Value)
+			}
+		}
+	}
+	return attrs
+}
+
+// ClockSkew is the leeway given on the validity periods of assertions, the clocks of the
+// IdP and the Service Provider not being exactly in sync.
+var ClockSkew = 3 * time.Minute
+
+// BearerMethod is the SubjectConfirmation method of the Web Browser SSO profile.
+const BearerMethod = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+// Validate checks the assertion can be used at now by the Service Provider audience, at
+// its Assertion Consumer Service recipient: its Conditions are met, it is restricted to
+// the audience and a bearer SubjectConfirmation for the recipient hasn't expired yet.
+func (a *Assertion) Validate(audience string, recipient string, now time.Time) error {
+	c := a.Conditions
+	if c == nil {
+		return fmt.Errorf("assertion has no Conditions")
+	}
+	if c.NotBefore != nil && now.Add(ClockSkew).Before(*c.NotBefore) {
+		return fmt.Errorf("assertion isn't valid before %s", c.NotBefore)
+	}
+	if c.NotOnOrAfter != nil && !now.Add(-ClockSkew).Before(*c.NotOnOrAfter) {
+		return fmt.Errorf("assertion expired at %s", c.NotOnOrAfter)
+	}
+	if len(c.AudienceRestrictions) == 0 {
+		return fmt.Errorf("assertion has no AudienceRestriction")
+	}
+	for _, restriction := range c.AudienceRestrictions {
+		if !ContainsString(restriction.Audiences, audience) {
+			return fmt.Errorf("assertion is restricted to %v, not %s", restriction.Audiences, audience)
+		}
+	}
+	if a.Subject == nil {
+		return fmt.Errorf("assertion has no Subject")
+	}
+	err := fmt.Errorf("assertion has no bearer SubjectConfirmation")
+	for _, sc := range a.Subject.SubjectConfirmations {
+		data := sc.SubjectConfirmationData
+		switch {
+		case sc.Method != BearerMethod || data == nil:
+		case data.Recipient != recipient:
+			err = fmt.Errorf("assertion is for %s, not %s", data.Recipient, recipient)
+		case data.NotOnOrAfter == nil:
+			err = fmt.Errorf("bearer SubjectConfirmation has no NotOnOrAfter")
+		case !now.Add(-ClockSkew).Before(*data.NotOnOrAfter):
+			err = fmt.Errorf("bearer SubjectConfirmation expired at %s", data.NotOnOrAfter)
+		default:
+			return nil
+		}
+	}
+	return err
+}
+
+// NotOnOrAfter returns when the assertion can no longer be used: the earliest NotOnOrAfter
+// of its Conditions and SubjectConfirmations, the zero time when it sets none.
+func (a *Assertion) NotOnOrAfter() time.Time {
+	var earliest time.Time
+	limit := func(t *time.Time) {
+		if t != nil && (earliest.IsZero() || t.Before(earliest)) {
+			earliest = *t
+		}
+	}
+	if a.Conditions != nil {
+		limit(a.Conditions.NotOnOrAfter)
+	}
+	if a.Subject != nil {
+		for _, sc := range a.Subject.SubjectConfirmations {
+			if sc.SubjectConfirmationData != nil {
+				limit(sc.SubjectConfirmationData.NotOnOrAfter)
+			}
+		}
+	}
+	return earliest
+}
@@ -0,0 +1,124 @@
+package samltools
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseResponse(t *testing.T) {
+	data, err := ioutil.ReadFile("./samples/saml-assertion-example.xml")
+	if err != nil {
+		t.Fatalf("failed to read sample %s", err)
+	}
+	resp, err := ParseResponse(data)
+	if err != nil {
+		t.Fatalf("failed to parse Response %s", err)
+	}
+	if resp.InResponseTo != "_5536853304964569377" || resp.Status.Err() != nil || len(resp.Assertions) != 1 {
+		t.Fatalf("unexpected Response %#v", resp)
+	}
+	assertion := resp.Assertions[0]
+	if nameID := assertion.NameID(); nameID == nil || nameID.Value != "auth0|5ffafb48d9ff9b0070c52eab" {
+		t.Fatalf("unexpected NameID %#v", assertion.NameID())
+	}
+	if assertion.SessionIndex() != "_v2T2aYi_zAipP6xHHg5oOHvtcaQoDmXt" {
+		t.Fatalf("unexpected SessionIndex %s", assertion.SessionIndex())
+	}
+	if email := assertion.Attributes()["email"]; len(email) != 1 || email[0] != "dev.null.dump.1@gmail.com" {
+		t.Fatalf("unexpected email attribute %v", email)
+	}
+}
+
+func TestParseValidatedAssertion(t *testing.T) {
+	ctx, certs := signingContextForTest()
+	opts := ResponseOptions{NameID: "user1", NameIDFormat: NameIDFormatEmailAddress, SessionIndex: "_session1"}
+	resp, err := CreateSAMLResponseWithOptions("http://idp.samltools.com", "_req1", "http://sp.samltools.com:4567/assertion", "urn:msingh.samltools:sp", opts, ctx)
+	if err != nil {
+		t.Fatalf("failed to create Response %s", err)
+	}
+	assertion, err := ParseValidatedAssertion(resp, CreateValidationContext(certs))
+	if err != nil {
+		t.Fatalf("failed to validate assertion %s", err)
+	}
+	nameID := assertion.NameID()
+	if nameID == nil || nameID.Value != "user1" || nameID.Format != NameIDFormatEmailAddress || assertion.SessionIndex() != "_session1" {
+		t.Fatalf("unexpected assertion %#v", assertion)
+	}
+	_, otherCerts := signingContextForTest()
+	if _, err := ParseValidatedAssertion(resp, CreateValidationContext(otherCerts)); err == nil {
+		t.Fatalf("expected validation with the wrong certificate to fail")
+	}
+}
+
+func TestUnsolicitedResponse(t *testing.T) {
+	ctx, _ := signingContextForTest()
+	resp, err := CreateSAMLResponseWithOptions("http://idp.samltools.com", "", "http://sp.samltools.com:4567/assertion", "urn:msingh.samltools:sp", ResponseOptions{}, ctx)
+	if err != nil {
+		t.Fatalf("failed to create Response %s", err)
+	}
+	data, _ := base64.StdEncoding.DecodeString(resp)
+	if strings.Contains(string(data), "InResponseTo") {
+		t.Fatalf("unsolicited Response refers to a request %s", data)
+	}
+	parsed, err := ParseResponse(data)
+	if err != nil {
+		t.Fatalf("failed to parse Response %s", err)
+	}
+	if !parsed.Unsolicited() {
+		t.Fatalf("expected Response to be unsolicited")
+	}
+}
+
+func TestValidateAssertion(t *testing.T) {
+	ctx, certs := signingContextForTest()
+	const (
+		audience  = "urn:msingh.samltools:sp"
+		recipient = "http://sp.samltools.com:4567/assertion"
+	)
+	parse := func(resp string) *Assertion {
+		assertion, err := ParseValidatedAssertion(resp, CreateValidationContext(certs))
+		if err != nil {
+			t.Fatalf("failed to validate assertion %s", err)
+		}
+		return assertion
+	}
+	resp, _ := CreateSAMLResponseWithOptions("http://idp.samltools.com", "_req1", recipient, audience, ResponseOptions{}, ctx)
+	assertion := parse(resp)
+	now := time.Now()
+	if err := assertion.Validate(audience, recipient, now); err != nil {
+		t.Fatalf("expected assertion to be valid %s", err)
+	}
+	if err := assertion.Validate("urn:other:sp", recipient, now); err == nil {
+		t.Fatalf("expected assertion for another audience to be rejected")
+	}
+	if err := assertion.Validate(audience, "http://other.samltools.com/assertion", now); err == nil {
+		t.Fatalf("expected assertion for another recipient to be rejected")
+	}
+	if err := assertion.Validate(audience, recipient, now.Add(3*time.Hour)); err == nil {
+		t.Fatalf("expected expired assertion to be rejected")
+	}
+	if err := assertion.Validate(audience, recipient, now.Add(-time.Hour)); err == nil {
+		t.Fatalf("expected assertion not valid yet to be rejected")
+	}
+
+	// The bearer SubjectConfirmation expires before the Conditions
+	expired := parse(resp)
+	past := now.Add(-time.Hour)
+	expired.Subject.SubjectConfirmations[0].SubjectConfirmationData.NotOnOrAfter = &past
+	if err := expired.Validate(audience, recipient, now); err == nil {
+		t.Fatalf("expected expired SubjectConfirmation to be rejected")
+	}
+	unconfirmed := parse(resp)
+	unconfirmed.Subject.SubjectConfirmations[0].Method = "urn:oasis:names:tc:SAML:2.0:cm:holder-of-key"
+	if err := unconfirmed.Validate(audience, recipient, now); err == nil {
+		t.Fatalf("expected assertion without bearer SubjectConfirmation to be rejected")
+	}
+	unrestricted := parse(resp)
+	unrestricted.Conditions.AudienceRestrictions = nil
+	if err := unrestricted.Validate(audience, recipient, now); err == nil {
+		t.Fatalf("expected assertion without AudienceRestriction to be rejected")
+	}
+}
@@ -1,14 +1,17 @@
 package samltools
 
 import (
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	mrand "math/rand"
+	"sort"
 	"time"
 
 	"github.com/beevik/etree"
@@ -25,29 +28,50 @@ var (
 //Test Cert
 var Certb64 = `MIIDtDCCApwCCQCjWnFcIynj3DANBgkqhkiG9w0BAQsFADCBmzELMAkGA1UEBhMCU0cxCzAJBgNVBAgMAlNHMQswCQYDVQQHDAJTRzEWMBQGA1UECgwNaWRwLnNhbWx0b29sczEbMBkGA1UECwwSaWRwLnNhbWx0b29scy5pbXBsMRowGAYDVQQDDBFpZHAuc2FtbHRvb2xzLmNvbTEhMB8GCSqGSIb3DQEJARYSbW9ubW9oYW5AZ21haWwuY29tMB4XDTIxMDcyNjEzNDAxOFoXDTIyMDcyNjEzNDAxOFowgZsxCzAJBgNVBAYTAlNHMQswCQYDVQQIDAJTRzELMAkGA1UEBwwCU0cxFjAUBgNVBAoMDWlkcC5zYW1sdG9vbHMxGzAZBgNVBAsMEmlkcC5zYW1sdG9vbHMuaW1wbDEaMBgGA1UEAwwRaWRwLnNhbWx0b29scy5jb20xITAfBgkqhkiG9w0BCQEWEm1vbm1vaGFuQGdtYWlsLmNvbTCCASIwDQYJKoZIhvcNAQEBBQADggEPADCCAQoCggEBAJp86VwT5M+APXg7gjN7suJSF2ikanKplsM5S+/hGKuPUwUoNp+9urkRXwRyLTSkB12O/kwa8hlcFK1Cvlx9durfwp/B2h39hHEiXrhiIpbswjzPbZRWAts8FDmxLKU2vb9T8K9ZLTv4IiqtWC70eeFg4iVqQ6/pkHCpFLUfoBbNdEsqGCJO6uo5ivt8cPvlf52iJKFB55R2KQsEDxOqoUxrCeIhEY/mGoSd3LvqBSypwv4dNdpwWEavkyb7f8sWm98Rf4l/MND9evRGSII7g7xLBvjbXMQeZSVXL4bpFCGDsGjuKViTrjBJ2lvYEPrMlPDr0NjFK9ipe9NYYUiXBakCAwEAATANBgkqhkiG9w0BAQsFAAOCAQEAEAM0gblUq0KS3tr1qyGtQ8wp6NemoOua22iaZokRzjUi6XOHdHwMXZ+wcm5yUEaqgX/o+ZJoiEax7wNl2azJk/zHWwpxvfzScrYhvof/JintY8jVBQQIfbOotQ2xENVgw2//YS0VHrz10+8lFtXi1cqxK38OagNdG/lXLj8n0hV+RVlabLAYk8EQ5wUZrVBbvcnLBM+u7sHM+QlbAlIgu06QJiHg3YfnE3GdjgZxDuXjHXPHk5LNhhoFGwJdtDhje0+FF+uD+eCBLtsrZJx3uSuBOOpUF3Dhoe+4cVZx1UM8AHW3q8LVMf02vAu2NIfX1r51XoiQcHsefMDMY33MYg==`
 
-type Issuer struct {
-	Namespace string `xml:"xmlns:saml,attr"`
-	Value     string `xml:",chardata"`
-}
-type AuthnRequest struct {
-	XMLName         xml.Name `xml:"samlp:AuthnRequest"`
-	SamlpAttr       string   `xml:"xmlns:samlp,attr"`
-	ID              string   `xml:"ID,attr"`
-	IssueInstant    string   `xml:"IssueInstant,attr"`
-	ProtocolBinding string   `xml:"ProtocolBinding,attr"`
-	Version         string   `xml:"Version,attr"`
-	Issuer          Issuer   `xml:"saml:Issuer"`
+// NewID returns a random identifier usable as the ID of SAML messages.
+// It starts with an underscore since xs:ID values can't start with a digit.
+func NewID() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic("failed to read random bytes: " + err.Error())
+	}
+	return "_" + hex.EncodeToString(b)
 }
 
 func ValidateAssertion(base64EncResp string, validationContext *dsig.ValidationContext) error {
+	_, err := validateAssertionElement(base64EncResp, validationContext)
+	return err
+}
+
+// ParseValidatedAssertion validates the signature of the assertion of a base64 encoded
+// Response like ValidateAssertion and returns the assertion as signed.
+func ParseValidatedAssertion(base64EncResp string, validationContext *dsig.ValidationContext) (*Assertion, error) {
+	elem, err := validateAssertionElement(base64EncResp, validationContext)
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(elem)
+	data, err := doc.WriteToBytes()
+	if err != nil {
+		return nil, perrors.Wrap(err, "Failed to write validated assertion")
+	}
+	assertion := &Assertion{}
+	if err := xml.Unmarshal(data, assertion); err != nil {
+		return nil, perrors.Wrap(err, "Can't read Assertion element")
+	}
+	return assertion, nil
+}
+
+func validateAssertionElement(base64EncResp string, validationContext *dsig.ValidationContext) (*etree.Element, error) {
 
 	samlResp, err := base64.StdEncoding.DecodeString(base64EncResp)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	doc := etree.NewDocument()
 	if err := doc.ReadFromBytes(samlResp); err != nil {
-		return perrors.Wrap(err, "Failed to create XML from decoded bytes")
+		return nil, perrors.Wrap(err, "Failed to create XML from decoded bytes")
 	}
 	var assertionEl *etree.Element
 	etreeutils.NSFindIterate(doc.Root(), "urn:oasis:names:tc:SAML:2.0:assertion", "Assertion", func(n etreeutils.NSContext, e *etree.Element) error {
@@ -56,26 +80,63 @@ func ValidateAssertion(base64EncResp string, validationContext *dsig.ValidationC
 		return etreeutils.ErrTraversalHalted
 	})
 	if assertionEl == nil {
-		return fmt.Errorf("assertion element not found")
+		return nil, fmt.Errorf("assertion element not found")
 	}
 
 	elem, err := validationContext.Validate(assertionEl)
 	if err != nil {
-		return perrors.Wrap(err, fmt.Sprintf("Error validationContext, transformed =%v", elem))
+		return nil, perrors.Wrap(err, fmt.Sprintf("Error validationContext, transformed =%v", elem))
 
 	}
 
-	return nil
+	return elem, nil
+
+}
 
+// ResponseOptions describe the subject and session of the assertion created by
+// CreateSAMLResponseWithOptions. Empty fields take the values of CreateSAMLResponse.
+type ResponseOptions struct {
+	NameID       string
+	NameIDFormat string
+	SessionIndex string
+	// SessionNotOnOrAfter, when set, tells Service Providers when to end their session.
+	SessionNotOnOrAfter time.Time
+	// Attributes are the attributes of the subject, by name. The sample attributes of
+	// IDPUser1 are sent when it is nil.
+	Attributes map[string][]string
+	// AssertionLifetime is how long the assertion can be used for, 2 hours by default.
+	AssertionLifetime time.Duration
+	// SignResponse signs the Response as well as the assertion.
+	SignResponse bool
+	// AuthnInstant is when the subject logged in, the time of the assertion when it is zero.
+	AuthnInstant time.Time
 }
 
 func CreateSAMLResponse(issuer string, inRespTo string, recipient string, audience string, signingCtx *dsig.SigningContext) (string, error) {
+	return CreateSAMLResponseWithOptions(issuer, inRespTo, recipient, audience, ResponseOptions{}, signingCtx)
+}
+
+// CreateSAMLResponseWithOptions is CreateSAMLResponse for the subject and session given by opts.
+// An empty inRespTo creates an unsolicited Response, for IdP-initiated SSO.
+func CreateSAMLResponseWithOptions(issuer string, inRespTo string, recipient string, audience string, opts ResponseOptions, signingCtx *dsig.SigningContext) (string, error) {
+	if opts.NameID == "" {
+		opts.NameID = "IDPUser1"
+	}
+	if opts.NameIDFormat == "" {
+		opts.NameIDFormat = NameIDFormatUnspecified
+	}
+	if opts.SessionIndex == "" {
+		opts.SessionIndex = NewID()
+	}
+	if opts.AssertionLifetime == 0 {
+		opts.AssertionLifetime = 2 * time.Hour
+	}
 	mrand.Seed(time.Now().UnixNano())
 
 	//create assertion
 	assertionID := fmt.Sprintf("_%d", mrand.Int())
 	issueTime := time.Now().Format(time.RFC3339)
-	notOnOrAfter := time.Now().Add(2 * time.Hour).Format(time.RFC3339)
+	notOnOrAfter := time.Now().Add(opts.AssertionLifetime).Format(time.RFC3339)
 	requestId := inRespTo
 	doc := etree.NewDocument()
 	asEl := doc.CreateElement("saml:Assertion")
@@ -87,18 +148,39 @@ func CreateSAMLResponse(issuer string, inRespTo string, recipient string, audien
 	//add Issuer
 	asEl.CreateElement("saml:Issuer").CreateText(issuer)
 
-	addSubject(asEl, requestId, notOnOrAfter, recipient)
+	addSubject(asEl, opts, requestId, notOnOrAfter, recipient)
 	addConditions(asEl, notOnOrAfter, audience)
-	addAuthStatements(asEl, issueTime)
+	authnInstant := issueTime
+	if !opts.AuthnInstant.IsZero() {
+		authnInstant = opts.AuthnInstant.UTC().Format(time.RFC3339)
+	}
+	addAuthStatements(asEl, authnInstant, opts.SessionIndex)
+	if !opts.SessionNotOnOrAfter.IsZero() {
+		asEl.SelectElement("saml:AuthnStatement").CreateAttr("SessionNotOnOrAfter", opts.SessionNotOnOrAfter.UTC().Format(time.RFC3339))
+	}
 
 	attrStmts := asEl.CreateElement("saml:AttributeStatement")
 	attrStmts.CreateAttr("xmlns", "http://www.w3.org/2001/XMLSchema")
 	attrStmts.CreateAttr(xmlns_xsi, "http://www.w3.org/2001/XMLSchema-instance")
-	createAttribute(attrStmts, "name", "IDPUser1")
-	createAttribute(attrStmts, "email", "dev.null.dump.1@gmail.com")
-	createAttribute(attrStmts, "userid", "IDPUser1")
+	if opts.Attributes == nil {
+		createAttribute(attrStmts, "name", "IDPUser1")
+		createAttribute(attrStmts, "email", "dev.null.dump.1@gmail.com")
+		createAttribute(attrStmts, "userid", "IDPUser1")
+	} else {
+		names := make([]string, 0, len(opts.Attributes))
+		for name := range opts.Attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			createAttribute(attrStmts, name, opts.Attributes[name]...)
+		}
+	}
 
-	samlResp := createSAMLResponseElement(asEl, requestId)
+	samlResp := createSAMLResponseElement(asEl, issuer, requestId)
+	if recipient != "" {
+		samlResp.CreateAttr("Destination", recipient)
+	}
 
 	// Sign the element
 	signedElement, err := signingCtx.SignEnveloped(asEl)
@@ -106,6 +188,11 @@ func CreateSAMLResponse(issuer string, inRespTo string, recipient string, audien
 		return "", perrors.Wrap(err, "Signature generation failed")
 	}
 	samlResp.AddChild(signedElement)
+	if opts.SignResponse {
+		if samlResp, err = signEnvelopedAfter(signingCtx, samlResp, "Issuer"); err != nil {
+			return "", perrors.Wrap(err, "Signature generation failed")
+		}
+	}
 
 	// Serialize the Response with signed assertion
 	fdoc := etree.NewDocument()
@@ -118,33 +205,37 @@ func CreateSAMLResponse(issuer string, inRespTo string, recipient string, audien
 	return base64.StdEncoding.EncodeToString(bytes), nil
 }
 
-func createSAMLResponseElement(assertion *etree.Element, requestId string) *etree.Element {
+func createSAMLResponseElement(assertion *etree.Element, issuerValue string, requestId string) *etree.Element {
 	doc := etree.NewDocument()
 	resp := doc.CreateElement("samlp:Response")
 	resp.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
 	resp.CreateAttr("ID", fmt.Sprintf("_%d", mrand.Int()))
-	resp.CreateAttr("InResponseTo", requestId)
+	if requestId != "" {
+		resp.CreateAttr("InResponseTo", requestId)
+	}
 	resp.CreateAttr("Version", "2.0")
 	issuer := resp.CreateElement("saml:Issuer")
 	issuer.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
-	issuer.CreateText("http://idp.samltools.com")
+	issuer.CreateText(issuerValue)
 	status := resp.CreateElement("samlp:Status")
 	stcode := status.CreateElement("samlp:StatusCode")
 	stcode.CreateAttr("Value", "urn:oasis:names:tc:SAML:2.0:status:Success")
 	return resp
 
 }
-func addSubject(assertionEl *etree.Element, requestId string, notOnOrAfter string, recipient string) {
+func addSubject(assertionEl *etree.Element, opts ResponseOptions, requestId string, notOnOrAfter string, recipient string) {
 	subject := assertionEl.CreateElement("saml:Subject")
 	nameId := subject.CreateElement("saml:NameID")
-	nameId.CreateAttr("Format", "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified")
-	nameId.CreateText("IDPUser1")
+	nameId.CreateAttr("Format", opts.NameIDFormat)
+	nameId.CreateText(opts.NameID)
 	subjectConf := subject.CreateElement("saml:SubjectConfirmation")
 	subjectConf.CreateAttr("Method", "urn:oasis:names:tc:SAML:2.0:cm:bearer")
 	subjectConfData := subjectConf.CreateElement("saml:SubjectConfirmationData")
 	subjectConfData.CreateAttr("NotOnOrAfter", notOnOrAfter)
 	subjectConfData.CreateAttr("Recipient", recipient)
-	subjectConfData.CreateAttr("InResponseTo", requestId)
+	if requestId != "" {
+		subjectConfData.CreateAttr("InResponseTo", requestId)
+	}
 }
 
 func addConditions(assertionEl *etree.Element, notOnOrAfter string, audience string) {
@@ -156,22 +247,24 @@ func addConditions(assertionEl *etree.Element, notOnOrAfter string, audience str
 	aud.CreateText(audience)
 }
 
-func addAuthStatements(assertionEl *etree.Element, issueTime string) {
+func addAuthStatements(assertionEl *etree.Element, authnInstant string, sessionIndex string) {
 	authnStmt := assertionEl.CreateElement("saml:AuthnStatement")
-	authnStmt.CreateAttr("AuthnInstant", issueTime)
-	authnStmt.CreateAttr("SessionIndex", "_NOSESSION_")
+	authnStmt.CreateAttr("AuthnInstant", authnInstant)
+	authnStmt.CreateAttr("SessionIndex", sessionIndex)
 	authCtx := authnStmt.CreateElement("saml:AuthnContext")
 	authCtxRef := authCtx.CreateElement("saml:AuthnContextClassRef")
 	authCtxRef.CreateText("urn:oasis:names:tc:SAML:2.0:ac:classes:unspecified")
 }
 
-func createAttribute(parent *etree.Element, name string, val string) {
+func createAttribute(parent *etree.Element, name string, vals ...string) {
 	attr := parent.CreateElement("saml:Attribute")
 	attr.CreateAttr("Name", name)
 	attr.CreateAttr("NameFormat", "urn:oasis:names:tc:SAML:2.0:attrname-format:basic")
-	attrVal := attr.CreateElement("saml:AttributeValue")
-	attrVal.CreateAttr("xsi:type", "xs:string")
-	attrVal.CreateText(val)
+	for _, val := range vals {
+		attrVal := attr.CreateElement("saml:AttributeValue")
+		attrVal.CreateAttr("xsi:type", "xs:string")
+		attrVal.CreateText(val)
+	}
 }
 
 type IDPKeyStore struct {
@@ -202,6 +295,51 @@ func (is *IDPKeyStore) GetKeyPair() (privateKey *rsa.PrivateKey, cert []byte, er
 	return is.key, is.cert, nil
 }
 
+// LoadKeyStore reads a PEM encoded RSA private key, PKCS#8 or PKCS#1, and the PEM
+// encoded certificate to publish with it.
+func LoadKeyStore(keyFile string, certFile string) (dsig.X509KeyStore, error) {
+	pemBlock, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, perrors.Wrap(err, "Failed to read private key file")
+	}
+	block, _ := pem.Decode(pemBlock)
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse PEM block containing the private key")
+	}
+	var key *rsa.PrivateKey
+	if pvt, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := pvt.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key is a %T, only RSA keys are supported", pvt)
+		}
+		key = rsaKey
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return nil, perrors.Wrap(err, "failed to parse DER encoded private key")
+	}
+	cert, err := ReadCertificateFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	return &IDPKeyStore{key: key, cert: cert.Raw}, nil
+}
+
+// ReadCertificateFile reads a PEM encoded certificate.
+func ReadCertificateFile(certFile string) (*x509.Certificate, error) {
+	pemBlock, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, perrors.Wrap(err, "Failed to read certificate file")
+	}
+	block, _ := pem.Decode(pemBlock)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("unable to read the pem encoded block")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, perrors.Wrap(err, "x509 parse err")
+	}
+	return cert, nil
+}
+
 func CreateValidationContextFromCertFile(certFile string) (*dsig.ValidationContext, error) {
 	pemBlock, err := ioutil.ReadFile(certFile)
 	if err != nil {
@@ -220,11 +358,16 @@ func CreateValidationContextFromCertFile(certFile string) (*dsig.ValidationConte
 	}
 	fmt.Printf("Got a %T, with remaining data: %q\n", cert, rest)
 
+	return CreateValidationContext([]*x509.Certificate{cert}), nil
+}
+
+// CreateValidationContext builds a validation context trusting the given certificates.
+func CreateValidationContext(certs []*x509.Certificate) *dsig.ValidationContext {
 	certificateStore := dsig.MemoryX509CertificateStore{
-		Roots: []*x509.Certificate{cert},
+		Roots: certs,
 	}
 
 	validationContext := dsig.NewDefaultValidationContext(&certificateStore)
 	validationContext.IdAttribute = "ID"
-	return validationContext, nil
+	return validationContext
 }
@@ -22,14 +22,8 @@ import (
 )
 
 func TestXMLGen(t *testing.T) {
-	req := &AuthnRequest{
-		SamlpAttr:       "urn:oasis:names:tc:SAML:2.0:protocol",
-		ID:              "123",
-		IssueInstant:    time.Now().Format(time.RFC3339),
-		ProtocolBinding: "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect",
-		Version:         "2.0",
-		Issuer:          Issuer{Namespace: "urn:oasis:names:tc:SAML:2.0:assertion", Value: "http://msinghlocal.saml.com"},
-	}
+	req := NewAuthnRequest("http://msinghlocal.saml.com", "http://idp.samltools.com:5678/logon")
+	req.ProtocolBinding = HTTPPostBinding
 	output, err := xml.MarshalIndent(req, "  ", "    ")
 	if err != nil {
 		fmt.Printf("error: %v\n", err)
@@ -84,9 +78,9 @@ func TestCreateAssertion(t *testing.T) {
 	//add Issuer
 	asEl.CreateElement("saml:Issuer").CreateText("http://idp.samltools.com")
 
-	addSubject(asEl, requestId, notOnOrAfter, "urn:auth0:dev-ejtl988w:auth0-as-sp")
+	addSubject(asEl, ResponseOptions{NameID: "IDPUser1", NameIDFormat: NameIDFormatUnspecified}, requestId, notOnOrAfter, "urn:auth0:dev-ejtl988w:auth0-as-sp")
 	addConditions(asEl, notOnOrAfter, "https://dev-ejtl988w.auth0.com/login/callback?connection=auth0-as-sp")
-	addAuthStatements(asEl, issueTime)
+	addAuthStatements(asEl, issueTime, "_NOSESSION_")
 
 	attrStmts := asEl.CreateElement("saml:AttributeStatement")
 	attrStmts.CreateAttr("xmlns", "http://www.w3.org/2001/XMLSchema")
@@ -95,7 +89,7 @@ func TestCreateAssertion(t *testing.T) {
 	createAttribute(attrStmts, "email", "dev.null.dump.1@gmail.com")
 	createAttribute(attrStmts, "userid", "IDPUser1")
 
-	samlResp := createSAMLResponseElement(asEl, requestId)
+	samlResp := createSAMLResponseElement(asEl, "http://idp.samltools.com", requestId)
 
 	//randomKeyStore := dsig.RandomKeyStoreForTest()
 	randomKeyStore := NewIDPKeyStore("./config/idp-samltools-privatekey.key")
@@ -0,0 +1,147 @@
+package samlidp
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/monmohan/samltools"
+)
+
+// AttributeRule adds an attribute to the assertions of a Service Provider. Its values are
+// those of the user attribute From, the static Values or the rendering of Template, given
+// the first value of every user attribute by name (e.g. {{.givenName}} {{.sn}}). They are
+// then transformed, in this order, by Replace, Transforms and Scope.
+//
+//	attribute_rules:
+//	  - name: http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress
+//	    from: email
+//	    transforms: [lowercase]
+//	  - name: eduPersonScopedAffiliation
+//	    values: [member]
+//	    scope: samltools.com
+type AttributeRule struct {
+	// Name is the name of the attribute sent to the Service Provider.
+	Name     string   `yaml:"name"`
+	From     string   `yaml:"from"`
+	Values   []string `yaml:"values"`
+	Template string   `yaml:"template"`
+	// Replace replaces the matches of a regular expression, as regexp.ReplaceAllString does.
+	Replace *AttributeReplace `yaml:"replace"`
+	// Transforms are applied to the values in turn: lowercase, uppercase or trim.
+	Transforms []string `yaml:"transforms"`
+	// Scope, when set, is appended to the values as @Scope.
+	Scope string `yaml:"scope"`
+
+	pattern  *regexp.Regexp
+	template *template.Template
+}
+
+// AttributeReplace replaces the matches of Pattern with With, which can refer to the
+// submatches with $1.
+type AttributeReplace struct {
+	Pattern string `yaml:"pattern"`
+	With    string `yaml:"with"`
+}
+
+var attributeTransforms = map[string]func(string) string{
+	"lowercase": strings.ToLower,
+	"uppercase": strings.ToUpper,
+	"trim":      strings.TrimSpace,
+}
+
+// compile checks the rule and prepares its regular expression and template.
+func (r *AttributeRule) compile() error {
+	sources := 0
+	for _, set := range []bool{r.From != "", len(r.Values) > 0, r.Template != ""} {
+		if set {
+			sources++
+		}
+	}
+	if r.Name == "" || sources != 1 {
+		return fmt.Errorf("attribute rule %q needs a name and one of from, values and template", r.Name)
+	}
+	if r.Template != "" {
+		t, err := template.New(r.Name).Option("missingkey=zero").Parse(r.Template)
+		if err != nil {
+			return fmt.Errorf("attribute rule %s: %s", r.Name, err)
+		}
+		r.template = t
+	}
+	if r.Replace != nil {
+		pattern, err := regexp.Compile(r.Replace.Pattern)
+		if err != nil {
+			return fmt.Errorf("attribute rule %s: %s", r.Name, err)
+		}
+		r.pattern = pattern
+	}
+	for _, name := range r.Transforms {
+		if _, ok := attributeTransforms[name]; !ok {
+			return fmt.Errorf("attribute rule %s: unknown transform %s", r.Name, name)
+		}
+	}
+	return nil
+}
+
+// values returns the values of the attribute for the user attributes, none when the
+// user attribute it is taken from is missing.
+func (r *AttributeRule) values(attributes map[string][]string) ([]string, error) {
+	var values []string
+	switch {
+	case r.From != "":
+		values = attributes[r.From]
+	case r.template != nil:
+		data := map[string]string{}
+		for name, v := range attributes {
+			if len(v) > 0 {
+				data[name] = v[0]
+			}
+		}
+		var buf bytes.Buffer
+		if err := r.template.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("attribute rule %s: %s", r.Name, err)
+		}
+		values = []string{buf.String()}
+	default:
+		values = r.Values
+	}
+	transformed := make([]string, 0, len(values))
+	for _, v := range values {
+		if r.pattern != nil {
+			v = r.pattern.ReplaceAllString(v, r.Replace.With)
+		}
+		for _, name := range r.Transforms {
+			v = attributeTransforms[name](v)
+		}
+		if r.Scope != "" {
+			v += "@" + r.Scope
+		}
+		transformed = append(transformed, v)
+	}
+	return transformed, nil
+}
+
+// release returns the attributes sent to the Service Provider out of the attributes of the
+// user: those listed in Attributes, as they are, and those of the AttributeRules, or all
+// of them with ReleaseAll. None are sent otherwise.
+func (c *ServiceProviderConfig) release(attributes map[string][]string) (map[string][]string, error) {
+	released := map[string][]string{}
+	for name, values := range attributes {
+		if c.ReleaseAll || samltools.ContainsString(c.Attributes, name) {
+			released[name] = append([]string(nil), values...)
+		}
+	}
+	for i := range c.AttributeRules {
+		rule := &c.AttributeRules[i]
+		values, err := rule.values(attributes)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) > 0 {
+			released[rule.Name] = append(released[rule.Name], values...)
+		}
+	}
+	return released, nil
+}
@@ -0,0 +1,141 @@
+package samlidp
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/monmohan/samltools"
+)
+
+// LoginTokenParam is the form parameter an Authenticator answering with a form posts
+// the LoginToken of the request in, for the Login handler to resume the login.
+const LoginTokenParam = "login"
+
+// loginLifetime is how long users have to log in.
+const loginLifetime = 10 * time.Minute
+
+// pendingLogin is a login waiting for the Authenticator to tell who the user is.
+type pendingLogin struct {
+	sp           *samltools.SPSSODescriptor
+	audience     string
+	authnRequest *samltools.AuthnRequest
+	relayState   string
+	expires      time.Time
+}
+
+type loginTokenKey struct{}
+
+// LoginToken returns the token of the login the request is part of, to be posted back
+// to the Login handler in LoginTokenParam.
+func LoginToken(req *http.Request) string {
+	token, _ := req.Context().Value(loginTokenKey{}).(string)
+	return token
+}
+
+// Login resumes a login the Authenticator answered with a form, posted back with
+// LoginTokenParam. The Authenticator is asked again who the user is.
+func (idp *IdentityProvider) Login(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	token := req.PostFormValue(LoginTokenParam)
+	idp.mu.Lock()
+	login, ok := idp.pendingLogins[token]
+	idp.mu.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		badRequest(fmt.Errorf("the login has expired, please start again from the Service Provider"), w)
+		return
+	}
+	req = req.WithContext(context.WithValue(req.Context(), loginTokenKey{}, token))
+	idp.sendAssertion(w, req, login.sp, login.audience, login.authnRequest, login.relayState)
+}
+
+// awaitLogin keeps the login until the user logs in, for Login to resume it.
+func (idp *IdentityProvider) awaitLogin(token string, login *pendingLogin) {
+	now := time.Now()
+	login.expires = now.Add(loginLifetime)
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	for t, l := range idp.pendingLogins {
+		if now.After(l.expires) {
+			delete(idp.pendingLogins, t)
+		}
+	}
+	idp.pendingLogins[token] = login
+}
+
+func (idp *IdentityProvider) endLogin(token string) {
+	idp.mu.Lock()
+	delete(idp.pendingLogins, token)
+	idp.mu.Unlock()
+}
+
+// LoginFormTemplate renders the login form of LoginForm.
+var LoginFormTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Log in</title>
+</head>
+<body>
+  <form action="{{.Action}}" method="post">
+    <input type="hidden" name="{{.TokenParam}}" value="{{.Token}}">
+    {{if .Error}}<p>{{.Error}}</p>{{end}}
+    <div><label>Username <input type="text" name="username" value="{{.Username}}" autofocus></label></div>
+    <div><label>Password <input type="password" name="password"></label></div>
+    <div><button type="submit">Log in</button></div>
+  </form>
+</body>
+</html>
+`))
+
+// LoginForm is an Authenticator asking users for their username and password, checked
+// against Users.
+type LoginForm struct {
+	Users *UserStore
+	// Action is the location of the Login handler of the IdP, the form is posted to.
+	Action string
+	// Template renders the form, given Action, TokenParam, Token, Username and Error.
+	// LoginFormTemplate is used when it is nil.
+	Template *template.Template
+}
+
+// Authenticate returns the user logging in with the posted username and password, and
+// shows the login form otherwise.
+func (f *LoginForm) Authenticate(w http.ResponseWriter, req *http.Request) (*User, error) {
+	username := req.PostFormValue("username")
+	if req.Method != http.MethodPost || username == "" {
+		f.show(w, req, http.StatusOK, "", "")
+		return nil, nil
+	}
+	user, err := f.Users.Authenticate(username, req.PostFormValue("password"))
+	if err != nil {
+		f.show(w, req, http.StatusUnauthorized, username, err.Error())
+		return nil, nil
+	}
+	return user, nil
+}
+
+func (f *LoginForm) show(w http.ResponseWriter, req *http.Request, code int, username string, message string) {
+	t := f.Template
+	if t == nil {
+		t = LoginFormTemplate
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	err := t.Execute(w, map[string]string{
+		"Action":     f.Action,
+		"TokenParam": LoginTokenParam,
+		"Token":      LoginToken(req),
+		"Username":   username,
+		"Error":      message,
+	})
+	if err != nil {
+		fmt.Printf("Error executing template %s\n", err.Error())
+	}
+}
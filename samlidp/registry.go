@@ -0,0 +1,262 @@
+package samlidp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/monmohan/samltools"
+	dsig "github.com/russellhaering/goxmldsig"
+	"gopkg.in/yaml.v2"
+)
+
+// ServiceProviderConfig describes a Service Provider trusted by the IdP and how the IdP
+// logs users in to it. The Service Provider is described by its metadata when Metadata
+// is set, the endpoints and certificates of the configuration being added to it.
+type ServiceProviderConfig struct {
+	EntityID string `yaml:"entity_id"`
+	// Metadata is the file or http(s) URL of the metadata of the Service Provider, signed
+	// with the certificate in the MetadataCert file. It must be for a URL.
+	Metadata     string `yaml:"metadata"`
+	MetadataCert string `yaml:"metadata_cert"`
+	// ACSURLs are the locations of its Assertion Consumer Services, the first one being
+	// the default. Responses are sent to them with ResponseBinding, post or artifact.
+	ACSURLs         []string `yaml:"acs_urls"`
+	ResponseBinding string   `yaml:"response_binding"`
+	// SLOURL is the location of its SingleLogoutService, with SLOBinding (redirect by
+	// default, post or soap).
+	SLOURL     string `yaml:"slo_url"`
+	SLOBinding string `yaml:"slo_binding"`
+	// SigningCert and EncryptionCert are the files of its certificates. AuthnRequestsSigned
+	// rejects its unsigned AuthnRequests.
+	SigningCert         string `yaml:"signing_cert"`
+	EncryptionCert      string `yaml:"encryption_cert"`
+	AuthnRequestsSigned bool   `yaml:"authn_requests_signed"`
+
+	// NameIDFormat is the format of the NameIDs sent to it, the one of the user when empty.
+	NameIDFormat string `yaml:"nameid_format"`
+	// Attributes lists the attributes of the user released to it as they are, and
+	// AttributeRules the attributes made for it out of them. ReleaseAll releases every
+	// attribute of the user instead; none are released by default, which is the case of
+	// the Service Providers only known from metadata.
+	Attributes     []string        `yaml:"attributes"`
+	AttributeRules []AttributeRule `yaml:"attribute_rules"`
+	ReleaseAll     bool            `yaml:"release_all"`
+	// AssertionLifetime is how long its assertions can be used for, 2 hours by default.
+	AssertionLifetime time.Duration `yaml:"assertion_lifetime"`
+	// SignResponse signs its Responses as well as their assertion, with SignatureAlgorithm
+	// when it is set rather than the algorithm of the IdP.
+	SignResponse       bool   `yaml:"sign_response"`
+	SignatureAlgorithm string `yaml:"signature_algorithm"`
+
+	descriptor *samltools.SPSSODescriptor
+}
+
+// Descriptor returns the Service Provider as described in metadata.
+func (c *ServiceProviderConfig) Descriptor() *samltools.SPSSODescriptor {
+	return c.descriptor
+}
+
+// signingContext returns the context signing the Responses of the Service Provider.
+func (c *ServiceProviderConfig) signingContext(ctx *dsig.SigningContext) (*dsig.SigningContext, error) {
+	if c.SignatureAlgorithm == "" || ctx == nil {
+		return ctx, nil
+	}
+	spCtx := *ctx
+	if err := spCtx.SetSignatureMethod(c.SignatureAlgorithm); err != nil {
+		return nil, err
+	}
+	return &spCtx, nil
+}
+
+// describe builds the descriptor of the Service Provider from its metadata and configuration.
+func (c *ServiceProviderConfig) describe() error {
+	for i := range c.AttributeRules {
+		if err := c.AttributeRules[i].compile(); err != nil {
+			return err
+		}
+	}
+	sp := &samltools.SPSSODescriptor{}
+	if c.Metadata != "" {
+		m := samltools.NewMetadataRefresher(c.Metadata, "", samltools.HasEntityID(c.EntityID))
+		if c.MetadataCert != "" {
+			vc, err := samltools.CreateValidationContextFromCertFile(c.MetadataCert)
+			if err != nil {
+				return err
+			}
+			m.ValidationContext = vc
+		}
+		if err := m.Load(); err != nil {
+			return err
+		}
+		found, ok := m.Index().SP(c.EntityID)
+		if !ok {
+			return fmt.Errorf("%s not found in %s", c.EntityID, c.Metadata)
+		}
+		copied := *found
+		sp = &copied
+	} else {
+		sp.ProtocolSupportEnumeration = samltools.ProtocolNamespace
+	}
+	sp.AuthnRequestsSigned = sp.AuthnRequestsSigned || c.AuthnRequestsSigned
+	binding, err := samltools.BindingURI(c.ResponseBinding)
+	if err != nil {
+		return err
+	}
+	if binding == "" {
+		binding = samltools.HTTPPostBinding
+	}
+	acs := make([]samltools.IndexedEndpoint, 0, len(c.ACSURLs)+len(sp.AssertionConsumerServices))
+	for i, location := range c.ACSURLs {
+		ep := samltools.IndexedEndpoint{Binding: binding, Location: location, Index: i}
+		if i == 0 {
+			isDefault := true
+			ep.IsDefault = &isDefault
+		}
+		acs = append(acs, ep)
+	}
+	for _, ep := range sp.AssertionConsumerServices {
+		ep.Index += len(c.ACSURLs)
+		acs = append(acs, ep)
+	}
+	sp.AssertionConsumerServices = acs
+	if c.SLOURL != "" {
+		sloBinding, err := samltools.BindingURI(c.SLOBinding)
+		if err != nil {
+			return err
+		}
+		if sloBinding == "" {
+			sloBinding = samltools.HTTPRedirectBinding
+		}
+		sp.SingleLogoutServices = append([]samltools.Endpoint{{Binding: sloBinding, Location: c.SLOURL}}, sp.SingleLogoutServices...)
+	}
+	keyDescriptors := append([]samltools.KeyDescriptor(nil), sp.KeyDescriptors...)
+	for _, kd := range []struct{ use, certFile string }{{"signing", c.SigningCert}, {"encryption", c.EncryptionCert}} {
+		if kd.certFile == "" {
+			continue
+		}
+		cert, err := samltools.ReadCertificateFile(kd.certFile)
+		if err != nil {
+			return err
+		}
+		keyDescriptors = append(keyDescriptors, samltools.NewKeyDescriptor(kd.use, cert))
+	}
+	sp.KeyDescriptors = keyDescriptors
+	if len(sp.AssertionConsumerServices) == 0 {
+		return fmt.Errorf("%s has no AssertionConsumerService", c.EntityID)
+	}
+	if sp.AuthnRequestsSigned {
+		if certs, err := sp.SigningCertificates(); err != nil || len(certs) == 0 {
+			return fmt.Errorf("%s signs its AuthnRequests but has no signing certificate", c.EntityID)
+		}
+	}
+	c.descriptor = sp
+	return nil
+}
+
+// ServiceProviderSettings is implemented by the ServiceProviderStores configuring how
+// users are logged in to their Service Providers, such as Registry.
+type ServiceProviderSettings interface {
+	Config(entityID string) (*ServiceProviderConfig, bool)
+}
+
+// Registry is a ServiceProviderStore of configured Service Providers, keyed by entity ID.
+// Those it doesn't have are looked up in Fallback when it is set, e.g. in federation metadata.
+type Registry struct {
+	Fallback ServiceProviderStore
+
+	mu  sync.RWMutex
+	sps map[string]*ServiceProviderConfig
+}
+
+func NewRegistry() *Registry {
+	return &Registry{sps: map[string]*ServiceProviderConfig{}}
+}
+
+// registryVar matches the ${name} references of a registry file.
+var registryVar = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// LoadRegistry reads the Service Providers of the YAML or JSON file, listed under
+// service_providers. ${name} references in the file are replaced by the value of name
+// in vars, e.g. ${protocol} for URLs following the protocol the IdP is served with.
+//
+//	service_providers:
+//	  - entity_id: urn:msingh.samltools:sp
+//	    acs_urls: [${protocol}://sp.samltools.com:4567/assertion]
+//	    attributes: [email]
+func LoadRegistry(file string, vars map[string]string) (*Registry, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var undefined []string
+	data = registryVar.ReplaceAllFunc(data, func(ref []byte) []byte {
+		name := string(ref[2 : len(ref)-1])
+		value, ok := vars[name]
+		if !ok {
+			undefined = append(undefined, name)
+		}
+		return []byte(value)
+	})
+	if len(undefined) > 0 {
+		return nil, fmt.Errorf("invalid Service Provider registry %s: undefined ${%s}", file, undefined[0])
+	}
+	var content struct {
+		ServiceProviders []*ServiceProviderConfig `yaml:"service_providers"`
+	}
+	if err := yaml.UnmarshalStrict(data, &content); err != nil {
+		return nil, fmt.Errorf("invalid Service Provider registry %s: %s", file, err)
+	}
+	r := NewRegistry()
+	for _, c := range content.ServiceProviders {
+		if err := r.Add(c); err != nil {
+			return nil, fmt.Errorf("invalid Service Provider registry %s: %s", file, err)
+		}
+	}
+	return r, nil
+}
+
+// Add registers the Service Provider, replacing the one with the same entity ID.
+func (r *Registry) Add(c *ServiceProviderConfig) error {
+	if c.EntityID == "" {
+		return fmt.Errorf("Service Provider without entity_id")
+	}
+	if err := c.describe(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.sps[c.EntityID] = c
+	r.mu.Unlock()
+	return nil
+}
+
+// Config returns the configuration of a registered Service Provider.
+func (r *Registry) Config(entityID string) (*ServiceProviderConfig, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.sps[entityID]
+	return c, ok
+}
+
+// EntityIDs returns the entity IDs of the registered Service Providers.
+func (r *Registry) EntityIDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, 0, len(r.sps))
+	for id := range r.sps {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (r *Registry) ServiceProvider(entityID string) (*samltools.SPSSODescriptor, error) {
+	if c, ok := r.Config(entityID); ok {
+		return c.descriptor, nil
+	}
+	if r.Fallback != nil {
+		return r.Fallback.ServiceProvider(entityID)
+	}
+	return nil, fmt.Errorf("Service Provider %s not found in metadata", entityID)
+}
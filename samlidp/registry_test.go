@@ -0,0 +1,215 @@
+package samlidp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/monmohan/samltools"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+func TestLoadRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatalf("failed to create directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "sps.yaml")
+	ioutil.WriteFile(file, []byte(`service_providers:
+  - entity_id: "urn:sp1"
+    acs_urls: ["https://sp1.example.com/acs", "https://sp1.example.com/acs2"]
+    slo_url: "https://sp1.example.com/slo"
+    slo_binding: "soap"
+    assertion_lifetime: "5m"
+  - entity_id: "urn:sp2"
+    acs_urls: ["https://sp2.example.com/acs"]
+    response_binding: "artifact"
+`), 0600)
+	r, err := LoadRegistry(file, nil)
+	if err != nil {
+		t.Fatalf("failed to load registry %s", err)
+	}
+	sp1, err := r.ServiceProvider("urn:sp1")
+	if err != nil || len(sp1.AssertionConsumerServices) != 2 || sp1.AssertionConsumerServices[1].Location != "https://sp1.example.com/acs2" {
+		t.Fatalf("unexpected urn:sp1 %#v %v", sp1, err)
+	}
+	if ep, ok := sp1.SingleLogoutService(samltools.SOAPBinding); !ok || ep.Location != "https://sp1.example.com/slo" {
+		t.Fatalf("expected SOAP SingleLogoutService for urn:sp1")
+	}
+	if c, _ := r.Config("urn:sp1"); c.AssertionLifetime != 5*time.Minute {
+		t.Fatalf("unexpected assertion lifetime %s", c.AssertionLifetime)
+	}
+	if sp2, err := r.ServiceProvider("urn:sp2"); err != nil || sp2.AssertionConsumerServices[0].Binding != samltools.HTTPArtifactBinding {
+		t.Fatalf("unexpected urn:sp2 %#v %v", sp2, err)
+	}
+	if _, err := r.ServiceProvider("urn:sp3"); err == nil {
+		t.Fatalf("expected unknown Service Provider to be rejected")
+	}
+	r.Fallback = ServiceProviderFunc(func(entityID string) (*samltools.SPSSODescriptor, error) {
+		if entityID != "urn:sp3" {
+			return nil, fmt.Errorf("not found")
+		}
+		return &samltools.SPSSODescriptor{}, nil
+	})
+	if _, err := r.ServiceProvider("urn:sp3"); err != nil {
+		t.Fatalf("expected Service Provider to be found in the fallback %s", err)
+	}
+
+	ioutil.WriteFile(file, []byte("service_providers:\n  - entity_id: \"urn:sp1\"\n    authn_requests_signed: true\n    acs_urls: [\"https://sp1.example.com/acs\"]\n"), 0600)
+	if _, err := LoadRegistry(file, nil); err == nil {
+		t.Fatalf("expected Service Provider signing its requests without certificate to be rejected")
+	}
+
+	ioutil.WriteFile(file, []byte("service_providers:\n  - entity_id: \"urn:sp1\"\n    acs_urls: [\"${protocol}://sp1.example.com/acs\"]\n"), 0600)
+	if _, err := LoadRegistry(file, nil); err == nil {
+		t.Fatalf("expected undefined ${protocol} to be rejected")
+	}
+	r, err = LoadRegistry(file, map[string]string{"protocol": "https"})
+	if err != nil {
+		t.Fatalf("failed to load registry %s", err)
+	}
+	if sp1, err := r.ServiceProvider("urn:sp1"); err != nil || sp1.AssertionConsumerServices[0].Location != "https://sp1.example.com/acs" {
+		t.Fatalf("expected ${protocol} to be replaced, got %#v %v", sp1, err)
+	}
+}
+
+func TestRegistrySettings(t *testing.T) {
+	idp, vc := newIdentityProviderForTest()
+	r := NewRegistry()
+	err := r.Add(&ServiceProviderConfig{
+		EntityID:           testSP,
+		ACSURLs:            []string{testACSURL},
+		NameIDFormat:       samltools.NameIDFormatPersistent,
+		Attributes:         []string{"email"},
+		AssertionLifetime:  time.Minute,
+		SignResponse:       true,
+		SignatureAlgorithm: dsig.RSASHA512SignatureMethod,
+	})
+	if err != nil {
+		t.Fatalf("failed to add Service Provider %s", err)
+	}
+	idp.ServiceProviders = r
+	idp.AuthnRequestVerifier.LookupSP = r.ServiceProvider
+	idp.AttributeSource = AttributeSourceFunc(func(user *User, spEntityID string) (map[string][]string, error) {
+		return map[string][]string{"email": {"alice@example.com"}, "groups": {"admins"}}, nil
+	})
+	samlResponse := postedResponseForTest(t, ssoForTest(t, idp))
+	assertion, err := samltools.ParseValidatedAssertion(samlResponse, vc)
+	if err != nil {
+		t.Fatalf("failed to validate assertion %s", err)
+	}
+	if assertion.NameID().Format != samltools.NameIDFormatPersistent {
+		t.Fatalf("unexpected NameID format %s", assertion.NameID().Format)
+	}
+	if attributes := assertion.Attributes(); len(attributes) != 1 || attributes["email"] == nil {
+		t.Fatalf("expected only email to be released, got %v", attributes)
+	}
+	if lifetime := assertion.Conditions.NotOnOrAfter.Sub(time.Now()); lifetime > time.Minute {
+		t.Fatalf("unexpected assertion lifetime %s", lifetime)
+	}
+	data, _ := base64.StdEncoding.DecodeString(samlResponse)
+	doc := etree.NewDocument()
+	doc.ReadFromBytes(data)
+	sig := doc.Root().SelectElement("Signature")
+	if sig == nil {
+		t.Fatalf("expected the Response to be signed")
+	}
+	if method := sig.FindElement("./SignedInfo/SignatureMethod"); method == nil || method.SelectAttrValue("Algorithm", "") != dsig.RSASHA512SignatureMethod {
+		t.Fatalf("expected the Response to be signed with RSA-SHA512")
+	}
+	if _, err := vc.Validate(doc.Root()); err != nil {
+		t.Fatalf("failed to validate the Response signature %s", err)
+	}
+}
+
+func TestAttributeRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatalf("failed to create directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "sps.yaml")
+	ioutil.WriteFile(file, []byte(`service_providers:
+  - entity_id: "urn:sp1"
+    acs_urls: ["https://sp1.example.com/acs"]
+    attributes: ["uid"]
+    attribute_rules:
+      - name: "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress"
+        from: "email"
+        transforms: ["trim", "lowercase"]
+      - name: "displayName"
+        template: "{{.givenName}} {{.sn}}{{.missing}}"
+      - name: "department"
+        from: "ou"
+        replace: {pattern: "^dept-(.*)$", with: "$1"}
+        transforms: ["uppercase"]
+      - name: "eduPersonScopedAffiliation"
+        values: ["member", "staff"]
+        scope: "samltools.com"
+      - name: "nickname"
+        from: "missing"
+`), 0600)
+	r, err := LoadRegistry(file, nil)
+	if err != nil {
+		t.Fatalf("failed to load registry %s", err)
+	}
+	c, _ := r.Config("urn:sp1")
+	user := map[string][]string{
+		"uid":       {"alice"},
+		"email":     {" Alice@Example.COM "},
+		"givenName": {"Alice"},
+		"sn":        {"Liddell"},
+		"ou":        {"dept-sales", "dept-it"},
+		"secret":    {"s3cr3t"},
+	}
+	released, err := c.release(user)
+	if err != nil {
+		t.Fatalf("failed to release attributes %s", err)
+	}
+	expected := map[string][]string{
+		"uid": {"alice"},
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress": {"alice@example.com"},
+		"displayName":                {"Alice Liddell"},
+		"department":                 {"SALES", "IT"},
+		"eduPersonScopedAffiliation": {"member@samltools.com", "staff@samltools.com"},
+	}
+	if fmt.Sprint(released) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected attributes %v", released)
+	}
+
+	for _, rule := range []string{
+		`{name: "x"}`,
+		`{name: "x", from: "a", values: ["b"]}`,
+		`{name: "x", template: "{{.a"}`,
+		`{name: "x", from: "a", replace: {pattern: "("}}`,
+		`{name: "x", from: "a", transforms: ["reverse"]}`,
+	} {
+		ioutil.WriteFile(file, []byte("service_providers:\n  - entity_id: \"urn:sp1\"\n    acs_urls: [\"https://sp1.example.com/acs\"]\n    attribute_rules: ["+rule+"]\n"), 0600)
+		if _, err := LoadRegistry(file, nil); err == nil {
+			t.Fatalf("expected attribute rule %s to be rejected", rule)
+		}
+	}
+}
+
+func TestFallbackServiceProviderGetsNoAttributes(t *testing.T) {
+	idp, vc := newIdentityProviderForTest()
+	registry := NewRegistry()
+	registry.Fallback = idp.ServiceProviders
+	idp.ServiceProviders = registry
+	idp.AttributeSource = AttributeSourceFunc(func(user *User, spEntityID string) (map[string][]string, error) {
+		return map[string][]string{"email": {"alice@example.com"}, "groups": {"admins"}}, nil
+	})
+	assertion, err := samltools.ParseValidatedAssertion(postedResponseForTest(t, ssoForTest(t, idp)), vc)
+	if err != nil {
+		t.Fatalf("failed to validate assertion %s", err)
+	}
+	if attributes := assertion.Attributes(); len(attributes) != 0 {
+		t.Fatalf("expected no attributes for a Service Provider without release policy, got %v", attributes)
+	}
+}
@@ -0,0 +1,466 @@
+// Package samlidp is a SAML 2.0 Identity Provider for net/http servers. How users log
+// in, what is known about them and which Service Providers are trusted is left to an
+// Authenticator, an AttributeSource and a ServiceProviderStore, so that it can serve as
+// a fake IdP in integration tests as well as a real one.
+//
+//	idp := samlidp.NewIdentityProvider("urn:example:idp", "https://idp.example.com/sso", signingContext, sps)
+//	idp.Authenticator = samlidp.FixedUser(samlidp.User{Name: "alice"})
+//	http.HandleFunc("/sso", idp.SSO)
+//	http.HandleFunc("/slo", idp.SLO)
+package samlidp
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/monmohan/samltools"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// ArtifactResolutionIndex is the index of the ArtifactResolutionService in the artifacts
+// of the IdP.
+const ArtifactResolutionIndex = 0
+
+// User is a user logged in at the IdP.
+type User struct {
+	// Name identifies the user to Service Providers, as the NameID of its assertions.
+	Name string
+	// NameIDFormat is the format of Name, unspecified when empty.
+	NameIDFormat string
+}
+
+// NameID returns the NameID of the user.
+func (u *User) NameID() samltools.NameID {
+	format := u.NameIDFormat
+	if format == "" {
+		format = samltools.NameIDFormatUnspecified
+	}
+	return samltools.NameID{Format: format, Value: u.Name}
+}
+
+// Authenticator tells who is making a request.
+type Authenticator interface {
+	// Authenticate returns the user making the request. When it can't tell yet it
+	// answers the request itself, with a login form for instance, and returns nil.
+	// An error fails the login, which is reported to the Service Provider.
+	Authenticate(w http.ResponseWriter, req *http.Request) (*User, error)
+}
+
+// AuthenticatorFunc is an Authenticator calling the function.
+type AuthenticatorFunc func(w http.ResponseWriter, req *http.Request) (*User, error)
+
+func (f AuthenticatorFunc) Authenticate(w http.ResponseWriter, req *http.Request) (*User, error) {
+	return f(w, req)
+}
+
+// FixedUser is an Authenticator logging every request in as user, without asking anything.
+func FixedUser(user User) Authenticator {
+	return AuthenticatorFunc(func(w http.ResponseWriter, req *http.Request) (*User, error) {
+		u := user
+		return &u, nil
+	})
+}
+
+// AttributeSource looks up the attributes of users.
+type AttributeSource interface {
+	// Attributes returns the attributes of the user sent to the Service Provider, by name.
+	Attributes(user *User, spEntityID string) (map[string][]string, error)
+}
+
+// AttributeSourceFunc is an AttributeSource calling the function.
+type AttributeSourceFunc func(user *User, spEntityID string) (map[string][]string, error)
+
+func (f AttributeSourceFunc) Attributes(user *User, spEntityID string) (map[string][]string, error) {
+	return f(user, spEntityID)
+}
+
+// ServiceProviderStore looks up the Service Providers the IdP trusts.
+type ServiceProviderStore interface {
+	// ServiceProvider returns the metadata of the Service Provider, an error when it isn't trusted.
+	ServiceProvider(entityID string) (*samltools.SPSSODescriptor, error)
+}
+
+// ServiceProviderFunc is a ServiceProviderStore calling the function.
+type ServiceProviderFunc func(entityID string) (*samltools.SPSSODescriptor, error)
+
+func (f ServiceProviderFunc) ServiceProvider(entityID string) (*samltools.SPSSODescriptor, error) {
+	return f(entityID)
+}
+
+// IdentityProvider holds the configuration and state of an Identity Provider.
+type IdentityProvider struct {
+	EntityID string
+	// SigningContext signs the assertions and Single Logout messages of the IdP.
+	SigningContext *dsig.SigningContext
+
+	Authenticator Authenticator
+	// AttributeSource, when set, gives the attributes of the assertions. They have none otherwise.
+	AttributeSource  AttributeSource
+	ServiceProviders ServiceProviderStore
+	Sessions         *samltools.IDPSessionStore
+	// SLOURL is the location of SLO. LogoutRequests addressed elsewhere are rejected.
+	SLOURL string
+
+	// AuthnRequestVerifier checks the AuthnRequests received by SSO.
+	AuthnRequestVerifier *samltools.AuthnRequestVerifier
+	// SSOBindings are the bindings SSO accepts AuthnRequests with, both HTTP-Redirect
+	// and HTTP-POST when empty.
+	SSOBindings []string
+	// Artifacts is the ArtifactResolutionService, holding the Responses sent with the
+	// HTTP-Artifact binding until Service Providers resolve them.
+	Artifacts *samltools.ArtifactResolutionService
+	// ResponseTemplate renders the page posting Responses to Service Providers with the
+	// HTTP-POST binding, given Base64Assertion, RelayState, ACSUrl, the decoded Response,
+	// Debug and the Nonce of its scripts. ResponseFormTemplate is used when it is nil.
+	ResponseTemplate *template.Template
+	// DebugResponses shows the Responses sent with the HTTP-POST binding, to be submitted
+	// by hand, instead of posting them right away.
+	DebugResponses bool
+
+	logouts      *samltools.LogoutTracker
+	logoutReplay *samltools.ReplayCache
+	soapLogout   *samltools.SOAPLogoutClient
+
+	mu            sync.Mutex
+	pendingLogins map[string]*pendingLogin
+}
+
+// NewIdentityProvider returns an Identity Provider receiving AuthnRequests at ssoURL from
+// the Service Providers in sps. Users are logged in by its Authenticator, to be set.
+func NewIdentityProvider(entityID string, ssoURL string, signingContext *dsig.SigningContext, sps ServiceProviderStore) *IdentityProvider {
+	return &IdentityProvider{
+		EntityID:             entityID,
+		SigningContext:       signingContext,
+		ServiceProviders:     sps,
+		Sessions:             samltools.NewIDPSessionStore(),
+		AuthnRequestVerifier: samltools.NewAuthnRequestVerifier([]string{ssoURL}, sps.ServiceProvider),
+		Artifacts: &samltools.ArtifactResolutionService{
+			EntityID:       entityID,
+			Store:          samltools.NewArtifactStore(),
+			SigningContext: signingContext,
+			LookupSP:       sps.ServiceProvider,
+		},
+		logouts:       samltools.NewLogoutTracker(),
+		logoutReplay:  samltools.NewReplayCache(),
+		soapLogout:    samltools.NewSOAPLogoutClient(entityID, signingContext, nil),
+		pendingLogins: map[string]*pendingLogin{},
+	}
+}
+
+// SSO is the SingleSignOnService: it answers the AuthnRequests of Service Providers,
+// received with the HTTP-Redirect or HTTP-POST binding, logging the user in.
+func (idp *IdentityProvider) SSO(w http.ResponseWriter, req *http.Request) {
+	binding := samltools.HTTPRedirectBinding
+	if req.Method == http.MethodPost {
+		binding = samltools.HTTPPostBinding
+	}
+	if !idp.ssoBindingAllowed(binding) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var authnRequest *samltools.AuthnRequest
+	var sp *samltools.SPSSODescriptor
+	var err error
+	var relayState string
+	if binding == samltools.HTTPPostBinding {
+		req.ParseForm()
+		relayState = req.PostForm.Get(samltools.RelayStateParam)
+		authnRequest, sp, err = idp.AuthnRequestVerifier.VerifyPOST(req.PostForm.Get(samltools.SAMLRequestParam))
+	} else {
+		relayState = req.URL.Query().Get(samltools.RelayStateParam)
+		authnRequest, sp, err = idp.AuthnRequestVerifier.VerifyRedirect(req.URL.RawQuery)
+	}
+	if err != nil {
+		// Errors are only sent back to Service Providers we know
+		if sp == nil {
+			badRequest(err, w)
+			return
+		}
+		idp.sendErrorResponse(w, req, authnRequest, sp, err, relayState)
+		return
+	}
+	if _, err := sp.ResponseEndpoint(authnRequest); err != nil {
+		idp.sendErrorResponse(w, req, authnRequest, sp, err, relayState)
+		return
+	}
+	audience := authnRequest.IssuerValue()
+	fmt.Printf("Generating response for request ID = %s, audience=%s\n", authnRequest.ID, audience)
+	idp.sendAssertion(w, req, sp, audience, authnRequest, relayState)
+}
+
+// IdPInitiated logs the user in to the Service Provider given by the sp parameter with
+// an unsolicited Response, RelayState (or target) telling it where to go next.
+func (idp *IdentityProvider) IdPInitiated(w http.ResponseWriter, req *http.Request) {
+	spEntityID := req.FormValue("sp")
+	if spEntityID == "" {
+		badRequest(fmt.Errorf("missing sp parameter"), w)
+		return
+	}
+	sp, err := idp.ServiceProviders.ServiceProvider(spEntityID)
+	if err != nil {
+		badRequest(err, w)
+		return
+	}
+	relayState := req.FormValue(samltools.RelayStateParam)
+	if relayState == "" {
+		relayState = req.FormValue("target")
+	}
+	fmt.Printf("Generating unsolicited response for audience=%s\n", spEntityID)
+	idp.sendAssertion(w, req, sp, spEntityID, nil, relayState)
+}
+
+// sendAssertion logs the user in to the Service Provider, answering the AuthnRequest or,
+// when it is nil, with an unsolicited Response. Users logged in already, in their IdP
+// session, aren't asked again unless the AuthnRequest is ForceAuthn. When the
+// Authenticator answers the request itself the login waits for Login to resume it.
+func (idp *IdentityProvider) sendAssertion(w http.ResponseWriter, req *http.Request, sp *samltools.SPSSODescriptor, audience string, authnRequest *samltools.AuthnRequest, relayState string) {
+	token := LoginToken(req)
+	session, ok := idp.Sessions.Get(req)
+	var subject samltools.NameID
+	if ok {
+		subject, _ = idp.Sessions.Subject(session)
+	}
+	var user *User
+	var err error
+	if token == "" && subject.Value != "" && (authnRequest == nil || !authnRequest.ForceAuthn) {
+		user = &User{Name: subject.Value, NameIDFormat: subject.Format}
+		fmt.Printf("Single sign-on of %s to %s\n", user.Name, audience)
+	} else {
+		if authnRequest != nil && authnRequest.IsPassive {
+			idp.sendErrorResponse(w, req, authnRequest, sp, samltools.ResponderError(samltools.StatusNoPassive, "the user isn't logged in"), relayState)
+			return
+		}
+		if token == "" {
+			token = samltools.NewID()
+			req = req.WithContext(context.WithValue(req.Context(), loginTokenKey{}, token))
+			idp.awaitLogin(token, &pendingLogin{sp: sp, audience: audience, authnRequest: authnRequest, relayState: relayState})
+		}
+		user, err = idp.Authenticator.Authenticate(w, req)
+		if user == nil && err == nil {
+			// The Authenticator answered the request
+			return
+		}
+		idp.endLogin(token)
+		if err != nil {
+			idp.sendErrorResponse(w, req, authnRequest, sp, samltools.ResponderError(samltools.StatusAuthnFailed, "%s", err), relayState)
+			return
+		}
+		session = idp.Sessions.Login(w, req, user.NameID())
+	}
+	spConfig := idp.spConfig(audience)
+	userAttributes := map[string][]string{}
+	if idp.AttributeSource != nil {
+		if userAttributes, err = idp.AttributeSource.Attributes(user, audience); err != nil {
+			idp.sendErrorResponse(w, req, authnRequest, sp, err, relayState)
+			return
+		}
+	}
+	attributes, err := spConfig.release(userAttributes)
+	if err != nil {
+		idp.sendErrorResponse(w, req, authnRequest, sp, err, relayState)
+		return
+	}
+	signingContext, err := spConfig.signingContext(idp.SigningContext)
+	if err != nil {
+		badRequest(err, w)
+		return
+	}
+	responseBinding, acsUrl, err := acsEndpoint(sp, authnRequest)
+	if err != nil {
+		idp.sendErrorResponse(w, req, authnRequest, sp, err, relayState)
+		return
+	}
+	inResponseTo := ""
+	if authnRequest != nil {
+		inResponseTo = authnRequest.ID
+	}
+	nameID := user.NameID()
+	if spConfig.NameIDFormat != "" {
+		nameID.Format = spConfig.NameIDFormat
+	}
+	idp.Sessions.AddParticipant(session, samltools.SessionParticipant{SPEntityID: audience, NameID: nameID, SessionIndex: session.SessionIndex})
+	_, authnInstant := idp.Sessions.Subject(session)
+	opts := samltools.ResponseOptions{
+		NameID:              nameID.Value,
+		NameIDFormat:        nameID.Format,
+		SessionIndex:        session.SessionIndex,
+		SessionNotOnOrAfter: session.Expires,
+		AuthnInstant:        authnInstant,
+		Attributes:          attributes,
+		AssertionLifetime:   spConfig.AssertionLifetime,
+		SignResponse:        spConfig.SignResponse,
+	}
+	assertion, err := samltools.CreateSAMLResponseWithOptions(idp.EntityID, inResponseTo, acsUrl, audience, opts, signingContext)
+	if err != nil {
+		badRequest(err, w)
+		return
+	}
+	idp.sendResponse(w, req, audience, responseBinding, acsUrl, assertion, relayState)
+}
+
+// spConfig returns the configuration of the Service Provider, the defaults when the
+// ServiceProviderStore has none for it.
+func (idp *IdentityProvider) spConfig(entityID string) *ServiceProviderConfig {
+	if settings, ok := idp.ServiceProviders.(ServiceProviderSettings); ok {
+		if c, ok := settings.Config(entityID); ok {
+			return c
+		}
+	}
+	return &ServiceProviderConfig{EntityID: entityID}
+}
+
+// sendErrorResponse reports a rejected AuthnRequest to the Service Provider with a SAML Response carrying the error status.
+func (idp *IdentityProvider) sendErrorResponse(w http.ResponseWriter, req *http.Request, authnRequest *samltools.AuthnRequest, sp *samltools.SPSSODescriptor, err error, relayState string) {
+	fmt.Printf("Rejecting AuthnRequest: %v\n", err)
+	status, ok := err.(*samltools.StatusError)
+	if !ok {
+		status = &samltools.StatusError{Code: samltools.StatusResponder, Message: err.Error()}
+	}
+	inResponseTo := ""
+	audience := ""
+	if authnRequest != nil {
+		inResponseTo = authnRequest.ID
+		audience = authnRequest.IssuerValue()
+	}
+	responseBinding, acsUrl, err := acsEndpoint(sp, authnRequest)
+	if err != nil {
+		// The endpoint the request asks for can't be trusted, errors go to the default one
+		if responseBinding, acsUrl, err = acsEndpoint(sp, nil); err != nil {
+			badRequest(err, w)
+			return
+		}
+	}
+	resp, err := samltools.CreateErrorResponse(idp.EntityID, inResponseTo, acsUrl, status, idp.SigningContext)
+	if err != nil {
+		badRequest(err, w)
+		return
+	}
+	idp.sendResponse(w, req, audience, responseBinding, acsUrl, resp, relayState)
+}
+
+// sendResponse delivers the base64 encoded Response to the Assertion Consumer Service.
+// With the HTTP-Artifact binding the Response is kept for the Service Provider to
+// resolve and the browser is only redirected with an artifact referencing it.
+func (idp *IdentityProvider) sendResponse(w http.ResponseWriter, req *http.Request, spEntityID string, binding string, acsUrl string, samlResponse string, relayState string) {
+	if binding != samltools.HTTPArtifactBinding {
+		idp.postResponse(w, req, acsUrl, samlResponse, relayState)
+		return
+	}
+	message, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		badRequest(err, w)
+		return
+	}
+	artifact, err := samltools.NewArtifact(idp.EntityID, ArtifactResolutionIndex)
+	if err != nil {
+		badRequest(err, w)
+		return
+	}
+	idp.Artifacts.Store.Put(artifact.String(), spEntityID, message)
+	u, err := url.Parse(acsUrl)
+	if err != nil {
+		badRequest(err, w)
+		return
+	}
+	q := u.Query()
+	q.Set(samltools.SAMLArtParam, artifact.String())
+	if relayState != "" {
+		q.Set(samltools.RelayStateParam, relayState)
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, req, u.String(), http.StatusFound)
+}
+
+// ResponseFormTemplate renders the page posting Responses with the HTTP-POST binding. It
+// submits the form right away unless Debug is set, showing the Response then.
+var ResponseFormTemplate = template.Must(template.New("response").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Form Post</title>
+</head>
+<body>
+  <form action="{{.ACSUrl}}" method="post">
+    <input type="hidden" name="SAMLResponse" value="{{.Base64Assertion}}">
+    {{if .RelayState}}<input type="hidden" name="RelayState" value="{{.RelayState}}">{{end}}
+    {{if .Debug}}
+    <p>Response sent to {{.ACSUrl}}{{if .RelayState}} with RelayState {{.RelayState}}{{end}}</p>
+    <pre>{{.Response}}</pre>
+    <div><button type="submit">Submit</button></div>
+    {{else}}
+    <noscript>
+      <p>Your browser doesn't run scripts, please continue by hand.</p>
+      <div><button type="submit">Continue</button></div>
+    </noscript>
+    {{end}}
+  </form>
+  {{if not .Debug}}<script nonce="{{.Nonce}}">document.forms[0].submit()</script>{{end}}
+</body>
+</html>
+`))
+
+// postResponse renders the page posting the base64 encoded Response to the Assertion
+// Consumer Service, with the headers of samltools.SetPostFormHeaders.
+func (idp *IdentityProvider) postResponse(w http.ResponseWriter, req *http.Request, acsUrl string, samlResponse string, relayState string) {
+	decoded, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		badRequest(err, w)
+		return
+	}
+	t := idp.ResponseTemplate
+	if t == nil {
+		t = ResponseFormTemplate
+	}
+	nonce := samltools.SetPostFormHeaders(w)
+	var page bytes.Buffer
+	err = t.Execute(&page, map[string]interface{}{
+		"Base64Assertion": samlResponse,
+		"RelayState":      relayState,
+		"ACSUrl":          acsUrl,
+		"Response":        string(decoded),
+		"Debug":           idp.DebugResponses,
+		"Nonce":           nonce,
+	})
+	if err != nil {
+		fmt.Printf("Error executing template %s\n", err.Error())
+		http.Error(w, "Failed to render the Response", http.StatusInternalServerError)
+		return
+	}
+	w.Write(page.Bytes())
+}
+
+// ssoBindingAllowed reports whether AuthnRequests may be received with the binding.
+func (idp *IdentityProvider) ssoBindingAllowed(binding string) bool {
+	if len(idp.SSOBindings) == 0 {
+		return true
+	}
+	for _, b := range idp.SSOBindings {
+		if b == binding {
+			return true
+		}
+	}
+	return false
+}
+
+// acsEndpoint returns the binding and location of the Assertion Consumer Service the
+// Response to the AuthnRequest is sent to, as resolved from the metadata of the Service
+// Provider.
+func acsEndpoint(sp *samltools.SPSSODescriptor, authnRequest *samltools.AuthnRequest) (string, string, error) {
+	ep, err := sp.ResponseEndpoint(authnRequest)
+	if err != nil {
+		return "", "", err
+	}
+	return ep.Binding, ep.Location, nil
+}
+
+func badRequest(err error, w http.ResponseWriter) {
+	fmt.Printf("%v\n", err)
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(fmt.Sprintf("Invalid Authentication Request: %s", err)))
+}
@@ -0,0 +1,266 @@
+package samlidp
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/monmohan/samltools"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	testSSOURL = "http://idp.samltools.com:5678/logon"
+	testSP     = "urn:msingh.samltools:sp"
+	testACSURL = "http://sp.samltools.com:4567/assertion"
+)
+
+func newIdentityProviderForTest() (*IdentityProvider, *dsig.ValidationContext) {
+	keyStore := dsig.RandomKeyStoreForTest()
+	_, certDER, _ := keyStore.GetKeyPair()
+	cert, _ := x509.ParseCertificate(certDER)
+	ctx := dsig.NewDefaultSigningContext(keyStore)
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	sps := ServiceProviderFunc(func(entityID string) (*samltools.SPSSODescriptor, error) {
+		if entityID != testSP {
+			return nil, fmt.Errorf("Service Provider %s not found", entityID)
+		}
+		sp := &samltools.SPSSODescriptor{}
+		sp.AssertionConsumerServices = []samltools.IndexedEndpoint{{Binding: samltools.HTTPPostBinding, Location: testACSURL}}
+		return sp, nil
+	})
+	idp := NewIdentityProvider("http://idp.samltools.com", testSSOURL, ctx, sps)
+	idp.Authenticator = FixedUser(User{Name: "alice@example.com", NameIDFormat: samltools.NameIDFormatEmailAddress})
+	return idp, samltools.CreateValidationContext([]*x509.Certificate{cert})
+}
+
+// releaseAllForTest registers testSP with the IdP, releasing every attribute of the user to it.
+func releaseAllForTest(t *testing.T, idp *IdentityProvider) {
+	registry := NewRegistry()
+	if err := registry.Add(&ServiceProviderConfig{EntityID: testSP, ACSURLs: []string{testACSURL}, ReleaseAll: true}); err != nil {
+		t.Fatalf("failed to register %s %s", testSP, err)
+	}
+	idp.ServiceProviders = registry
+}
+
+// ssoForTest sends an AuthnRequest of testSP to the IdP with the HTTP-Redirect binding,
+// completed by options when given.
+func ssoForTest(t *testing.T, idp *IdentityProvider, options ...func(*samltools.AuthnRequest)) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	idp.SSO(rec, ssoRequestForTest(t, options...))
+	return rec
+}
+
+func ssoRequestForTest(t *testing.T, options ...func(*samltools.AuthnRequest)) *http.Request {
+	authnRequest := samltools.NewAuthnRequest(testSP, testSSOURL)
+	for _, option := range options {
+		option(authnRequest)
+	}
+	data, _ := authnRequest.Bytes()
+	location, err := samltools.RedirectURL(testSSOURL, samltools.SAMLRequestParam, data, "state1", nil)
+	if err != nil {
+		t.Fatalf("failed to encode AuthnRequest %s", err)
+	}
+	return httptest.NewRequest(http.MethodGet, location, nil)
+}
+
+// postedResponseForTest returns the SAMLResponse posted by the form in the body.
+func postedResponseForTest(t *testing.T, rec *httptest.ResponseRecorder) string {
+	m := regexp.MustCompile(`name="SAMLResponse" value="([^"]*)"`).FindStringSubmatch(rec.Body.String())
+	if m == nil {
+		t.Fatalf("no SAMLResponse in %d %s", rec.Code, rec.Body.String())
+	}
+	return html.UnescapeString(m[1])
+}
+
+func TestSSO(t *testing.T) {
+	idp, vc := newIdentityProviderForTest()
+	idp.AttributeSource = AttributeSourceFunc(func(user *User, spEntityID string) (map[string][]string, error) {
+		return map[string][]string{"groups": {"admins", "users"}}, nil
+	})
+	releaseAllForTest(t, idp)
+	rec := ssoForTest(t, idp)
+	assertion, err := samltools.ParseValidatedAssertion(postedResponseForTest(t, rec), vc)
+	if err != nil {
+		t.Fatalf("failed to validate assertion %s", err)
+	}
+	nameID := assertion.NameID()
+	if nameID == nil || nameID.Value != "alice@example.com" || nameID.Format != samltools.NameIDFormatEmailAddress {
+		t.Fatalf("unexpected NameID %#v", nameID)
+	}
+	if groups := assertion.Attributes()["groups"]; len(groups) != 2 || groups[1] != "users" {
+		t.Fatalf("unexpected attributes %v", assertion.Attributes())
+	}
+	req := httptest.NewRequest(http.MethodGet, "/logout", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	session, ok := idp.Sessions.Get(req)
+	if !ok || session.SessionIndex != assertion.SessionIndex() {
+		t.Fatalf("expected an IdP session for the assertion")
+	}
+	if _, ok := session.Participant(testSP); !ok {
+		t.Fatalf("expected %s to take part in the session", testSP)
+	}
+}
+
+func TestSSOAuthenticator(t *testing.T) {
+	idp, _ := newIdentityProviderForTest()
+	idp.Authenticator = AuthenticatorFunc(func(w http.ResponseWriter, req *http.Request) (*User, error) {
+		w.Write([]byte("login form"))
+		return nil, nil
+	})
+	rec := ssoForTest(t, idp)
+	if rec.Body.String() != "login form" || len(rec.Result().Cookies()) != 0 {
+		t.Fatalf("expected the Authenticator to answer, got %s", rec.Body.String())
+	}
+
+	idp.Authenticator = AuthenticatorFunc(func(w http.ResponseWriter, req *http.Request) (*User, error) {
+		return nil, fmt.Errorf("wrong password")
+	})
+	data, _ := base64.StdEncoding.DecodeString(postedResponseForTest(t, ssoForTest(t, idp)))
+	resp, err := samltools.ParseResponse(data)
+	if err != nil {
+		t.Fatalf("failed to parse Response %s", err)
+	}
+	if status := resp.Status.Err(); status == nil || status.SubCode != samltools.StatusAuthnFailed || len(resp.Assertions) != 0 {
+		t.Fatalf("expected AuthnFailed Response, got %#v", resp)
+	}
+}
+
+func TestSSOSession(t *testing.T) {
+	idp, vc := newIdentityProviderForTest()
+	logins := 0
+	idp.Authenticator = AuthenticatorFunc(func(w http.ResponseWriter, req *http.Request) (*User, error) {
+		logins++
+		return &User{Name: "alice@example.com"}, nil
+	})
+	forceAuthn := func(r *samltools.AuthnRequest) { r.ForceAuthn = true }
+	isPassive := func(r *samltools.AuthnRequest) { r.IsPassive = true }
+	sso := func(cookie *http.Cookie, options ...func(*samltools.AuthnRequest)) (*samltools.Response, *samltools.Assertion) {
+		req := ssoRequestForTest(t, options...)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		idp.SSO(rec, req)
+		samlResponse := postedResponseForTest(t, rec)
+		data, _ := base64.StdEncoding.DecodeString(samlResponse)
+		resp, err := samltools.ParseResponse(data)
+		if err != nil {
+			t.Fatalf("failed to parse Response %s", err)
+		}
+		if resp.Status.Err() != nil {
+			return resp, nil
+		}
+		assertion, err := samltools.ParseValidatedAssertion(samlResponse, vc)
+		if err != nil {
+			t.Fatalf("failed to validate assertion %s", err)
+		}
+		return resp, assertion
+	}
+
+	if resp, _ := sso(nil, isPassive); resp.Status.Err() == nil || resp.Status.Err().SubCode != samltools.StatusNoPassive {
+		t.Fatalf("expected NoPassive Response without a session, got %#v", resp.Status)
+	}
+	req := ssoRequestForTest(t)
+	rec := httptest.NewRecorder()
+	idp.SSO(rec, req)
+	cookie := rec.Result().Cookies()[0]
+	req = httptest.NewRequest(http.MethodGet, "/logout", nil)
+	req.AddCookie(cookie)
+	session, ok := idp.Sessions.Get(req)
+	if !ok || !session.Authenticated() || session.SessionIndex == "_NOSESSION_" {
+		t.Fatalf("expected a session to be started for the login")
+	}
+
+	_, assertion := sso(cookie)
+	if logins != 1 || assertion.SessionIndex() != session.SessionIndex || assertion.NameID().Value != "alice@example.com" {
+		t.Fatalf("expected single sign-on in the session, got %d logins", logins)
+	}
+	if _, assertion = sso(cookie, isPassive); assertion == nil || logins != 1 {
+		t.Fatalf("expected IsPassive to be answered from the session")
+	}
+	if _, assertion = sso(cookie, forceAuthn); logins != 2 || assertion.SessionIndex() != session.SessionIndex {
+		t.Fatalf("expected ForceAuthn to log the user in again, in the session")
+	}
+	if !assertion.AuthnStatements[0].AuthnInstant.Equal(session.AuthnInstant.Truncate(time.Second)) {
+		t.Fatalf("unexpected AuthnInstant %v", assertion.AuthnStatements[0].AuthnInstant)
+	}
+}
+
+func TestResponseForm(t *testing.T) {
+	idp, _ := newIdentityProviderForTest()
+	rec := ssoForTest(t, idp)
+	body := rec.Body.String()
+	postedResponseForTest(t, rec)
+	csp := rec.Header().Get("Content-Security-Policy")
+	nonce := regexp.MustCompile(`script-src 'nonce-([0-9a-f]+)'`).FindStringSubmatch(csp)
+	if nonce == nil || strings.Contains(csp, "form-action") || !strings.Contains(csp, "default-src 'none'") {
+		t.Fatalf("unexpected Content-Security-Policy %s", csp)
+	}
+	if !strings.Contains(body, `<script nonce="`+nonce[1]+`">document.forms[0].submit()</script>`) || !strings.Contains(body, "<noscript>") {
+		t.Fatalf("expected the form to be submitted by a script with the nonce, got %s", body)
+	}
+	if !strings.Contains(rec.Header().Get("Cache-Control"), "no-store") || !strings.Contains(body, `type="hidden" name="RelayState" value="state1"`) {
+		t.Fatalf("unexpected Response page %v %s", rec.Header(), body)
+	}
+
+	idp.DebugResponses = true
+	rec = ssoForTest(t, idp)
+	if strings.Contains(rec.Body.String(), "<script") || !strings.Contains(rec.Body.String(), "&lt;samlp:Response") {
+		t.Fatalf("expected the decoded Response to be shown, got %s", rec.Body.String())
+	}
+
+	idp.ResponseTemplate = template.Must(template.New("broken").Parse(`{{template "missing"}}`))
+	if rec = ssoForTest(t, idp); rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "SAMLResponse") {
+		t.Fatalf("expected template errors to fail the page, got %d", rec.Code)
+	}
+}
+
+func TestIdPInitiated(t *testing.T) {
+	idp, vc := newIdentityProviderForTest()
+	rec := httptest.NewRecorder()
+	idp.IdPInitiated(rec, httptest.NewRequest(http.MethodGet, "/initiate?sp=urn:other", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected unknown Service Provider to be rejected, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	idp.IdPInitiated(rec, httptest.NewRequest(http.MethodGet, "/initiate?sp="+testSP, nil))
+	samlResponse := postedResponseForTest(t, rec)
+	if _, err := samltools.ParseValidatedAssertion(samlResponse, vc); err != nil {
+		t.Fatalf("failed to validate assertion %s", err)
+	}
+	data, _ := base64.StdEncoding.DecodeString(samlResponse)
+	resp, _ := samltools.ParseResponse(data)
+	if !resp.Unsolicited() || resp.Issuer == nil || resp.Issuer.Value != idp.EntityID {
+		t.Fatalf("unexpected Response %#v", resp)
+	}
+}
+
+func TestSSOUnregisteredACS(t *testing.T) {
+	idp, _ := newIdentityProviderForTest()
+	rec := ssoForTest(t, idp, func(r *samltools.AuthnRequest) {
+		r.AssertionConsumerServiceURL = "https://attacker.example.com/acs"
+	})
+	if !strings.Contains(rec.Body.String(), `action="`+testACSURL+`"`) {
+		t.Fatalf("expected the error to be sent to the registered ACS, got %s", rec.Body.String())
+	}
+	data, _ := base64.StdEncoding.DecodeString(postedResponseForTest(t, rec))
+	resp, err := samltools.ParseResponse(data)
+	if err != nil {
+		t.Fatalf("failed to parse Response %s", err)
+	}
+	if status := resp.Status.Err(); status == nil || status.SubCode != samltools.StatusRequestDenied || len(resp.Assertions) != 0 {
+		t.Fatalf("expected RequestDenied Response, got %#v", resp)
+	}
+	if len(rec.Result().Cookies()) != 0 {
+		t.Fatalf("expected no session to be started")
+	}
+}
@@ -0,0 +1,234 @@
+package samlidp
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/monmohan/samltools"
+)
+
+// SLO is the SingleLogoutService, receiving the LogoutRequests of Service Providers ending their session here
+// and the LogoutResponses of those the logout is propagated to.
+func (idp *IdentityProvider) SLO(w http.ResponseWriter, req *http.Request) {
+	msg, err := samltools.ReadInboundMessage(req)
+	if err != nil {
+		badRequest(err, w)
+		return
+	}
+	if msg.IsRequest() {
+		idp.handleLogoutRequest(w, req, msg)
+		return
+	}
+	idp.handleLogoutResponse(w, req, msg)
+}
+
+// handleLogoutRequest ends the session a Service Provider logs out of and propagates the
+// logout to the other Service Providers of the session before answering it.
+func (idp *IdentityProvider) handleLogoutRequest(w http.ResponseWriter, req *http.Request, msg *samltools.InboundMessage) {
+	logoutRequest, err := samltools.ParseLogoutRequest(msg.Message)
+	if err != nil {
+		badRequest(err, w)
+		return
+	}
+	issuer := logoutRequest.IssuerValue()
+	if logoutRequest, err = idp.verifyLogoutRequest(issuer, msg); err != nil {
+		badRequest(err, w)
+		return
+	}
+	if !msg.Signed() && len(logoutRequest.SessionIndexes) == 0 {
+		// Anyone could log a user out knowing their NameID alone
+		badRequest(fmt.Errorf("unsigned LogoutRequest %s doesn't give the SessionIndex", logoutRequest.ID), w)
+		return
+	}
+	propagation := &samltools.LogoutPropagation{
+		Initiator:          issuer,
+		InitiatorRequestID: logoutRequest.ID,
+		InitiatorBinding:   msg.Binding,
+		RelayState:         msg.RelayState,
+	}
+	if status := idp.checkLogoutRequest(logoutRequest, msg.Signed()); status != nil {
+		idp.finishLogout(w, req, propagation, status)
+		return
+	}
+	session, ok := idp.Sessions.Find(issuer, logoutRequest)
+	if !ok {
+		// Nothing left to end, the session is gone already
+		fmt.Printf("No session of %s at %s\n", logoutRequest.NameID.Value, issuer)
+		idp.finishLogout(w, req, propagation, nil)
+		return
+	}
+	for _, p := range idp.Sessions.Delete(w, req, session) {
+		if p.SPEntityID != issuer {
+			propagation.Pending = append(propagation.Pending, p)
+		}
+	}
+	idp.continueLogout(w, req, propagation)
+}
+
+// handleLogoutResponse records the outcome of a propagated LogoutRequest and goes on with the logout.
+func (idp *IdentityProvider) handleLogoutResponse(w http.ResponseWriter, req *http.Request, msg *samltools.InboundMessage) {
+	logoutResponse, err := samltools.ParseLogoutResponse(msg.Message)
+	if err != nil {
+		badRequest(err, w)
+		return
+	}
+	propagation, ok := idp.logouts.Take(logoutResponse.InResponseTo)
+	if !ok {
+		badRequest(fmt.Errorf("unexpected LogoutResponse to %s", logoutResponse.InResponseTo), w)
+		return
+	}
+	if err := idp.checkLogoutResponse(propagation.Current, logoutResponse, msg); err != nil {
+		fmt.Printf("Logout failed at %s: %v\n", propagation.Current, err)
+		propagation.Fail(propagation.Current)
+	}
+	idp.continueLogout(w, req, propagation)
+}
+
+// checkLogoutResponse verifies a LogoutResponse comes from the Service Provider it was
+// expected from and reports its session was ended.
+func (idp *IdentityProvider) checkLogoutResponse(spEntityID string, logoutResponse *samltools.LogoutResponse, msg *samltools.InboundMessage) error {
+	if logoutResponse.IssuerValue() != spEntityID {
+		return fmt.Errorf("LogoutResponse issued by %s", logoutResponse.IssuerValue())
+	}
+	sp, err := idp.ServiceProviders.ServiceProvider(spEntityID)
+	if err != nil {
+		return err
+	}
+	data, err := verifyFromSP(sp, msg)
+	if err != nil {
+		return err
+	}
+	if logoutResponse, err = samltools.ParseLogoutResponse(data); err != nil {
+		return err
+	}
+	if status := logoutResponse.Status.Err(); status != nil {
+		return status
+	}
+	return nil
+}
+
+// Logout starts a logout at the IdP, ending its session at every Service Provider.
+func (idp *IdentityProvider) Logout(w http.ResponseWriter, req *http.Request) {
+	session, ok := idp.Sessions.Get(req)
+	if !ok {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	idp.continueLogout(w, req, &samltools.LogoutPropagation{Pending: idp.Sessions.Delete(w, req, session)})
+}
+
+// continueLogout ends the session at the next Service Providers of the propagation, over
+// the SOAP back-channel for those having a SOAP SingleLogoutService and otherwise sending
+// the browser with a LogoutRequest, finishing the logout when there is none left.
+func (idp *IdentityProvider) continueLogout(w http.ResponseWriter, req *http.Request, propagation *samltools.LogoutPropagation) {
+	for {
+		p, ok := propagation.Next()
+		if !ok {
+			idp.finishLogout(w, req, propagation, propagation.Status())
+			return
+		}
+		sent, err := idp.sendLogoutRequest(w, req, propagation, p)
+		if err != nil {
+			fmt.Printf("Logout failed at %s: %v\n", p.SPEntityID, err)
+			propagation.Fail(p.SPEntityID)
+			continue
+		}
+		if sent {
+			return
+		}
+	}
+}
+
+// sendLogoutRequest ends the session at a Service Provider. It reports whether the
+// LogoutRequest was sent through the browser, the response then being yet to come.
+func (idp *IdentityProvider) sendLogoutRequest(w http.ResponseWriter, req *http.Request, propagation *samltools.LogoutPropagation, p samltools.SessionParticipant) (bool, error) {
+	sp, err := idp.ServiceProviders.ServiceProvider(p.SPEntityID)
+	if err != nil {
+		return false, err
+	}
+	if ep, ok := sp.SingleLogoutService(samltools.SOAPBinding); ok {
+		certs, err := sp.SigningCertificates()
+		if err != nil {
+			return false, err
+		}
+		return false, idp.soapLogout.Logout(ep.Location, p, certs)
+	}
+	ep, ok := sp.SingleLogoutService(samltools.HTTPRedirectBinding, samltools.HTTPPostBinding)
+	if !ok {
+		return false, fmt.Errorf("no SingleLogoutService")
+	}
+	logoutRequest := samltools.NewLogoutRequest(idp.EntityID, ep.Location, p.NameID, p.SessionIndex)
+	data, err := logoutRequest.Bytes()
+	if err != nil {
+		return false, err
+	}
+	idp.logouts.Await(logoutRequest.ID, propagation)
+	if err := samltools.SendMessage(w, req, ep.Binding, ep.Location, samltools.SAMLRequestParam, data, "", idp.SigningContext); err != nil {
+		idp.logouts.Take(logoutRequest.ID)
+		return false, err
+	}
+	return true, nil
+}
+
+// finishLogout answers the Service Provider that started the logout with the status,
+// or reports it in the browser when the logout started at the IdP.
+func (idp *IdentityProvider) finishLogout(w http.ResponseWriter, req *http.Request, propagation *samltools.LogoutPropagation, status *samltools.StatusError) {
+	if propagation.Initiator == "" {
+		if status != nil {
+			w.Write([]byte(fmt.Sprintf("Partially logged out: %s", status.Message)))
+			return
+		}
+		w.Write([]byte("Logged out"))
+		return
+	}
+	sp, err := idp.ServiceProviders.ServiceProvider(propagation.Initiator)
+	if err != nil {
+		badRequest(err, w)
+		return
+	}
+	ep, ok := sp.SingleLogoutService(propagation.InitiatorBinding, samltools.HTTPRedirectBinding, samltools.HTTPPostBinding)
+	if !ok {
+		badRequest(fmt.Errorf("%s has no SingleLogoutService", propagation.Initiator), w)
+		return
+	}
+	logoutResponse := samltools.NewLogoutResponse(idp.EntityID, ep.ResponseURL(), propagation.InitiatorRequestID, status)
+	data, err := logoutResponse.Bytes()
+	if err != nil {
+		badRequest(err, w)
+		return
+	}
+	if err := samltools.SendMessage(w, req, ep.Binding, ep.ResponseURL(), samltools.SAMLResponseParam, data, propagation.RelayState, idp.SigningContext); err != nil {
+		badRequest(err, w)
+	}
+}
+
+// verifyLogoutRequest checks the LogoutRequest comes from the Service Provider it claims
+// to and returns it as signed.
+func (idp *IdentityProvider) verifyLogoutRequest(issuer string, msg *samltools.InboundMessage) (*samltools.LogoutRequest, error) {
+	sp, err := idp.ServiceProviders.ServiceProvider(issuer)
+	if err != nil {
+		return nil, err
+	}
+	data, err := verifyFromSP(sp, msg)
+	if err != nil {
+		return nil, err
+	}
+	return samltools.ParseLogoutRequest(data)
+}
+
+// checkLogoutRequest checks a LogoutRequest is addressed to the IdP, fresh and not
+// replayed, like AuthnRequests are.
+func (idp *IdentityProvider) checkLogoutRequest(logoutRequest *samltools.LogoutRequest, signed bool) *samltools.StatusError {
+	return samltools.CheckLogoutRequest(logoutRequest, idp.SLOURL, signed, idp.logoutReplay, time.Now())
+}
+
+// verifyFromSP checks the signature of a message from a Service Provider. Messages must
+// be signed by Service Providers with a signing certificate, others can't sign them.
+func verifyFromSP(sp *samltools.SPSSODescriptor, msg *samltools.InboundMessage) ([]byte, error) {
+	certs, err := sp.SigningCertificates()
+	if err != nil {
+		return nil, err
+	}
+	return msg.Verify(certs, len(certs) > 0)
+}
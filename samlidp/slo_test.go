@@ -0,0 +1,80 @@
+package samlidp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/monmohan/samltools"
+)
+
+const testSPSLOURL = "http://sp.samltools.com:4567/slo"
+
+func TestSLOLogoutRequest(t *testing.T) {
+	idp, vc := newIdentityProviderForTest()
+	idp.SLOURL = "http://idp.samltools.com:5678/slo"
+	sps := idp.ServiceProviders
+	idp.ServiceProviders = ServiceProviderFunc(func(entityID string) (*samltools.SPSSODescriptor, error) {
+		sp, err := sps.ServiceProvider(entityID)
+		if err == nil {
+			sp.SingleLogoutServices = []samltools.Endpoint{{Binding: samltools.HTTPRedirectBinding, Location: testSPSLOURL}}
+		}
+		return sp, err
+	})
+	assertion, err := samltools.ParseValidatedAssertion(postedResponseForTest(t, ssoForTest(t, idp)), vc)
+	if err != nil {
+		t.Fatalf("failed to validate assertion %s", err)
+	}
+	nameID := *assertion.NameID()
+	loggedIn := func() bool {
+		_, ok := idp.Sessions.Find(testSP, samltools.NewLogoutRequest(testSP, idp.SLOURL, nameID))
+		return ok
+	}
+	slo := func(logoutRequest *samltools.LogoutRequest) *httptest.ResponseRecorder {
+		data, _ := logoutRequest.Bytes()
+		location, err := samltools.RedirectURL(idp.SLOURL, samltools.SAMLRequestParam, data, "", nil)
+		if err != nil {
+			t.Fatalf("failed to encode LogoutRequest %s", err)
+		}
+		rec := httptest.NewRecorder()
+		idp.SLO(rec, httptest.NewRequest(http.MethodGet, location, nil))
+		return rec
+	}
+	status := func(rec *httptest.ResponseRecorder) *samltools.StatusError {
+		location, err := url.Parse(rec.Header().Get("Location"))
+		if err != nil || rec.Code != http.StatusFound {
+			t.Fatalf("expected LogoutResponse, got %d %s", rec.Code, rec.Body.String())
+		}
+		data, _ := samltools.DecodeAndInflate(location.Query().Get(samltools.SAMLResponseParam))
+		logoutResponse, err := samltools.ParseLogoutResponse(data)
+		if err != nil {
+			t.Fatalf("failed to parse LogoutResponse %s", err)
+		}
+		return logoutResponse.Status.Err()
+	}
+
+	if rec := slo(samltools.NewLogoutRequest(testSP, idp.SLOURL, nameID)); rec.Code != http.StatusBadRequest || !loggedIn() {
+		t.Fatalf("expected unsigned LogoutRequest without SessionIndex to be rejected, got %d", rec.Code)
+	}
+	if slo(samltools.NewLogoutRequest(testSP, idp.SLOURL, nameID, "_guessed")); !loggedIn() {
+		t.Fatalf("expected LogoutRequest for another SessionIndex to leave the session")
+	}
+	if s := status(slo(samltools.NewLogoutRequest(testSP, "http://other.samltools.com/slo", nameID, assertion.SessionIndex()))); s == nil || !loggedIn() {
+		t.Fatalf("expected LogoutRequest sent elsewhere to be denied")
+	}
+	stale := samltools.NewLogoutRequest(testSP, idp.SLOURL, nameID, assertion.SessionIndex())
+	stale.IssueInstant = time.Now().Add(-time.Hour)
+	if s := status(slo(stale)); s == nil || !loggedIn() {
+		t.Fatalf("expected stale LogoutRequest to be denied")
+	}
+
+	logoutRequest := samltools.NewLogoutRequest(testSP, idp.SLOURL, nameID, assertion.SessionIndex())
+	if s := status(slo(logoutRequest)); s != nil || loggedIn() {
+		t.Fatalf("expected LogoutRequest with the SessionIndex to end the session, got %v", s)
+	}
+	if s := status(slo(logoutRequest)); s == nil || s.SubCode != samltools.StatusRequestDenied {
+		t.Fatalf("expected replayed LogoutRequest to be denied, got %v", s)
+	}
+}
@@ -0,0 +1,100 @@
+package samlidp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// UserRecord is a user of a UserStore, as read from its file.
+type UserRecord struct {
+	Username string `json:"username" yaml:"username"`
+	// PasswordHash is the bcrypt hash of the password of the user.
+	PasswordHash string `json:"password_hash" yaml:"password_hash"`
+	// NameIDFormat is the format of the username, unspecified when empty.
+	NameIDFormat string              `json:"nameid_format" yaml:"nameid_format"`
+	Attributes   map[string][]string `json:"attributes" yaml:"attributes"`
+}
+
+// UserStore holds users with bcrypt hashed passwords and their attributes, as read from
+// a YAML or JSON file listing them under users:
+//
+//	users:
+//	  - username: IDPUser1
+//	    password_hash: $2a$10$...
+//	    attributes:
+//	      email: [user1@samltools.com]
+//
+// It is the AttributeSource of the users it authenticates.
+type UserStore struct {
+	users map[string]*UserRecord
+}
+
+// NewUserStore returns a store of the users.
+func NewUserStore(users []UserRecord) *UserStore {
+	s := &UserStore{users: map[string]*UserRecord{}}
+	for i := range users {
+		s.users[users[i].Username] = &users[i]
+	}
+	return s
+}
+
+// LoadUserStore reads the users of the YAML or JSON file, JSON when its name ends with .json.
+func LoadUserStore(file string) (*UserStore, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var content struct {
+		Users []UserRecord `json:"users" yaml:"users"`
+	}
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		err = json.Unmarshal(data, &content)
+	} else {
+		err = yaml.UnmarshalStrict(data, &content)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid user store %s: %s", file, err)
+	}
+	for _, u := range content.Users {
+		if u.Username == "" || u.PasswordHash == "" {
+			return nil, fmt.Errorf("invalid user store %s: users need a username and a password_hash", file)
+		}
+	}
+	return NewUserStore(content.Users), nil
+}
+
+// dummyHash is compared to the passwords of unknown users, for them to take as long to
+// be rejected as known users with a wrong password.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("samltools"), bcrypt.DefaultCost)
+
+// Authenticate returns the user with the username and password, an error when there is none.
+func (s *UserStore) Authenticate(username string, password string) (*User, error) {
+	u, ok := s.users[username]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, fmt.Errorf("invalid username or password")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)); err != nil {
+		return nil, fmt.Errorf("invalid username or password")
+	}
+	return &User{Name: u.Username, NameIDFormat: u.NameIDFormat}, nil
+}
+
+// Attributes returns the attributes of the user.
+func (s *UserStore) Attributes(user *User, spEntityID string) (map[string][]string, error) {
+	u, ok := s.users[user.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown user %s", user.Name)
+	}
+	attributes := map[string][]string{}
+	for name, values := range u.Attributes {
+		attributes[name] = append([]string(nil), values...)
+	}
+	return attributes, nil
+}
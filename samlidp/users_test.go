@@ -0,0 +1,113 @@
+package samlidp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/monmohan/samltools"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func userStoreForTest(t *testing.T) *UserStore {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	return NewUserStore([]UserRecord{{
+		Username:     "alice",
+		PasswordHash: string(hash),
+		Attributes:   map[string][]string{"email": {"alice@example.com"}},
+	}})
+}
+
+func TestLoadUserStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatalf("failed to create directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	files := map[string]string{
+		"users.yaml": "users:\n  - username: alice\n    password_hash: \"" + string(hash) + "\"\n    attributes:\n      displayName: [Alice]\n",
+		"users.json": `{"users": [{"username": "alice", "password_hash": "` + string(hash) + `", "attributes": {"displayName": ["Alice"]}}]}`,
+	}
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		ioutil.WriteFile(file, []byte(content), 0600)
+		users, err := LoadUserStore(file)
+		if err != nil {
+			t.Fatalf("%s: failed to load users %s", name, err)
+		}
+		if _, err := users.Authenticate("alice", "wrong"); err == nil {
+			t.Fatalf("%s: expected wrong password to be rejected", name)
+		}
+		if _, err := users.Authenticate("bob", "secret"); err == nil {
+			t.Fatalf("%s: expected unknown user to be rejected", name)
+		}
+		user, err := users.Authenticate("alice", "secret")
+		if err != nil || user.Name != "alice" {
+			t.Fatalf("%s: expected alice to log in, got %v", name, err)
+		}
+		attributes, _ := users.Attributes(user, testSP)
+		if v := attributes["displayName"]; len(v) != 1 || v[0] != "Alice" {
+			t.Fatalf("%s: unexpected attributes %v", name, attributes)
+		}
+	}
+	file := filepath.Join(dir, "invalid.yaml")
+	ioutil.WriteFile(file, []byte("users:\n  - username: alice\n"), 0600)
+	if _, err := LoadUserStore(file); err == nil {
+		t.Fatalf("expected user without password to be rejected")
+	}
+}
+
+// postLoginForTest posts the login form in the body to the Login handler of the IdP.
+func postLoginForTest(t *testing.T, idp *IdentityProvider, rec *httptest.ResponseRecorder, username string, password string) *httptest.ResponseRecorder {
+	m := regexp.MustCompile(`name="` + LoginTokenParam + `" value="([^"]*)"`).FindStringSubmatch(rec.Body.String())
+	if m == nil {
+		t.Fatalf("no login form in %s", rec.Body.String())
+	}
+	form := url.Values{LoginTokenParam: {m[1]}, "username": {username}, "password": {password}}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	idp.Login(rec, req)
+	return rec
+}
+
+func TestLoginForm(t *testing.T) {
+	idp, vc := newIdentityProviderForTest()
+	users := userStoreForTest(t)
+	idp.Authenticator = &LoginForm{Users: users, Action: "/login"}
+	idp.AttributeSource = users
+	releaseAllForTest(t, idp)
+
+	rec := ssoForTest(t, idp)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `action="/login"`) {
+		t.Fatalf("expected the login form, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = postLoginForTest(t, idp, rec, "alice", "wrong")
+	if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), "invalid username or password") {
+		t.Fatalf("expected the login form again, got %d %s", rec.Code, rec.Body.String())
+	}
+	loginPage := rec
+	rec = postLoginForTest(t, idp, loginPage, "alice", "secret")
+	samlResponse := postedResponseForTest(t, rec)
+	assertion, err := samltools.ParseValidatedAssertion(samlResponse, vc)
+	if err != nil {
+		t.Fatalf("failed to validate assertion %s", err)
+	}
+	if assertion.NameID().Value != "alice" || assertion.Attributes()["email"][0] != "alice@example.com" {
+		t.Fatalf("unexpected assertion %#v", assertion)
+	}
+	if m := regexp.MustCompile(`name="RelayState" value="([^"]*)"`).FindStringSubmatch(rec.Body.String()); m == nil || m[1] != "state1" {
+		t.Fatalf("expected RelayState to be kept across the login")
+	}
+
+	if rec = postLoginForTest(t, idp, loginPage, "alice", "secret"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a finished login not to be resumed again, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,176 @@
+package samlsp
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/monmohan/samltools"
+)
+
+// Requirement is a condition logged in users must meet to access the routes Authorize
+// protects.
+type Requirement interface {
+	// Check returns why the user of the session doesn't meet the requirement, nil when they do.
+	Check(session *samltools.SPSession, profile *Profile) error
+}
+
+// StepUpRequirement is a Requirement users can meet by logging in again, with the
+// AuthnRequest completed by StepUp.
+type StepUpRequirement interface {
+	Requirement
+	StepUp(authnRequest *samltools.AuthnRequest)
+}
+
+// RequirementFunc is a Requirement calling the function.
+type RequirementFunc func(session *samltools.SPSession, profile *Profile) error
+
+func (f RequirementFunc) Check(session *samltools.SPSession, profile *Profile) error {
+	return f(session, profile)
+}
+
+// InGroup requires users to be in one of the groups of their profile.
+func InGroup(groups ...string) Requirement {
+	return RequirementFunc(func(session *samltools.SPSession, profile *Profile) error {
+		for _, g := range profile.Groups {
+			for _, required := range groups {
+				if g == required {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("you need to be in group %s", strings.Join(groups, " or "))
+	})
+}
+
+// EmailDomain requires the email of users to be of one of the domains.
+func EmailDomain(domains ...string) Requirement {
+	return RequirementFunc(func(session *samltools.SPSession, profile *Profile) error {
+		if at := strings.LastIndex(profile.Email, "@"); at >= 0 {
+			for _, d := range domains {
+				if strings.EqualFold(profile.Email[at+1:], d) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("you need an email address of %s", strings.Join(domains, " or "))
+	})
+}
+
+// AuthnContext requires users to have logged in with one of the authentication context
+// classes. Those who haven't are asked to log in again with it.
+func AuthnContext(classRefs ...string) StepUpRequirement {
+	return authnContextRequirement(classRefs)
+}
+
+type authnContextRequirement []string
+
+func (r authnContextRequirement) Check(session *samltools.SPSession, profile *Profile) error {
+	for _, classRef := range r {
+		if session.AuthnContextClassRef == classRef {
+			return nil
+		}
+	}
+	return fmt.Errorf("you need to log in with %s", strings.Join(r, " or "))
+}
+
+func (r authnContextRequirement) StepUp(authnRequest *samltools.AuthnRequest) {
+	authnRequest.ForceAuthn = true
+	authnRequest.RequestedAuthnContext = &samltools.RequestedAuthnContext{
+		Comparison:            "exact",
+		AuthnContextClassRefs: r,
+	}
+}
+
+// Expression requires the template to render "true", given the Session, the Profile and
+// the Attributes of the user. Besides the template functions, has tells whether a list
+// has a value and hasSuffix, hasPrefix and lower are those of strings.
+//
+//	{{and (has .Profile.Groups "admins") (hasSuffix .Profile.Email "@samltools.com")}}
+func Expression(expression string) (Requirement, error) {
+	t, err := template.New("requirement").Option("missingkey=zero").Funcs(template.FuncMap{
+		"has": func(values []string, v string) bool {
+			for _, value := range values {
+				if value == v {
+					return true
+				}
+			}
+			return false
+		},
+		"hasSuffix": strings.HasSuffix,
+		"hasPrefix": strings.HasPrefix,
+		"lower":     strings.ToLower,
+	}).Parse(expression)
+	if err != nil {
+		return nil, err
+	}
+	return RequirementFunc(func(session *samltools.SPSession, profile *Profile) error {
+		var buf bytes.Buffer
+		err := t.Execute(&buf, map[string]interface{}{
+			"Session":    session,
+			"Profile":    profile,
+			"Attributes": session.Attributes,
+		})
+		if err != nil || strings.TrimSpace(buf.String()) != "true" {
+			return fmt.Errorf("you don't meet %s", expression)
+		}
+		return nil
+	}), nil
+}
+
+// Authorize lets logged in users meeting all the requirements through to next. The others
+// are denied with 403 Forbidden and the reason, unless they can meet a StepUpRequirement
+// by logging in again. They are only asked to once, the IdP possibly not being able to.
+func (sp *ServiceProvider) Authorize(next http.Handler, requirements ...Requirement) http.Handler {
+	return sp.RequireAccount(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		session, _ := SessionFromContext(req.Context())
+		profile, _ := ProfileFromContext(req.Context())
+		for _, r := range requirements {
+			err := r.Check(session, profile)
+			if err == nil {
+				continue
+			}
+			if stepUp, ok := r.(StepUpRequirement); ok && req.Method == http.MethodGet && !sp.steppedUp(session) {
+				if id := sp.startLogin(w, req, req.URL.RequestURI(), stepUp.StepUp); id != "" {
+					sp.awaitStepUp(id)
+				}
+				return
+			}
+			http.Error(w, "Access denied: "+err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	}))
+}
+
+// awaitStepUp keeps the ID of the AuthnRequest sent for a StepUpRequirement, for steppedUp
+// to recognize the session it starts.
+func (sp *ServiceProvider) awaitStepUp(id string) {
+	now := time.Now()
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.pruneStepUps(now)
+	sp.stepUps[id] = now.Add(sp.Sessions.Lifetime)
+}
+
+// steppedUp reports whether the session was started by the user logging in again for a
+// StepUpRequirement.
+func (sp *ServiceProvider) steppedUp(session *samltools.SPSession) bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.pruneStepUps(time.Now())
+	_, ok := sp.stepUps[session.InResponseTo]
+	return ok && session.InResponseTo != ""
+}
+
+// pruneStepUps deletes the expired step-ups, sp.mu being held.
+func (sp *ServiceProvider) pruneStepUps(now time.Time) {
+	for id, expires := range sp.stepUps {
+		if now.After(expires) {
+			delete(sp.stepUps, id)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package samlsp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/monmohan/samltools"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// loginForTest logs the user in to the Service Provider with the attributes, and returns
+// the cookies of the browser.
+func loginForTest(t *testing.T, sp *ServiceProvider, idpCtx *dsig.SigningContext, attributes map[string][]string) []*http.Cookie {
+	rec := httptest.NewRecorder()
+	sp.Login(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	location, _ := url.Parse(rec.Header().Get("Location"))
+	requestCookie := rec.Result().Cookies()[0]
+	authnRequest := authnRequestForTest(t, location)
+	opts := samltools.ResponseOptions{NameID: "user1", Attributes: attributes}
+	resp, err := samltools.CreateSAMLResponseWithOptions(sp.IDPEntityID, authnRequest.ID, sp.ACSURL, sp.EntityID, opts, idpCtx)
+	if err != nil {
+		t.Fatalf("failed to create Response %s", err)
+	}
+	if rec = acsForTest(sp, resp, "", requestCookie); rec.Code != http.StatusFound {
+		t.Fatalf("failed to log in, got %d", rec.Code)
+	}
+	return append(rec.Result().Cookies(), requestCookie)
+}
+
+func TestAuthorize(t *testing.T) {
+	sp, idpCtx := newServiceProviderForTest()
+	cookies := loginForTest(t, sp, idpCtx, map[string][]string{
+		"email":      {"user1@samltools.com"},
+		"groups":     {"users"},
+		"department": {"sales"},
+	})
+	app := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	get := func(handler http.Handler) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/admin/page", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	expression, err := Expression(`{{and (has .Attributes.department "sales") (hasSuffix .Profile.Email "@samltools.com")}}`)
+	if err != nil {
+		t.Fatalf("failed to parse expression %s", err)
+	}
+	missing, _ := Expression(`{{has .Attributes.missing "x"}}`)
+	if _, err := Expression(`{{has`); err == nil {
+		t.Fatalf("expected invalid expression to be rejected")
+	}
+
+	for _, c := range []struct {
+		requirement Requirement
+		allowed     bool
+	}{
+		{InGroup("admins", "users"), true},
+		{InGroup("admins"), false},
+		{EmailDomain("SAMLtools.com"), true},
+		{EmailDomain("example.com"), false},
+		{expression, true},
+		{missing, false},
+		{RequirementFunc(func(session *samltools.SPSession, profile *Profile) error { return nil }), true},
+	} {
+		rec := get(sp.Authorize(app, c.requirement))
+		if c.allowed && (rec.Code != http.StatusOK || rec.Body.String() != "ok") {
+			t.Fatalf("expected user to be allowed, got %d %s", rec.Code, rec.Body.String())
+		}
+		if !c.allowed && (rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "Access denied: you")) {
+			t.Fatalf("expected user to be denied with the reason, got %d %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	// Step-up login
+	passwordProtected := "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+	rec := get(sp.Authorize(app, AuthnContext(passwordProtected)))
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != http.StatusFound || err != nil || !strings.HasPrefix(location.String(), sp.IDPSSOURL) {
+		t.Fatalf("expected user to be sent to the IdP to log in again, got %d", rec.Code)
+	}
+	authnRequest := authnRequestForTest(t, location)
+	if !authnRequest.ForceAuthn || authnRequest.RequestedAuthnContext == nil || authnRequest.RequestedAuthnContext.AuthnContextClassRefs[0] != passwordProtected {
+		t.Fatalf("unexpected step-up AuthnRequest %#v", authnRequest)
+	}
+	resp, _ := samltools.CreateSAMLResponseWithOptions(sp.IDPEntityID, authnRequest.ID, sp.ACSURL, sp.EntityID, samltools.ResponseOptions{NameID: "user1"}, idpCtx)
+	rec = acsForTest(sp, resp, location.Query().Get(samltools.RelayStateParam), rec.Result().Cookies()[0])
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/admin/page" {
+		t.Fatalf("expected the user to come back to the page, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	cookies = rec.Result().Cookies()
+	if rec = get(sp.Authorize(app, AuthnContext(passwordProtected))); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected user still not meeting the requirement after logging in again to be denied, got %d", rec.Code)
+	}
+}
+
+func TestAwaitStepUpPrunesExpired(t *testing.T) {
+	sp, _ := newServiceProviderForTest()
+	sp.stepUps["_expired"] = time.Now().Add(-time.Second)
+	sp.awaitStepUp("_stepup")
+	if _, ok := sp.stepUps["_expired"]; ok {
+		t.Fatalf("expected expired step-up to be pruned")
+	}
+	if !sp.steppedUp(&samltools.SPSession{InResponseTo: "_stepup"}) {
+		t.Fatalf("expected the session started by the step-up to be recognized")
+	}
+}
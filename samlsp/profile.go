@@ -0,0 +1,140 @@
+package samlsp
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/monmohan/samltools"
+)
+
+// Profile is the logged in user as the application knows them, whatever the attribute
+// names of their IdP.
+type Profile struct {
+	ID     string              `json:"id"`
+	Email  string              `json:"email,omitempty"`
+	Name   string              `json:"name,omitempty"`
+	Groups []string            `json:"groups,omitempty"`
+	Fields map[string][]string `json:"fields,omitempty"`
+}
+
+// AttributeMapping tells which attributes of the assertions of an IdP make up the
+// Profile. Each field lists the attribute names it is taken from, the first one present
+// being used. The ID is the NameID when none of its attributes is present.
+type AttributeMapping struct {
+	// IDP is the entity ID of the IdP the mapping applies to.
+	IDP    string   `mapstructure:"idp"`
+	ID     []string `mapstructure:"id"`
+	Email  []string `mapstructure:"email"`
+	Name   []string `mapstructure:"name"`
+	Groups []string `mapstructure:"groups"`
+	// Fields are the custom fields of the profile, by name.
+	Fields map[string][]string `mapstructure:"fields"`
+}
+
+// DefaultAttributeMapping maps the usual attribute names: the basic names of the toy IdP,
+// the claim URIs of ADFS, Azure AD and Auth0 and the LDAP/eduPerson OIDs.
+var DefaultAttributeMapping = AttributeMapping{
+	ID: []string{
+		"userid",
+		"uid",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/nameidentifier",
+		"urn:oid:0.9.2342.19200300.100.1.1",
+	},
+	Email: []string{
+		"email",
+		"mail",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+		"urn:oid:0.9.2342.19200300.100.1.3",
+	},
+	Name: []string{
+		"name",
+		"displayName",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/name",
+		"urn:oid:2.16.840.1.113730.3.1.241",
+	},
+	Groups: []string{
+		"groups",
+		"memberOf",
+		"http://schemas.microsoft.com/ws/2008/06/identity/claims/groups",
+		"http://schemas.microsoft.com/ws/2008/06/identity/claims/role",
+		"urn:oid:1.3.6.1.4.1.5923.1.5.1.1",
+	},
+}
+
+// Profile returns the profile of the user of the session, mapped from its attributes by
+// the AttributeMapping of its IdP. DefaultAttributeMapping maps the fields it leaves out.
+func (sp *ServiceProvider) Profile(session *samltools.SPSession) *Profile {
+	mapping := DefaultAttributeMapping
+	for _, m := range sp.AttributeMappings {
+		if m.IDP != session.IDPEntityID {
+			continue
+		}
+		if len(m.ID) > 0 {
+			mapping.ID = m.ID
+		}
+		if len(m.Email) > 0 {
+			mapping.Email = m.Email
+		}
+		if len(m.Name) > 0 {
+			mapping.Name = m.Name
+		}
+		if len(m.Groups) > 0 {
+			mapping.Groups = m.Groups
+		}
+		mapping.Fields = m.Fields
+		break
+	}
+	return mapping.Profile(session)
+}
+
+// Profile maps the attributes of the session to a profile.
+func (m *AttributeMapping) Profile(session *samltools.SPSession) *Profile {
+	profile := &Profile{
+		ID:     firstValue(session.Attributes, m.ID),
+		Email:  firstValue(session.Attributes, m.Email),
+		Name:   firstValue(session.Attributes, m.Name),
+		Groups: values(session.Attributes, m.Groups),
+	}
+	if profile.ID == "" {
+		profile.ID = session.NameID.Value
+	}
+	if len(m.Fields) > 0 {
+		profile.Fields = map[string][]string{}
+		for field, names := range m.Fields {
+			if v := values(session.Attributes, names); v != nil {
+				profile.Fields[field] = v
+			}
+		}
+	}
+	return profile
+}
+
+// values returns the values of the first of the attributes present.
+func values(attributes map[string][]string, names []string) []string {
+	for _, name := range names {
+		if v, ok := attributes[name]; ok && len(v) > 0 {
+			return append([]string(nil), v...)
+		}
+	}
+	return nil
+}
+
+func firstValue(attributes map[string][]string, names []string) string {
+	if v := values(attributes, names); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+type profileKey struct{}
+
+// ProfileFromContext returns the profile of the user, put in the request context by RequireAccount.
+func ProfileFromContext(ctx context.Context) (*Profile, bool) {
+	profile, ok := ctx.Value(profileKey{}).(*Profile)
+	return profile, ok
+}
+
+// withProfile puts the profile of the user of the session in the request context.
+func (sp *ServiceProvider) withProfile(req *http.Request, session *samltools.SPSession) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), profileKey{}, sp.Profile(session)))
+}
@@ -0,0 +1,128 @@
+package samlsp
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monmohan/samltools"
+)
+
+// MaxRelayStateLength is the longest RelayState the SAML bindings allow.
+const MaxRelayStateLength = 80
+
+// maxReturnURLLength is the longest page address kept for users logging in.
+const maxReturnURLLength = 2048
+
+// RelayStateStore keeps the pages users asked for while they log in at the IdP. Only an
+// opaque token referencing the page is sent as RelayState, each token being good for a
+// single login.
+type RelayStateStore struct {
+	// TTL is how long users have to log in.
+	TTL time.Duration
+	// MaxEntries bounds how many logins can be in progress, for the store not to grow
+	// without limit with logins that are never finished.
+	MaxEntries int
+
+	mu     sync.Mutex
+	states map[string]relayState
+}
+
+type relayState struct {
+	returnURL string
+	expires   time.Time
+}
+
+func NewRelayStateStore() *RelayStateStore {
+	return &RelayStateStore{
+		TTL:        10 * time.Minute,
+		MaxEntries: 10000,
+		states:     map[string]relayState{},
+	}
+}
+
+// Put keeps the page and returns the RelayState token referencing it, empty when the
+// page can't be kept.
+func (s *RelayStateStore) Put(returnURL string) string {
+	if len(returnURL) > maxReturnURLLength {
+		return ""
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.states) >= s.MaxEntries {
+		for token, state := range s.states {
+			if now.After(state.expires) {
+				delete(s.states, token)
+			}
+		}
+		if len(s.states) >= s.MaxEntries {
+			return ""
+		}
+	}
+	token := samltools.NewID()
+	s.states[token] = relayState{returnURL: returnURL, expires: now.Add(s.TTL)}
+	return token
+}
+
+// Take returns the page the RelayState token references, forgetting it.
+func (s *RelayStateStore) Take(token string) (string, bool) {
+	if token == "" || len(token) > MaxRelayStateLength {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[token]
+	if !ok {
+		return "", false
+	}
+	delete(s.states, token)
+	if time.Now().After(state.expires) {
+		return "", false
+	}
+	return state.returnURL, true
+}
+
+// returnURL is where the user goes after logging in: the page the RelayState token
+// references or, for the unsolicited Responses of IdP-initiated SSO, the page RelayState
+// names. DefaultRedirect is used unless that page is safe to redirect to.
+func (sp *ServiceProvider) returnURL(relayState string, unsolicited bool) string {
+	returnURL, ok := sp.RelayStates.Take(relayState)
+	if !ok && unsolicited {
+		returnURL, ok = relayState, true
+	}
+	if !ok || !sp.safeRedirect(returnURL) {
+		return sp.DefaultRedirect
+	}
+	return returnURL
+}
+
+// safeRedirect reports whether users may be sent to the page after logging in: pages
+// of the Service Provider, either local paths or URLs with the origin of its ACS, and
+// pages of the origins in AllowedRedirects.
+func (sp *ServiceProvider) safeRedirect(returnURL string) bool {
+	if returnURL == "" || strings.ContainsAny(returnURL, "\\\r\n\t") {
+		return false
+	}
+	u, err := url.Parse(returnURL)
+	if err != nil || u.User != nil {
+		return false
+	}
+	if u.Scheme == "" && u.Host == "" {
+		return strings.HasPrefix(returnURL, "/") && !strings.HasPrefix(returnURL, "//")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	origin := u.Scheme + "://" + strings.ToLower(u.Host)
+	if acs, err := url.Parse(sp.ACSURL); err == nil && origin == acs.Scheme+"://"+strings.ToLower(acs.Host) {
+		return true
+	}
+	for _, allowed := range sp.AllowedRedirects {
+		if origin == strings.ToLower(strings.TrimSuffix(allowed, "/")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,438 @@
+// Package samlsp is a SAML 2.0 Service Provider for net/http applications: it logs
+// users in at an Identity Provider, keeps their session and logs them out again.
+//
+//	sp := samlsp.NewServiceProvider("urn:example:sp", "https://app.example.com/saml/acs", validationContext)
+//	sp.IDPSSOURL = "https://idp.example.com/sso"
+//	http.Handle("/saml/acs", http.HandlerFunc(sp.ACS))
+//	http.Handle("/app/", sp.RequireAccount(app))
+package samlsp
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/monmohan/samltools"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// ServiceProvider holds the configuration and state of a Service Provider relying on a
+// single Identity Provider. The IdP is described by its metadata, when IDPMetadata is
+// set, and otherwise by the IDP* locations.
+type ServiceProvider struct {
+	EntityID string
+	// ACSURL is the location of the Assertion Consumer Service, served by ACS.
+	ACSURL string
+	// SLOURL is the location of the front-channel SingleLogoutService, served by SLO.
+	// The SOAP one, served by SOAPLogoutService, is at SLOURL/soap. No Single Logout is
+	// published when it is empty.
+	SLOURL string
+
+	// IDPEntityID, when set, is the only IdP Responses and LogoutRequests are accepted from.
+	IDPEntityID string
+	// IDPMetadata returns the metadata of the IdP, nil when it isn't known.
+	IDPMetadata func() *samltools.IDPSSODescriptor
+	// IDPSSOURL, IDPSLOURL and ArtifactResolutionURL locate the IdP services when there
+	// is no metadata, or it doesn't list them.
+	IDPSSOURL             string
+	IDPSLOURL             string
+	IDPSLOBinding         string
+	ArtifactResolutionURL string
+
+	// ValidationContext verifies the signatures of the IdP.
+	ValidationContext *dsig.ValidationContext
+	// SigningContext, when set, signs AuthnRequests and Single Logout messages.
+	SigningContext *dsig.SigningContext
+	// ArtifactResolver, when set, resolves Responses sent with the HTTP-Artifact binding.
+	ArtifactResolver *samltools.ArtifactResolver
+	Sessions         *samltools.SPSessionStore
+	// Requests keeps the AuthnRequests waiting for a Response, bound to the browser
+	// they were sent through.
+	Requests *samltools.OutstandingRequests
+	// Assertions remembers the IDs of the assertions received until they expire, so that
+	// none is used twice, unsolicited ones having no AuthnRequest to consume.
+	Assertions *samltools.ReplayCache
+
+	// AuthnRequestBinding is the binding AuthnRequests are sent with, by default
+	// HTTP-Redirect unless the IdP only has an HTTP-POST SingleSignOnService.
+	AuthnRequestBinding string
+	// ResponseBinding is the binding the IdP is asked to send Responses with, HTTP-POST
+	// or HTTP-Artifact.
+	ResponseBinding string
+	// AuthnRequestOptions, when set, completes every AuthnRequest, e.g. with a NameIDPolicy.
+	AuthnRequestOptions func(*samltools.AuthnRequest)
+	// AllowUnsolicitedFrom lists the IdPs unsolicited Responses are accepted from, "*" for any.
+	AllowUnsolicitedFrom []string
+	// AttributeMappings map the attributes of the IdPs to the Profile of the user, by IdP.
+	// DefaultAttributeMapping is used for the others.
+	AttributeMappings []AttributeMapping
+
+	// DefaultRedirect is where users land after logging in without a page to return to.
+	DefaultRedirect string
+	// RelayStates keeps the pages users return to after logging in, only an opaque token
+	// being sent to the IdP as RelayState.
+	RelayStates *RelayStateStore
+	// AllowedRedirects lists the origins, e.g. https://app.example.com, users may return
+	// to after logging in besides the one of ACSURL.
+	AllowedRedirects []string
+	// Debug makes ACS show the Response it received instead of redirecting the user,
+	// even when its signature doesn't verify.
+	Debug bool
+
+	mu             sync.Mutex
+	pendingLogouts map[string]time.Time
+	stepUps        map[string]time.Time
+	logoutReplay   *samltools.ReplayCache
+}
+
+// NewServiceProvider returns a Service Provider receiving Responses at acsURL, signed by
+// the IdP as checked by validationContext.
+func NewServiceProvider(entityID string, acsURL string, validationContext *dsig.ValidationContext) *ServiceProvider {
+	return &ServiceProvider{
+		EntityID:          entityID,
+		ACSURL:            acsURL,
+		ValidationContext: validationContext,
+		Sessions:          samltools.NewSPSessionStore(),
+		Requests:          samltools.NewOutstandingRequests(),
+		Assertions:        samltools.NewReplayCache(),
+		ResponseBinding:   samltools.HTTPPostBinding,
+		DefaultRedirect:   "/",
+		RelayStates:       NewRelayStateStore(),
+		pendingLogouts:    map[string]time.Time{},
+		stepUps:           map[string]time.Time{},
+		logoutReplay:      samltools.NewReplayCache(),
+	}
+}
+
+// SessionFromContext returns the session of the user, put in the request context by RequireAccount.
+func SessionFromContext(ctx context.Context) (*samltools.SPSession, bool) {
+	return samltools.SPSessionFromContext(ctx)
+}
+
+// RequireAccount lets requests of logged in users through to next, with their session
+// and Profile in the request context, and sends the others to the IdP to log in. They
+// come back to the page they asked for.
+func (sp *ServiceProvider) RequireAccount(next http.Handler) http.Handler {
+	return sp.Sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if session, ok := SessionFromContext(req.Context()); ok {
+			next.ServeHTTP(w, sp.withProfile(req, session))
+			return
+		}
+		if req.Method != http.MethodGet {
+			http.Error(w, "Login required", http.StatusUnauthorized)
+			return
+		}
+		sp.startLogin(w, req, req.URL.RequestURI())
+	}))
+}
+
+// ReturnParam is the query parameter of the Login handler naming the page users return
+// to after logging in.
+const ReturnParam = "return"
+
+// Login sends the browser to the IdP with a new AuthnRequest. Users come back to the
+// page of ReturnParam, when it is safe to redirect to.
+func (sp *ServiceProvider) Login(w http.ResponseWriter, req *http.Request) {
+	returnURL := req.URL.Query().Get(ReturnParam)
+	if !sp.safeRedirect(returnURL) {
+		returnURL = ""
+	}
+	sp.startLogin(w, req, returnURL)
+}
+
+// startLogin sends the AuthnRequest, completed by options, with the token of returnURL as
+// RelayState. It returns the ID of the AuthnRequest, empty when it couldn't be sent.
+func (sp *ServiceProvider) startLogin(w http.ResponseWriter, req *http.Request, returnURL string, options ...func(*samltools.AuthnRequest)) string {
+	binding, location := sp.IDPSSOService()
+	samlreq := sp.NewAuthnRequest(location)
+	for _, option := range options {
+		option(samlreq)
+	}
+	output, err := samlreq.Bytes()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return ""
+	}
+	sp.Requests.Add(w, req, samlreq.ID)
+	relayState := ""
+	if returnURL != "" {
+		relayState = sp.RelayStates.Put(returnURL)
+	}
+	if err := samltools.SendMessage(w, req, binding, location, samltools.SAMLRequestParam, output, relayState, sp.SigningContext); err != nil {
+		fmt.Printf("Failed to send AuthnRequest %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return ""
+	}
+	return samlreq.ID
+}
+
+// NewAuthnRequest returns an AuthnRequest for the IdP SSO service at destination.
+func (sp *ServiceProvider) NewAuthnRequest(destination string) *samltools.AuthnRequest {
+	samlreq := samltools.NewAuthnRequest(sp.EntityID, destination)
+	samlreq.ProtocolBinding = sp.ResponseBinding
+	samlreq.AssertionConsumerServiceURL = sp.ACSURL
+	if sp.AuthnRequestOptions != nil {
+		sp.AuthnRequestOptions(samlreq)
+	}
+	return samlreq
+}
+
+// IDPSSOService returns the binding AuthnRequests are sent with and the SSO endpoint of the IdP for it.
+func (sp *ServiceProvider) IDPSSOService() (string, string) {
+	binding := sp.AuthnRequestBinding
+	if idp := sp.idp(); idp != nil {
+		bindings := []string{binding}
+		if binding == "" {
+			bindings = []string{samltools.HTTPRedirectBinding, samltools.HTTPPostBinding}
+		}
+		for _, b := range bindings {
+			if loc, ok := idp.SingleSignOnService(b); ok {
+				return b, loc
+			}
+		}
+	}
+	if binding == "" {
+		binding = samltools.HTTPRedirectBinding
+	}
+	return binding, sp.IDPSSOURL
+}
+
+// IDPSLOService returns the SingleLogoutService of the IdP with the first of the bindings it has.
+func (sp *ServiceProvider) IDPSLOService(bindings ...string) (samltools.Endpoint, bool) {
+	if idp := sp.idp(); idp != nil {
+		return idp.SingleLogoutService(bindings...)
+	}
+	if sp.IDPSLOURL == "" {
+		return samltools.Endpoint{}, false
+	}
+	binding := sp.IDPSLOBinding
+	if binding == "" {
+		binding = samltools.HTTPRedirectBinding
+	}
+	return samltools.Endpoint{Binding: binding, Location: sp.IDPSLOURL}, true
+}
+
+func (sp *ServiceProvider) idp() *samltools.IDPSSODescriptor {
+	if sp.IDPMetadata == nil {
+		return nil
+	}
+	return sp.IDPMetadata()
+}
+
+// ACS is the Assertion Consumer Service: it checks the Response of the IdP, received
+// with the HTTP-POST or HTTP-Artifact binding, and starts a session for its subject.
+// A Response with an error status ends the login, reporting the status to the user.
+func (sp *ServiceProvider) ACS(w http.ResponseWriter, req *http.Request) {
+	var err error
+	req.ParseForm()
+	samlResponse := req.Form.Get(samltools.SAMLResponseParam)
+	if artifact := req.Form.Get(samltools.SAMLArtParam); artifact != "" {
+		if samlResponse, err = sp.resolveArtifact(artifact); err != nil {
+			fmt.Printf("Artifact resolution failed \n %s \n", err.Error())
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	data, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := samltools.ParseResponse(data)
+	if err == nil && resp.Destination != "" && resp.Destination != sp.ACSURL {
+		err = fmt.Errorf("Response is sent to %s, not %s", resp.Destination, sp.ACSURL)
+	}
+	if err != nil {
+		fmt.Printf("Rejecting Response \n %s \n", err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if status := resp.Status.Err(); status != nil {
+		fmt.Printf("Rejecting Response \n %s \n", status.Error())
+		if !resp.Unsolicited() {
+			sp.Requests.Consume(req, resp.InResponseTo)
+		}
+		http.Error(w, loginFailure(status), http.StatusForbidden)
+		return
+	}
+
+	assertion, err := samltools.ParseValidatedAssertion(samlResponse, sp.ValidationContext)
+	if err == nil && sp.IDPEntityID != "" && (assertion.Issuer == nil || assertion.Issuer.Value != sp.IDPEntityID) {
+		err = fmt.Errorf("assertion isn't issued by %s", sp.IDPEntityID)
+	}
+	if err == nil {
+		err = assertion.Validate(sp.EntityID, sp.ACSURL, time.Now())
+	}
+	if err == nil {
+		err = sp.checkUnsolicited(resp, assertion)
+	}
+	if err == nil {
+		err = sp.checkInResponseTo(req, resp, assertion)
+	}
+	if err == nil && !sp.Assertions.Add(assertion.ID, assertion.NotOnOrAfter().Add(samltools.ClockSkew)) {
+		err = fmt.Errorf("assertion %s was already used", assertion.ID)
+	}
+	if err != nil {
+		fmt.Printf("Rejecting Response \n %s \n", err.Error())
+		if !sp.Debug {
+			http.Error(w, "Invalid assertion", http.StatusForbidden)
+			return
+		}
+	} else {
+		issuer := ""
+		if assertion.Issuer != nil {
+			issuer = assertion.Issuer.Value
+		}
+		sp.Sessions.Create(w, req, issuer, assertion)
+	}
+
+	if sp.Debug {
+		w.Header().Add("Content-Type", "application/xml")
+		w.Write(data)
+		return
+	}
+	http.Redirect(w, req, sp.returnURL(req.Form.Get(samltools.RelayStateParam), resp.Unsolicited()), http.StatusFound)
+}
+
+// loginFailure returns what to tell the user of the status of a Response without assertion.
+func loginFailure(status *samltools.StatusError) string {
+	switch status.SubCode {
+	case samltools.StatusNoPassive:
+		return "login required"
+	case samltools.StatusAuthnFailed:
+		return "authentication failed"
+	}
+	if status.Message != "" {
+		return "login failed: " + status.Message
+	}
+	return "login failed"
+}
+
+// checkUnsolicited rejects the unsolicited Responses of IdP-initiated SSO unless their
+// signed assertion is issued by an IdP listed in AllowUnsolicitedFrom.
+func (sp *ServiceProvider) checkUnsolicited(resp *samltools.Response, assertion *samltools.Assertion) error {
+	if !resp.Unsolicited() {
+		return nil
+	}
+	issuer := ""
+	if assertion.Issuer != nil {
+		issuer = assertion.Issuer.Value
+	}
+	for _, allowed := range sp.AllowUnsolicitedFrom {
+		if allowed == "*" || allowed == issuer {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsolicited Responses from %s aren't accepted", issuer)
+}
+
+// checkInResponseTo checks the Response and the SubjectConfirmationData of its signed
+// assertion answer the same AuthnRequest, outstanding for the browser, and consumes it.
+func (sp *ServiceProvider) checkInResponseTo(req *http.Request, resp *samltools.Response, assertion *samltools.Assertion) error {
+	confirmed := false
+	if assertion.Subject != nil {
+		for _, sc := range assertion.Subject.SubjectConfirmations {
+			if sc.SubjectConfirmationData == nil {
+				continue
+			}
+			if sc.SubjectConfirmationData.InResponseTo != resp.InResponseTo {
+				return fmt.Errorf("assertion is in response to %s, not %s", sc.SubjectConfirmationData.InResponseTo, resp.InResponseTo)
+			}
+			confirmed = true
+		}
+	}
+	if !confirmed {
+		return fmt.Errorf("assertion has no SubjectConfirmationData")
+	}
+	if resp.Unsolicited() {
+		return nil
+	}
+	return sp.Requests.Consume(req, resp.InResponseTo)
+}
+
+// resolveArtifact returns the base64 encoded Response referenced by the artifact,
+// resolved at the ArtifactResolutionService of the IdP the artifact comes from.
+func (sp *ServiceProvider) resolveArtifact(encoded string) (string, error) {
+	if sp.ArtifactResolver == nil {
+		return "", fmt.Errorf("the HTTP-Artifact binding isn't supported")
+	}
+	artifact, err := samltools.ParseArtifact(encoded)
+	if err != nil {
+		return "", err
+	}
+	location := sp.ArtifactResolutionURL
+	if sp.IDPEntityID != "" {
+		if !artifact.IssuedBy(sp.IDPEntityID) {
+			return "", fmt.Errorf("artifact wasn't issued by %s", sp.IDPEntityID)
+		}
+		if idp := sp.idp(); idp != nil {
+			if loc, ok := idp.ArtifactResolutionService(int(artifact.EndpointIndex)); ok {
+				location = loc
+			}
+		}
+	}
+	if location == "" {
+		return "", fmt.Errorf("no ArtifactResolutionService for index %d", artifact.EndpointIndex)
+	}
+	message, err := sp.ArtifactResolver.Resolve(location, encoded)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(message), nil
+}
+
+// Metadata serves the metadata of the Service Provider.
+func (sp *ServiceProvider) Metadata(w http.ResponseWriter, req *http.Request) {
+	ed, err := sp.EntityDescriptor()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := xml.MarshalIndent(ed, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+// EntityDescriptor describes the Service Provider in metadata.
+func (sp *ServiceProvider) EntityDescriptor() (*samltools.EntityDescriptor, error) {
+	desc := samltools.SPSSODescriptor{
+		AuthnRequestsSigned:  sp.SigningContext != nil,
+		WantAssertionsSigned: true,
+	}
+	desc.ProtocolSupportEnumeration = samltools.ProtocolNamespace
+	desc.AssertionConsumerServices = []samltools.IndexedEndpoint{{Binding: samltools.HTTPPostBinding, Location: sp.ACSURL, Index: 0}}
+	if sp.ArtifactResolver != nil {
+		desc.AssertionConsumerServices = append(desc.AssertionConsumerServices,
+			samltools.IndexedEndpoint{Binding: samltools.HTTPArtifactBinding, Location: sp.ACSURL, Index: 1})
+	}
+	if sp.SLOURL != "" {
+		desc.SingleLogoutServices = []samltools.Endpoint{
+			{Binding: samltools.HTTPRedirectBinding, Location: sp.SLOURL},
+			{Binding: samltools.HTTPPostBinding, Location: sp.SLOURL},
+			{Binding: samltools.SOAPBinding, Location: sp.SLOURL + "/soap"},
+		}
+	}
+	if sp.SigningContext != nil {
+		_, certDER, err := sp.SigningContext.KeyStore.GetKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		cert, err := x509.ParseCertificate(certDER)
+		if err != nil {
+			return nil, err
+		}
+		desc.KeyDescriptors = []samltools.KeyDescriptor{samltools.NewKeyDescriptor("signing", cert)}
+	}
+	return &samltools.EntityDescriptor{EntityID: sp.EntityID, SPSSODescriptors: []samltools.SPSSODescriptor{desc}}, nil
+}
@@ -0,0 +1,174 @@
+package samlsp
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/monmohan/samltools"
+)
+
+// logoutLifetime is how long the IdP has to answer a LogoutRequest of Logout.
+const logoutLifetime = 5 * time.Minute
+
+// Logout ends the session at the Service Provider and sends the browser to the IdP
+// with a LogoutRequest, for the IdP to end it at the other Service Providers too. Only
+// POST requests are accepted, so that other sites can't log users out with a link.
+func (sp *ServiceProvider) Logout(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	session, ok := sp.Sessions.Get(req)
+	if !ok {
+		http.Redirect(w, req, sp.DefaultRedirect, http.StatusFound)
+		return
+	}
+	sp.Sessions.Delete(w, req, session)
+	ep, ok := sp.IDPSLOService(samltools.HTTPRedirectBinding, samltools.HTTPPostBinding)
+	if !ok {
+		w.Write([]byte("Logged out of this Service Provider only, the IdP has no Single Logout service"))
+		return
+	}
+	logoutRequest := samltools.NewLogoutRequest(sp.EntityID, ep.Location, session.NameID, session.SessionIndex)
+	output, err := logoutRequest.Bytes()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	sp.awaitLogout(logoutRequest.ID)
+	if err := samltools.SendMessage(w, req, ep.Binding, ep.Location, samltools.SAMLRequestParam, output, "", sp.SigningContext); err != nil {
+		fmt.Printf("Failed to send LogoutRequest %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// awaitLogout keeps the ID of the LogoutRequest until the IdP answers it, for SLO to
+// accept the LogoutResponse.
+func (sp *ServiceProvider) awaitLogout(id string) {
+	now := time.Now()
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for i, expires := range sp.pendingLogouts {
+		if now.After(expires) {
+			delete(sp.pendingLogouts, i)
+		}
+	}
+	sp.pendingLogouts[id] = now.Add(logoutLifetime)
+}
+
+// SLO is the front-channel SingleLogoutService. It receives the LogoutResponse to a
+// logout started by Logout and the LogoutRequests of logouts started elsewhere, both
+// of which must be signed by the IdP.
+func (sp *ServiceProvider) SLO(w http.ResponseWriter, req *http.Request) {
+	msg, err := samltools.ReadInboundMessage(req)
+	if err != nil {
+		sloError(w, http.StatusBadRequest, err)
+		return
+	}
+	certs, err := sp.ValidationContext.CertificateStore.Certificates()
+	if err != nil {
+		sloError(w, http.StatusInternalServerError, err)
+		return
+	}
+	data, err := msg.Verify(certs, true)
+	if err != nil {
+		sloError(w, http.StatusBadRequest, err)
+		return
+	}
+	if msg.IsRequest() {
+		sp.handleLogoutRequest(w, req, msg, data)
+		return
+	}
+	logoutResponse, err := samltools.ParseLogoutResponse(data)
+	if err != nil {
+		sloError(w, http.StatusBadRequest, err)
+		return
+	}
+	sp.mu.Lock()
+	expires, ok := sp.pendingLogouts[logoutResponse.InResponseTo]
+	delete(sp.pendingLogouts, logoutResponse.InResponseTo)
+	sp.mu.Unlock()
+	if !ok || time.Now().After(expires) {
+		sloError(w, http.StatusBadRequest, fmt.Errorf("unexpected LogoutResponse to %s", logoutResponse.InResponseTo))
+		return
+	}
+	if status := logoutResponse.Status.Err(); status != nil {
+		if status.SubCode == samltools.StatusPartialLogout {
+			w.Write([]byte(fmt.Sprintf("Partially logged out: %s", status.Message)))
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("Logged out of this Service Provider only: %s", status)))
+		return
+	}
+	w.Write([]byte("Logged out"))
+}
+
+// handleLogoutRequest ends the sessions a LogoutRequest of the IdP refers to and answers it.
+func (sp *ServiceProvider) handleLogoutRequest(w http.ResponseWriter, req *http.Request, msg *samltools.InboundMessage, data []byte) {
+	logoutRequest, err := samltools.ParseLogoutRequest(data)
+	if err != nil {
+		sloError(w, http.StatusBadRequest, err)
+		return
+	}
+	issuer := logoutRequest.IssuerValue()
+	if sp.IDPEntityID != "" && issuer != sp.IDPEntityID {
+		sloError(w, http.StatusBadRequest, fmt.Errorf("LogoutRequest issued by %s", issuer))
+		return
+	}
+	status := samltools.CheckLogoutRequest(logoutRequest, sp.SLOURL, true, sp.logoutReplay, time.Now())
+	if status == nil {
+		current, hasCurrent := sp.Sessions.Get(req)
+		sp.Sessions.DeleteMatching(issuer, logoutRequest)
+		if _, stillLive := sp.Sessions.Get(req); hasCurrent && !stillLive {
+			sp.Sessions.Delete(w, req, current)
+		}
+	}
+	ep, ok := sp.IDPSLOService(msg.Binding, samltools.HTTPRedirectBinding, samltools.HTTPPostBinding)
+	if !ok {
+		sloError(w, http.StatusInternalServerError, fmt.Errorf("the IdP has no Single Logout service"))
+		return
+	}
+	logoutResponse := samltools.NewLogoutResponse(sp.EntityID, ep.ResponseURL(), logoutRequest.ID, status)
+	output, err := logoutResponse.Bytes()
+	if err != nil {
+		sloError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := samltools.SendMessage(w, req, ep.Binding, ep.ResponseURL(), samltools.SAMLResponseParam, output, msg.RelayState, sp.SigningContext); err != nil {
+		sloError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// SOAPLogoutService returns the handler ending sessions on the LogoutRequests the IdP
+// sends over the SOAP back-channel.
+func (sp *ServiceProvider) SOAPLogoutService() http.Handler {
+	location := ""
+	if sp.SLOURL != "" {
+		location = sp.SLOURL + "/soap"
+	}
+	return &samltools.SOAPLogoutService{
+		EntityID:        sp.EntityID,
+		Location:        location,
+		Sessions:        sp.Sessions,
+		Replay:          sp.logoutReplay,
+		IDPCertificates: sp.idpCertificates,
+		SigningContext:  sp.SigningContext,
+	}
+}
+
+// idpCertificates returns the signing certificates of the IdP, the only one trusted to end sessions.
+func (sp *ServiceProvider) idpCertificates(idpEntityID string) ([]*x509.Certificate, error) {
+	if sp.IDPEntityID != "" && idpEntityID != sp.IDPEntityID {
+		return nil, fmt.Errorf("%s isn't the IdP of this Service Provider", idpEntityID)
+	}
+	return sp.ValidationContext.CertificateStore.Certificates()
+}
+
+func sloError(w http.ResponseWriter, code int, err error) {
+	fmt.Printf("Single Logout failed \n %s \n", err)
+	w.WriteHeader(code)
+	w.Write([]byte(err.Error()))
+}
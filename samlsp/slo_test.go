@@ -0,0 +1,65 @@
+package samlsp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/monmohan/samltools"
+)
+
+func TestAwaitLogoutPrunesExpired(t *testing.T) {
+	sp, _ := newServiceProviderForTest()
+	sp.pendingLogouts["_expired"] = time.Now().Add(-time.Second)
+	sp.awaitLogout("_pending")
+	if _, ok := sp.pendingLogouts["_expired"]; ok {
+		t.Fatalf("expected expired LogoutRequest to be pruned")
+	}
+	if expires, ok := sp.pendingLogouts["_pending"]; !ok || !time.Now().Before(expires) {
+		t.Fatalf("expected LogoutRequest to await its LogoutResponse")
+	}
+}
+
+func TestSLOChecksLogoutRequest(t *testing.T) {
+	sp, idpCtx := newServiceProviderForTest()
+	sp.SLOURL = "http://sp.samltools.com:4567/slo"
+	sp.IDPSLOURL = "http://idp.samltools.com:5678/slo"
+	nameID := samltools.NameID{Value: "alice"}
+	slo := func(logoutRequest *samltools.LogoutRequest) *samltools.StatusError {
+		data, _ := logoutRequest.Bytes()
+		location, err := samltools.RedirectURL(sp.SLOURL, samltools.SAMLRequestParam, data, "", idpCtx)
+		if err != nil {
+			t.Fatalf("failed to encode LogoutRequest %s", err)
+		}
+		rec := httptest.NewRecorder()
+		sp.SLO(rec, httptest.NewRequest(http.MethodGet, location, nil))
+		redirect, err := url.Parse(rec.Header().Get("Location"))
+		if err != nil || rec.Code != http.StatusFound {
+			t.Fatalf("expected LogoutResponse, got %d %s", rec.Code, rec.Body.String())
+		}
+		data, _ = samltools.DecodeAndInflate(redirect.Query().Get(samltools.SAMLResponseParam))
+		logoutResponse, err := samltools.ParseLogoutResponse(data)
+		if err != nil {
+			t.Fatalf("failed to parse LogoutResponse %s", err)
+		}
+		return logoutResponse.Status.Err()
+	}
+
+	if status := slo(samltools.NewLogoutRequest(sp.IDPEntityID, "http://other.samltools.com/slo", nameID)); status == nil {
+		t.Fatalf("expected LogoutRequest sent elsewhere to be denied")
+	}
+	stale := samltools.NewLogoutRequest(sp.IDPEntityID, sp.SLOURL, nameID)
+	stale.IssueInstant = time.Now().Add(-time.Hour)
+	if status := slo(stale); status == nil {
+		t.Fatalf("expected stale LogoutRequest to be denied")
+	}
+	logoutRequest := samltools.NewLogoutRequest(sp.IDPEntityID, sp.SLOURL, nameID)
+	if status := slo(logoutRequest); status != nil {
+		t.Fatalf("expected LogoutRequest to be accepted, got %v", status)
+	}
+	if status := slo(logoutRequest); status == nil || status.SubCode != samltools.StatusRequestDenied {
+		t.Fatalf("expected replayed LogoutRequest to be denied, got %v", status)
+	}
+}
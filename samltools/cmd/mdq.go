@@ -0,0 +1,81 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/monmohan/samltools"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/spf13/cobra"
+)
+
+// mdqCmd groups the Metadata Query Protocol commands
+var mdqCmd = &cobra.Command{
+	Use:   "mdq",
+	Short: "Metadata Query Protocol (MDQ) tools",
+}
+
+// mdqServeCmd serves the entities of a local aggregate over MDQ
+var mdqServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve per-entity signed metadata out of a local aggregate file",
+	Long: `Serve every EntityDescriptor of a local aggregate file at /entities/{id},
+where id is the URL encoded entityID or its {sha1} transform. Each entity is
+signed with the given key on the way out, so it can be used offline as the MDQ
+responder of the SP and IdP.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		aggregate, _ := cmd.Flags().GetString("aggregate")
+		keyFile, _ := cmd.Flags().GetString("key")
+		certFile, _ := cmd.Flags().GetString("cert")
+		addr, _ := cmd.Flags().GetString("addr")
+		validFor, _ := cmd.Flags().GetDuration("valid-for")
+		if aggregate == "" || keyFile == "" || certFile == "" {
+			return fmt.Errorf("aggregate, key and cert are required")
+		}
+		keyStore, err := samltools.LoadKeyStore(keyFile, certFile)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(aggregate)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		server, err := samltools.NewMDQServer(f, dsig.NewDefaultSigningContext(keyStore))
+		if err != nil {
+			return err
+		}
+		server.ValidFor = validFor
+		fmt.Printf("Serving %d entities from %s at http://%s/entities/\n", server.Len(), aggregate, addr)
+		mux := http.NewServeMux()
+		mux.Handle("/entities/", server)
+		return http.ListenAndServe(addr, mux)
+	},
+}
+
+func init() {
+	mdqServeCmd.Flags().StringP("aggregate", "f", "", "path to the aggregate metadata file")
+	mdqServeCmd.Flags().String("key", "", "PEM private key used to sign the served metadata")
+	mdqServeCmd.Flags().String("cert", "", "PEM certificate of the signing key")
+	mdqServeCmd.Flags().String("addr", "localhost:8089", "address to listen on")
+	mdqServeCmd.Flags().Duration("valid-for", 7*24*time.Hour, "validity of the served metadata")
+	mdqCmd.AddCommand(mdqServeCmd)
+	rootCmd.AddCommand(mdqCmd)
+}
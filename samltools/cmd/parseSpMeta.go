@@ -17,11 +17,11 @@ package cmd
 
 import (
 	"crypto/x509"
-	"encoding/base64"
 	"fmt"
+	"io"
+	"os"
 
-	"github.com/beevik/etree"
-	"github.com/russellhaering/goxmldsig/etreeutils"
+	"github.com/monmohan/samltools"
 	"github.com/spf13/cobra"
 )
 
@@ -29,77 +29,110 @@ import (
 var parseSpMetaCmd = &cobra.Command{
 	Use:   "parse-sp-meta",
 	Short: "Parse a SP metadata XML file",
+	Long: `Parse a metadata XML file holding either a single EntityDescriptor or a
+federation aggregate (EntitiesDescriptor) and print the signing certificates of
+every matching entity. Aggregates are streamed, one entity at a time.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		fmt.Println("parseSpMeta called")
 		filePath, err := cmd.Flags().GetString("metadata-file")
 		if err != nil || len(filePath) == 0 {
 			return fmt.Errorf("error in file path")
 		}
-		doc := etree.NewDocument()
-		if err := doc.ReadFromFile(filePath); err != nil {
+		filters, err := metadataFilters(cmd)
+		if err != nil {
 			return err
 		}
-		getSigningCert(doc)
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		count, err := printSigningCerts(f, os.Stdout, filters...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\n%d matching entities\n", count)
 		return nil
 	},
 }
 
-func getSigningCert(doc *etree.Document) {
-
-	var signKeyEl *etree.Element
-	var ctx etreeutils.NSContext
-	err := etreeutils.NSFindIterate(doc.Root(), "urn:oasis:names:tc:SAML:2.0:metadata", "KeyDescriptor", func(n etreeutils.NSContext, e *etree.Element) error {
-		//fmt.Printf("\tFound KeyDescriptor Element %s\n", e)
-		useAttr := e.SelectAttr("use")
-		if useAttr == nil {
-			return fmt.Errorf("Keydescriptor with no use defined")
-		}
-
-		/*if useAttr.Value == "encryption" {
-			encKeyEl = e
-		}*/
-		if useAttr.Value == "signing" {
-			signKeyEl = e
-		}
-		ctx = n
-		return nil
-	})
+func metadataFilters(cmd *cobra.Command) ([]samltools.EntityFilter, error) {
+	authority, err := cmd.Flags().GetString("registration-authority")
 	if err != nil {
-		fmt.Printf("Error in traversal %s", err.Error())
+		return nil, err
 	}
+	attrs, err := cmd.Flags().GetStringToString("entity-attribute")
+	if err != nil {
+		return nil, err
+	}
+	filters := samltools.MetadataFilters(authority, attrs)
+	entityIDs, err := cmd.Flags().GetStringSlice("entity-id")
+	if err != nil {
+		return nil, err
+	}
+	if len(entityIDs) > 0 {
+		filters = append(filters, samltools.HasEntityID(entityIDs...))
+	}
+	return filters, nil
+}
 
-	var signCert string
-
-	err = etreeutils.NSFindIterateCtx(ctx, signKeyEl, "http://www.w3.org/2000/09/xmldsig#", "X509Certificate", func(n etreeutils.NSContext, e *etree.Element) error {
-		fmt.Printf("\nFound Signing Cert Element %v\n", e.Tag)
-		signCert = e.Text()
-
-		certBytes, err := base64.RawStdEncoding.DecodeString(signCert)
-		if err != nil {
-			return err
+// printSigningCerts streams the metadata and writes the signing certificates of
+// every role of each entity accepted by the filters. It returns the number of entities printed.
+func printSigningCerts(r io.Reader, out io.Writer, filters ...samltools.EntityFilter) (int, error) {
+	count := 0
+	err := samltools.StreamEntityDescriptors(r, func(ed *samltools.EntityDescriptor) error {
+		for _, accept := range filters {
+			if !accept(ed) {
+				return nil
+			}
 		}
-		cert, err := x509.ParseCertificate(certBytes)
-		if err != nil {
-			return err
+		count++
+		fmt.Fprintf(out, "\nEntity => %s\n", ed.EntityID)
+		if ra := ed.RegistrationAuthority(); ra != "" {
+			fmt.Fprintf(out, " Registration Authority => %s\n", ra)
 		}
-		fmt.Printf(" Cert Issuer => %v\n Subject => %v\n PK Algo=> %v\n Not Valid Before=> %v\n Not Valid After=> %v\n ",
-			cert.Issuer, cert.Subject, cert.PublicKeyAlgorithm, cert.NotBefore, cert.NotAfter)
-		err = cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
-		if err != nil {
-			return err
+		for _, idp := range ed.IDPSSODescriptors {
+			if err := printCerts(out, "IDPSSODescriptor", idp.SSODescriptor); err != nil {
+				return err
+			}
+		}
+		for _, sp := range ed.SPSSODescriptors {
+			if err := printCerts(out, "SPSSODescriptor", sp.SSODescriptor); err != nil {
+				return err
+			}
 		}
-		fmt.Println("Verified signature of the certificate using self Public Key.")
-
 		return nil
 	})
+	return count, err
+}
+
+func printCerts(out io.Writer, role string, d samltools.SSODescriptor) error {
+	certs, err := d.SigningCertificates()
 	if err != nil {
-		fmt.Printf("Error in traversal 2 %s", err.Error())
+		return err
 	}
+	fmt.Fprintf(out, " %s signing certificates => %d\n", role, len(certs))
+	for _, cert := range certs {
+		fmt.Fprintf(out, " Cert Issuer => %v\n Subject => %v\n PK Algo=> %v\n Not Valid Before=> %v\n Not Valid After=> %v\n",
+			cert.Issuer, cert.Subject, cert.PublicKeyAlgorithm, cert.NotBefore, cert.NotAfter)
+		if err := verifySelfSigned(cert); err != nil {
+			fmt.Fprintf(out, " Not a self signed certificate: %s\n", err)
+			continue
+		}
+		fmt.Fprintln(out, " Verified signature of the certificate using self Public Key.")
+	}
+	return nil
+}
 
+func verifySelfSigned(cert *x509.Certificate) error {
+	return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
 }
 
 func init() {
 	parseSpMetaCmd.Flags().StringP("metadata-file", "f", "", "path to metdata file")
+	parseSpMetaCmd.Flags().StringSlice("entity-id", nil, "only print the given entities")
+	parseSpMetaCmd.Flags().String("registration-authority", "", "only print entities registered by this authority")
+	parseSpMetaCmd.Flags().StringToString("entity-attribute", nil, "only print entities with this entity attribute, e.g. name=value")
 	rootCmd.AddCommand(parseSpMetaCmd)
 
 	// Here you will define your flags and configuration settings.
@@ -1,16 +1,43 @@
 package cmd
 
 import (
+	"bytes"
 	"log"
+	"os"
+	"strings"
 	"testing"
 
-	"github.com/beevik/etree"
+	"github.com/monmohan/samltools"
 )
 
 func TestFetchSigningCert(t *testing.T) {
-	doc := etree.NewDocument()
-	if err := doc.ReadFromFile("/Users/singhmo/Downloads/okta_metadata.xml"); err != nil {
+	f, err := os.Open("../../samples/dev-ejtl988w_auth0_com-metadata.xml")
+	if err != nil {
 		log.Fatalf("Error : %s", err.Error())
 	}
-	getSigningCert(doc)
+	defer f.Close()
+	var out bytes.Buffer
+	count, err := printSigningCerts(f, &out)
+	if err != nil {
+		t.Fatalf("Error : %s", err.Error())
+	}
+	if count != 1 || !strings.Contains(out.String(), "Verified signature of the certificate") {
+		t.Fatalf("unexpected output %s", out.String())
+	}
+}
+
+func TestFetchSigningCertAggregate(t *testing.T) {
+	f, err := os.Open("../../samples/federation-metadata.xml")
+	if err != nil {
+		log.Fatalf("Error : %s", err.Error())
+	}
+	defer f.Close()
+	var out bytes.Buffer
+	count, err := printSigningCerts(f, &out, samltools.RegisteredBy("https://federation.samltools.com"))
+	if err != nil {
+		t.Fatalf("Error : %s", err.Error())
+	}
+	if count != 2 || strings.Count(out.String(), "Cert Issuer") != 2 {
+		t.Fatalf("unexpected output %s", out.String())
+	}
 }
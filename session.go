@@ -0,0 +1,403 @@
+package samltools
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SPSession is the login of a user at a Service Provider, established by an assertion of its IdP.
+type SPSession struct {
+	ID           string
+	IDPEntityID  string
+	NameID       NameID
+	SessionIndex string
+	Attributes   map[string][]string
+	// AuthnContextClassRef is how the IdP logged the user in.
+	AuthnContextClassRef string
+	// InResponseTo is the ID of the AuthnRequest the session was started for, empty for
+	// IdP-initiated SSO.
+	InResponseTo string
+	Created      time.Time
+	Expires      time.Time
+}
+
+// sessionPruneInterval is how often session stores drop their expired sessions, when
+// starting a new one.
+const sessionPruneInterval = time.Minute
+
+// SPSessionStore keeps the sessions of a Service Provider in memory, referenced by a cookie.
+type SPSessionStore struct {
+	CookieName string
+	Lifetime   time.Duration
+
+	mu        sync.Mutex
+	sessions  map[string]*SPSession
+	nextPrune time.Time
+}
+
+func NewSPSessionStore() *SPSessionStore {
+	return &SPSessionStore{
+		CookieName: "samltools_sp_session",
+		Lifetime:   8 * time.Hour,
+		sessions:   map[string]*SPSession{},
+	}
+}
+
+// Create starts a session for the subject of the assertion and sets its cookie. The
+// session lasts Lifetime, or until the SessionNotOnOrAfter of the assertion if earlier.
+func (s *SPSessionStore) Create(w http.ResponseWriter, req *http.Request, idpEntityID string, assertion *Assertion) *SPSession {
+	now := time.Now()
+	session := &SPSession{
+		ID:           NewID(),
+		IDPEntityID:  idpEntityID,
+		SessionIndex: assertion.SessionIndex(),
+		Attributes:   assertion.Attributes(),
+		Created:      now,
+		Expires:      now.Add(s.Lifetime),
+	}
+	if len(assertion.AuthnStatements) > 0 {
+		session.AuthnContextClassRef = assertion.AuthnStatements[0].AuthnContextClassRef
+	}
+	if assertion.Subject != nil {
+		for _, sc := range assertion.Subject.SubjectConfirmations {
+			if sc.SubjectConfirmationData != nil && sc.SubjectConfirmationData.InResponseTo != "" {
+				session.InResponseTo = sc.SubjectConfirmationData.InResponseTo
+			}
+		}
+	}
+	if nameID := assertion.NameID(); nameID != nil {
+		session.NameID = *nameID
+	}
+	if notOnOrAfter := assertion.SessionNotOnOrAfter(); notOnOrAfter != nil && notOnOrAfter.Before(session.Expires) {
+		session.Expires = *notOnOrAfter
+	}
+	s.mu.Lock()
+	s.prune(now)
+	s.sessions[session.ID] = session
+	s.mu.Unlock()
+	setSessionCookie(w, req, s.CookieName, session.ID, session.Expires)
+	return session
+}
+
+// prune deletes the expired sessions every sessionPruneInterval, s.mu being held.
+func (s *SPSessionStore) prune(now time.Time) {
+	if now.Before(s.nextPrune) {
+		return
+	}
+	s.nextPrune = now.Add(sessionPruneInterval)
+	for id, session := range s.sessions {
+		if !now.Before(session.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// Get returns the live session the cookie of the request refers to.
+func (s *SPSessionStore) Get(req *http.Request) (*SPSession, bool) {
+	c, err := req.Cookie(s.CookieName)
+	if err != nil {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[c.Value]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(session.Expires) {
+		delete(s.sessions, session.ID)
+		return nil, false
+	}
+	return session, true
+}
+
+// Delete ends a session and clears its cookie.
+func (s *SPSessionStore) Delete(w http.ResponseWriter, req *http.Request, session *SPSession) {
+	s.mu.Lock()
+	delete(s.sessions, session.ID)
+	s.mu.Unlock()
+	clearSessionCookie(w, req, s.CookieName)
+}
+
+// DeleteMatching ends the sessions a LogoutRequest of the IdP refers to: those of the
+// principal from that IdP, limited to the SessionIndexes of the request when it lists
+// any. It returns how many sessions were ended.
+func (s *SPSessionStore) DeleteMatching(idpEntityID string, logoutRequest *LogoutRequest) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, session := range s.sessions {
+		if session.IDPEntityID != idpEntityID || !sameNameID(session.NameID, *logoutRequest.NameID) {
+			continue
+		}
+		if len(logoutRequest.SessionIndexes) > 0 && !ContainsString(logoutRequest.SessionIndexes, session.SessionIndex) {
+			continue
+		}
+		delete(s.sessions, id)
+		n++
+	}
+	return n
+}
+
+// Attribute returns the first value of the attribute, empty when the user has none.
+func (s *SPSession) Attribute(name string) string {
+	if values := s.Attributes[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+type spSessionKey struct{}
+
+// Middleware makes the session of the request, when there is one, available to next
+// through SPSessionFromContext.
+func (s *SPSessionStore) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if session, ok := s.Get(req); ok {
+			req = req.WithContext(context.WithValue(req.Context(), spSessionKey{}, session))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// SPSessionFromContext returns the session of the user making the request, put in
+// the context by SPSessionStore.Middleware.
+func SPSessionFromContext(ctx context.Context) (*SPSession, bool) {
+	session, ok := ctx.Value(spSessionKey{}).(*SPSession)
+	return session, ok
+}
+
+// SessionParticipant is a Service Provider an IdP session has sent an assertion to.
+type SessionParticipant struct {
+	SPEntityID   string
+	NameID       NameID
+	SessionIndex string
+}
+
+// IDPSession is the login of a user at an Identity Provider. SessionIndex, unlike ID,
+// is given out to Service Providers. Subject, AuthnInstant and Participants change as
+// the user logs in to Service Providers and are read through the IDPSessionStore.
+type IDPSession struct {
+	ID           string
+	SessionIndex string
+	// Subject is the user logged in, at AuthnInstant. Its Value is empty until the user
+	// logs in.
+	Subject      NameID
+	AuthnInstant time.Time
+	Created      time.Time
+	Expires      time.Time
+	Participants []SessionParticipant
+}
+
+// Authenticated reports whether the user of the session has logged in, the lock of its
+// store being held.
+func (s *IDPSession) Authenticated() bool {
+	return s.Subject.Value != ""
+}
+
+// Participant returns the participant for the Service Provider, the lock of the store
+// of the session being held.
+func (s *IDPSession) Participant(spEntityID string) (SessionParticipant, bool) {
+	for _, p := range s.Participants {
+		if p.SPEntityID == spEntityID {
+			return p, true
+		}
+	}
+	return SessionParticipant{}, false
+}
+
+// IDPSessionStore keeps the sessions of an Identity Provider in memory, referenced by a cookie.
+type IDPSessionStore struct {
+	CookieName string
+	Lifetime   time.Duration
+
+	mu        sync.Mutex
+	sessions  map[string]*IDPSession
+	nextPrune time.Time
+}
+
+func NewIDPSessionStore() *IDPSessionStore {
+	return &IDPSessionStore{
+		CookieName: "samltools_idp_session",
+		Lifetime:   8 * time.Hour,
+		sessions:   map[string]*IDPSession{},
+	}
+}
+
+// Get returns the live session the cookie of the request refers to.
+func (s *IDPSessionStore) Get(req *http.Request) (*IDPSession, bool) {
+	c, err := req.Cookie(s.CookieName)
+	if err != nil {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[c.Value]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(session.Expires) {
+		delete(s.sessions, session.ID)
+		return nil, false
+	}
+	return session, true
+}
+
+// GetOrCreate returns the session of the request, starting one when there is none.
+func (s *IDPSessionStore) GetOrCreate(w http.ResponseWriter, req *http.Request) *IDPSession {
+	if session, ok := s.Get(req); ok {
+		return session
+	}
+	return s.create(w, req)
+}
+
+// Login records that the user of the request logged in as subject, in the session of the
+// request unless it is the one of another user. A new session is started then.
+func (s *IDPSessionStore) Login(w http.ResponseWriter, req *http.Request, subject NameID) *IDPSession {
+	session, ok := s.Get(req)
+	if ok {
+		if current, _ := s.Subject(session); current.Value != "" && !sameNameID(current, subject) {
+			ok = false
+		}
+	}
+	if !ok {
+		session = s.create(w, req)
+	}
+	s.mu.Lock()
+	session.Subject = subject
+	session.AuthnInstant = time.Now()
+	s.mu.Unlock()
+	return session
+}
+
+func (s *IDPSessionStore) create(w http.ResponseWriter, req *http.Request) *IDPSession {
+	now := time.Now()
+	session := &IDPSession{
+		ID:           NewID(),
+		SessionIndex: NewID(),
+		Created:      now,
+		Expires:      now.Add(s.Lifetime),
+	}
+	s.mu.Lock()
+	s.prune(now)
+	s.sessions[session.ID] = session
+	s.mu.Unlock()
+	setSessionCookie(w, req, s.CookieName, session.ID, session.Expires)
+	return session
+}
+
+// prune deletes the expired sessions every sessionPruneInterval, s.mu being held.
+func (s *IDPSessionStore) prune(now time.Time) {
+	if now.Before(s.nextPrune) {
+		return
+	}
+	s.nextPrune = now.Add(sessionPruneInterval)
+	for id, session := range s.sessions {
+		if !now.Before(session.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// Subject returns the user logged in with the session, empty until the user logs in,
+// and when.
+func (s *IDPSessionStore) Subject(session *IDPSession) (NameID, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return session.Subject, session.AuthnInstant
+}
+
+// Participants returns the Service Providers the session sent an assertion to.
+func (s *IDPSessionStore) Participants(session *IDPSession) []SessionParticipant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SessionParticipant(nil), session.Participants...)
+}
+
+// AddParticipant records that the session sent an assertion to a Service Provider,
+// replacing what was recorded for it before.
+func (s *IDPSessionStore) AddParticipant(session *IDPSession, p SessionParticipant) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range session.Participants {
+		if session.Participants[i].SPEntityID == p.SPEntityID {
+			session.Participants[i] = p
+			return
+		}
+	}
+	session.Participants = append(session.Participants, p)
+}
+
+// Find returns the session a LogoutRequest from a Service Provider refers to, matching
+// the NameID and SessionIndexes it was given by the session.
+func (s *IDPSessionStore) Find(spEntityID string, logoutRequest *LogoutRequest) (*IDPSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, session := range s.sessions {
+		p, ok := session.Participant(spEntityID)
+		if !ok || !sameNameID(p.NameID, *logoutRequest.NameID) {
+			continue
+		}
+		if len(logoutRequest.SessionIndexes) > 0 && !ContainsString(logoutRequest.SessionIndexes, p.SessionIndex) {
+			continue
+		}
+		return session, true
+	}
+	return nil, false
+}
+
+// Delete ends a session and returns its participants, whose sessions are to be ended
+// too. Its cookie is cleared when w is set, that is when the session is ended from
+// the browser holding it.
+func (s *IDPSessionStore) Delete(w http.ResponseWriter, req *http.Request, session *IDPSession) []SessionParticipant {
+	s.mu.Lock()
+	delete(s.sessions, session.ID)
+	participants := append([]SessionParticipant(nil), session.Participants...)
+	s.mu.Unlock()
+	if w != nil {
+		clearSessionCookie(w, req, s.CookieName)
+	}
+	return participants
+}
+
+func sameNameID(a NameID, b NameID) bool {
+	return a.Value == b.Value && a.NameQualifier == b.NameQualifier && a.SPNameQualifier == b.SPNameQualifier
+}
+
+// setSessionCookie sets a session cookie. Over TLS it is sent along the cross-site POSTs
+// of the HTTP-POST binding too, which browsers only allow for Secure cookies.
+func setSessionCookie(w http.ResponseWriter, req *http.Request, name string, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: sessionCookieSameSite(req),
+	})
+}
+
+// sessionCookieSameSite is None over TLS, for the cookie to follow the cross-site POSTs
+// of the HTTP-POST binding, and Lax otherwise since browsers reject SameSite=None cookies
+// that aren't Secure. The HTTP-POST binding only works over TLS then.
+func sessionCookieSameSite(req *http.Request) http.SameSite {
+	if req.TLS != nil {
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteLaxMode
+}
+
+func clearSessionCookie(w http.ResponseWriter, req *http.Request, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: sessionCookieSameSite(req),
+	})
+}
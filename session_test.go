@@ -0,0 +1,85 @@
+package samltools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSPSessionNotOnOrAfter(t *testing.T) {
+	ctx, certs := signingContextForTest()
+	notOnOrAfter := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	opts := ResponseOptions{NameID: "user1", SessionIndex: "_session1", SessionNotOnOrAfter: notOnOrAfter}
+	resp, err := CreateSAMLResponseWithOptions("http://idp.samltools.com", "_req1", "http://sp.samltools.com:4567/assertion", "urn:msingh.samltools:sp", opts, ctx)
+	if err != nil {
+		t.Fatalf("failed to create Response %s", err)
+	}
+	assertion, err := ParseValidatedAssertion(resp, CreateValidationContext(certs))
+	if err != nil {
+		t.Fatalf("failed to validate assertion %s", err)
+	}
+
+	store := NewSPSessionStore()
+	rec := httptest.NewRecorder()
+	session := store.Create(rec, httptest.NewRequest(http.MethodPost, "/assertion", nil), "http://idp.samltools.com", assertion)
+	if !session.Expires.Equal(notOnOrAfter) {
+		t.Fatalf("session expires %v, want %v", session.Expires, notOnOrAfter)
+	}
+	store.Lifetime = time.Minute
+	if session = store.Create(rec, httptest.NewRequest(http.MethodPost, "/assertion", nil), "http://idp.samltools.com", assertion); !session.Expires.Before(notOnOrAfter) {
+		t.Fatalf("expected Lifetime to limit the session, expires %v", session.Expires)
+	}
+	session.Expires = time.Now().Add(-time.Second)
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.AddCookie(rec.Result().Cookies()[1])
+	if _, ok := store.Get(req); ok {
+		t.Fatalf("expected expired session to be ended")
+	}
+}
+
+func TestSPSessionMiddleware(t *testing.T) {
+	store := NewSPSessionStore()
+	assertion := &Assertion{
+		Subject: &Subject{NameID: &NameID{Value: "IDPUser1"}},
+		AttributeStatements: []AttributeStatement{{Attributes: []Attribute{
+			{Name: "email", Values: []AttributeValue{{Value: "dev.null.dump.1@gmail.com"}}},
+		}}},
+	}
+	rec := httptest.NewRecorder()
+	store.Create(rec, httptest.NewRequest(http.MethodPost, "/assertion", nil), "http://idp.samltools.com", assertion)
+
+	var current *SPSession
+	handler := store.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		current, _ = SPSessionFromContext(req.Context())
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/me", nil))
+	if current != nil {
+		t.Fatalf("expected no session without cookie")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if current == nil || current.NameID.Value != "IDPUser1" || current.Attribute("email") != "dev.null.dump.1@gmail.com" || current.Attribute("name") != "" {
+		t.Fatalf("unexpected session %#v", current)
+	}
+}
+
+func TestIDPSessionStorePrunesExpired(t *testing.T) {
+	store := NewIDPSessionStore()
+	req := httptest.NewRequest(http.MethodGet, "/sso", nil)
+	expired := store.Login(httptest.NewRecorder(), req, NameID{Value: "user1"})
+	expired.Expires = time.Now().Add(-time.Second)
+	store.nextPrune = time.Time{}
+	session := store.Login(httptest.NewRecorder(), req, NameID{Value: "user2"})
+	if _, ok := store.sessions[expired.ID]; ok {
+		t.Fatalf("expected expired session to be pruned")
+	}
+	if subject, authnInstant := store.Subject(session); subject.Value != "user2" || authnInstant.IsZero() {
+		t.Fatalf("unexpected subject %v at %v", subject, authnInstant)
+	}
+	store.AddParticipant(session, SessionParticipant{SPEntityID: "urn:msingh.samltools:sp"})
+	if participants := store.Participants(session); len(participants) != 1 {
+		t.Fatalf("unexpected participants %v", participants)
+	}
+}
@@ -0,0 +1,27 @@
+package samltools
+
+import (
+	"github.com/beevik/etree"
+	perrors "github.com/pkg/errors"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// signEnvelopedAfter signs el with an enveloped signature and moves the Signature
+// right after the first child element named afterTag, as the SAML schemas expect
+// it after the Issuer. With no such child the Signature becomes the first child.
+func signEnvelopedAfter(signingCtx *dsig.SigningContext, el *etree.Element, afterTag string) (*etree.Element, error) {
+	signed, err := signingCtx.SignEnveloped(el)
+	if err != nil {
+		return nil, perrors.Wrap(err, "Signature generation failed")
+	}
+	sig := signed.RemoveChildAt(len(signed.Child) - 1)
+	index := 0
+	for i, child := range signed.Child {
+		if c, ok := child.(*etree.Element); ok && afterTag != "" && c.Tag == afterTag {
+			index = i + 1
+			break
+		}
+	}
+	signed.InsertChildAt(index, sig)
+	return signed, nil
+}
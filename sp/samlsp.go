@@ -3,81 +3,182 @@ package main
 import (
 	"bytes"
 	"compress/flate"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net/http"
-	"net/url"
 	"time"
 
 	"github.com/monmohan/samltools"
+	"github.com/monmohan/samltools/samlsp"
 	dsig "github.com/russellhaering/goxmldsig"
 	"github.com/spf13/viper"
 )
 
 var defaultValidationContext *dsig.ValidationContext
 
-func samlAssertionHandler(w http.ResponseWriter, req *http.Request) {
-	var err error
-	req.ParseForm()
-	assertion := req.Form.Get("SAMLResponse")
+// idpMetadata keeps the metadata of the Identity Providers this SP trusts up to date,
+// nil when the IdP is configured directly through idp_cert and ssoUrl.
+var idpMetadata *samltools.MetadataRefresher
 
-	fmt.Printf("\n DEBUG: Raw SAML Assertion\n %s\n", assertion)
+// idpMDQ resolves the Identity Provider through an MDQ responder when it isn't
+// configured through idp_metadata.
+var idpMDQ *samltools.MDQClient
 
-	if defaultValidationContext != nil {
-		err = samltools.ValidateAssertion(assertion, defaultValidationContext)
-		if err != nil {
-			//Don't fail the request, just log it for now
-			fmt.Printf("Signature Validation failed \n %s \n", err.Error())
-		}
-	}
+// spSigningContext signs AuthnRequests with the SP credential, nil when no credential is configured.
+var spSigningContext *dsig.SigningContext
 
-	assertion, err = decodeSAMLResponse(assertion)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+// sp is this Service Provider, in debug mode: it shows the Responses it receives.
+var sp *samlsp.ServiceProvider
+
+// newServiceProvider sets up the Service Provider as configured.
+func newServiceProvider() (*samlsp.ServiceProvider, error) {
+	sp := samlsp.NewServiceProvider(viper.GetString("issuer"), assertionURL(), defaultValidationContext)
+	sp.SLOURL = fmt.Sprintf("%s://%s:%v/slo", viper.GetString("protocol"), viper.GetString("host"), viper.GetInt("port"))
+	sp.IDPEntityID = viper.GetString("idp_entity_id")
+	sp.IDPMetadata = idpDescriptor
+	sp.IDPSSOURL = viper.GetString("ssoUrl")
+	sp.IDPSLOURL = viper.GetString("sloUrl")
+	sp.ArtifactResolutionURL = viper.GetString("artifact_resolution_url")
+	sp.SigningContext = spSigningContext
+	sp.ResponseBinding = responseBinding()
+	sp.AuthnRequestOptions = authnRequestOptions
+	sp.AllowUnsolicitedFrom = viper.GetStringSlice("allow_unsolicited_from")
+	sp.DefaultRedirect = "/pages/sp.html"
+	sp.AllowedRedirects = viper.GetStringSlice("allowed_redirects")
+	if err := viper.UnmarshalKey("attribute_mappings", &sp.AttributeMappings); err != nil {
+		fmt.Printf("Ignoring attribute_mappings: %s\n", err)
 	}
-	w.Header().Add("Content-Type", "application/xml")
-	w.Write([]byte(assertion))
+	sp.Debug = true
+	var err error
+	if sp.AuthnRequestBinding, err = samltools.BindingURI(viper.GetString("authn_request_binding")); err != nil {
+		fmt.Printf("Ignoring authn_request_binding: %s\n", err)
+	}
+	if sp.IDPSLOBinding, err = samltools.BindingURI(viper.GetString("slo_binding")); err != nil {
+		fmt.Printf("Ignoring slo_binding: %s\n", err)
+	}
+	if lifetime := viper.GetDuration("session_lifetime"); lifetime > 0 {
+		sp.Sessions.Lifetime = lifetime
+	}
+	if sp.ArtifactResolver, err = createArtifactResolver(); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
 
+// authnRequestOptions completes AuthnRequests as configured.
+func authnRequestOptions(samlreq *samltools.AuthnRequest) {
+	samlreq.ForceAuthn = viper.GetBool("force_authn")
+	samlreq.IsPassive = viper.GetBool("is_passive")
+	if format := viper.GetString("nameid_format"); format != "" {
+		allowCreate := true
+		samlreq.NameIDPolicy = &samltools.NameIDPolicy{Format: format, AllowCreate: &allowCreate}
+	}
+	if classRefs := viper.GetStringSlice("authn_context_class_refs"); len(classRefs) > 0 {
+		samlreq.RequestedAuthnContext = &samltools.RequestedAuthnContext{
+			Comparison:            viper.GetString("authn_context_comparison"),
+			AuthnContextClassRefs: classRefs,
+		}
+	}
 }
 
 func generateSAMLRequest(w http.ResponseWriter, req *http.Request) {
-	samlreq := &samltools.AuthnRequest{
-		SamlpAttr:       "urn:oasis:names:tc:SAML:2.0:protocol",
-		ID:              fmt.Sprintf("_%d", rand.Int()),
-		IssueInstant:    time.Now().Format(time.RFC3339),
-		ProtocolBinding: "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect",
-		Version:         "2.0",
-		Issuer: samltools.Issuer{
-			Namespace: "urn:oasis:names:tc:SAML:2.0:assertion",
-			Value:     viper.GetString("issuer")},
-	}
+	binding, location := sp.IDPSSOService()
+	samlreq := sp.NewAuthnRequest(location)
 	output, err := xml.MarshalIndent(samlreq, "  ", "    ")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+	}
 	decoded := req.URL.Query().Get("showdecoded")
 	if decoded != "" {
+		// Show the request as it is sent, with its enveloped signature for the POST binding
+		if binding == samltools.HTTPPostBinding && spSigningContext != nil {
+			if output, err = samltools.SignMessage(output, spSigningContext); err != nil {
+				fmt.Printf("error: %v\n", err)
+			}
+		}
 		w.Header().Add("Content-Type", "application/xml")
 		w.Write(output)
 		return
 	}
-	if err != nil {
-		fmt.Printf("error: %v\n", err)
-	}
-	s, err := encodeSAMLRequest(output)
+	location, err = samltools.RedirectURL(location, samltools.SAMLRequestParam, output, "", spSigningContext)
 	if err != nil {
 		log.Fatalf("Error %s\n", err.Error())
 	}
+	sp.Requests.Add(w, req, samlreq.ID)
+	w.Write([]byte(location))
+
+}
+
+// currentUser shows the user logged in at this SP, as kept in its session, and their profile.
+func currentUser(w http.ResponseWriter, req *http.Request) {
+	session, ok := samlsp.SessionFromContext(req.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"idp":          session.IDPEntityID,
+		"nameId":       session.NameID.Value,
+		"nameIdFormat": session.NameID.Format,
+		"sessionIndex": session.SessionIndex,
+		"expires":      session.Expires,
+		"attributes":   session.Attributes,
+		"profile":      sp.Profile(session),
+	})
+}
 
-	u, _ := url.Parse(viper.GetString("ssoUrl"))
+// accessRule restricts a path to the users meeting its conditions, as configured in access_rules.
+type accessRule struct {
+	Path                  string   `mapstructure:"path"`
+	Groups                []string `mapstructure:"groups"`
+	EmailDomains          []string `mapstructure:"email_domains"`
+	AuthnContextClassRefs []string `mapstructure:"authn_context_class_refs"`
+	Expression            string   `mapstructure:"expression"`
+}
 
-	q := u.Query()
-	q.Add("SAMLRequest", s)
-	u.RawQuery = q.Encode()
-	w.Write([]byte(u.String()))
+// handleAccessRules serves the paths of access_rules to the users allowed to access them.
+func handleAccessRules() error {
+	var rules []accessRule
+	if err := viper.UnmarshalKey("access_rules", &rules); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		var requirements []samlsp.Requirement
+		if len(rule.Groups) > 0 {
+			requirements = append(requirements, samlsp.InGroup(rule.Groups...))
+		}
+		if len(rule.EmailDomains) > 0 {
+			requirements = append(requirements, samlsp.EmailDomain(rule.EmailDomains...))
+		}
+		if rule.Expression != "" {
+			expression, err := samlsp.Expression(rule.Expression)
+			if err != nil {
+				return err
+			}
+			requirements = append(requirements, expression)
+		}
+		if len(rule.AuthnContextClassRefs) > 0 {
+			requirements = append(requirements, samlsp.AuthnContext(rule.AuthnContextClassRefs...))
+		}
+		http.Handle(rule.Path, sp.Authorize(http.HandlerFunc(protectedPage), requirements...))
+	}
+	return nil
+}
 
+// protectedPage stands for a page of the application only some users may access.
+func protectedPage(w http.ResponseWriter, req *http.Request) {
+	profile, _ := samlsp.ProfileFromContext(req.Context())
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Welcome %s, you are allowed to access %s\n", profile.ID, req.URL.Path)
 }
 
 func main() {
@@ -89,16 +190,59 @@ func main() {
 	if err != nil {
 		log.Fatalf("Unable to read idp cert, Signature Validations will fail, %s", err.Error())
 	}
-	http.HandleFunc("/assertion", samlAssertionHandler)
+	if idpMetadata != nil {
+		go idpMetadata.Run(nil)
+	}
+	spSigningContext, err = createSPSigningContext()
+	if err != nil {
+		log.Fatalf("Unable to read SP credential, %s", err.Error())
+	}
+	sp, err = newServiceProvider()
+	if err != nil {
+		log.Fatalf("Unable to read artifact resolution TLS settings, %s", err.Error())
+	}
+	http.HandleFunc("/assertion", sp.ACS)
+	http.HandleFunc("/metadata", sp.Metadata)
 	http.HandleFunc("/issue", generateSAMLRequest)
+	http.HandleFunc("/login", sp.Login)
+	http.HandleFunc("/logout", sp.Logout)
+	http.HandleFunc("/slo", sp.SLO)
+	http.Handle("/me", sp.Sessions.Middleware(http.HandlerFunc(currentUser)))
+	http.Handle("/slo/soap", sp.SOAPLogoutService())
+	if err := handleAccessRules(); err != nil {
+		log.Fatalf("Invalid access_rules, %s", err.Error())
+	}
 	fs := http.FileServer(http.Dir("../pages"))
 	http.Handle("/pages/", http.StripPrefix("/pages/", fs))
 	rand.Seed(time.Now().UnixNano())
 	serverUrl := fmt.Sprintf("%s:%v", viper.GetString("host"), viper.GetInt("port"))
-	fmt.Printf("Server URL : %s\n", serverUrl)
-	fmt.Printf("Assertion URL : http://%s/assertion \n", serverUrl)
-	log.Fatal(http.ListenAndServe(serverUrl, nil))
+	fmt.Printf("Server URL : %s://%s\n", viper.GetString("protocol"), serverUrl)
+	fmt.Printf("Assertion URL : %s \n", assertionURL())
+	log.Fatal(samltools.ListenAndServe(serverUrl, nil, serveOptions()))
+
+}
+
+// serveOptions returns the TLS settings of protocol, tls_cert and tls_key, or tls_dev and
+// tls_dev_dir for a development certificate.
+func serveOptions() samltools.ServeOptions {
+	opts := samltools.ServeOptions{
+		HTTPS:    viper.GetString("protocol") == "https",
+		CertFile: viper.GetString("tls_cert"),
+		KeyFile:  viper.GetString("tls_key"),
+		Host:     viper.GetString("host"),
+	}
+	if viper.GetBool("tls_dev") {
+		opts.DevDir = viper.GetString("tls_dev_dir")
+		if opts.DevDir == "" {
+			opts.DevDir = "../config/dev-tls"
+		}
+	}
+	return opts
+}
 
+// assertionURL is the Assertion Consumer Service URL of this SP.
+func assertionURL() string {
+	return fmt.Sprintf("%s://%s:%v/assertion", viper.GetString("protocol"), viper.GetString("host"), viper.GetInt("port"))
 }
 
 func config() error {
@@ -108,10 +252,123 @@ func config() error {
 }
 
 func CreateDefaultValidationContext() (*dsig.ValidationContext, error) {
+	if source := viper.GetString("idp_metadata"); source != "" {
+		filters := samltools.MetadataFilters(viper.GetString("metadata_registration_authority"),
+			viper.GetStringMapString("metadata_entity_attributes"))
+		idpMetadata = samltools.NewMetadataRefresher(source, viper.GetString("idp_metadata_cache"), filters...)
+		if certFile := viper.GetString("idp_metadata_cert"); certFile != "" {
+			vc, err := samltools.CreateValidationContextFromCertFile(certFile)
+			if err != nil {
+				return nil, err
+			}
+			idpMetadata.ValidationContext = vc
+		}
+		return samltools.CreateRefreshingValidationContext(idpMetadata, viper.GetString("idp_entity_id"))
+	}
+	if mdqURL := viper.GetString("mdq_url"); mdqURL != "" {
+		client, err := createMDQClient(mdqURL)
+		if err != nil {
+			return nil, err
+		}
+		idpMDQ = client
+		if _, err := idpMDQ.IDP(viper.GetString("idp_entity_id")); err != nil {
+			return nil, err
+		}
+		validationContext := dsig.NewDefaultValidationContext(idpMDQ.CertificateStore(viper.GetString("idp_entity_id")))
+		validationContext.IdAttribute = "ID"
+		return validationContext, nil
+	}
 	certFile := viper.GetString("idp_cert")
 	return samltools.CreateValidationContextFromCertFile(certFile)
 }
 
+// createSPSigningContext loads the SP credential used to sign AuthnRequests. Requests
+// are sent unsigned when no credential is configured, which IdPs asking for signed
+// requests in their metadata will reject.
+func createSPSigningContext() (*dsig.SigningContext, error) {
+	keyFile := viper.GetString("sp_private_key_file")
+	if keyFile == "" {
+		if idpMetadata != nil {
+			if idp, ok := idpMetadata.Index().IDP(viper.GetString("idp_entity_id")); ok && idp.WantAuthnRequestsSigned {
+				fmt.Printf("WARNING: %s wants signed AuthnRequests but sp_private_key_file isn't set\n", viper.GetString("idp_entity_id"))
+			}
+		}
+		return nil, nil
+	}
+	keyStore, err := samltools.LoadKeyStore(keyFile, viper.GetString("sp_cert_file"))
+	if err != nil {
+		return nil, err
+	}
+	signingContext := dsig.NewDefaultSigningContext(keyStore)
+	signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	if alg := viper.GetString("signature_algorithm"); alg != "" {
+		if err := signingContext.SetSignatureMethod(alg); err != nil {
+			return nil, err
+		}
+	}
+	return signingContext, nil
+}
+
+// responseBinding returns the binding the IdP is asked to send Responses with, response_binding or HTTP-POST.
+func responseBinding() string {
+	binding, err := samltools.BindingURI(viper.GetString("response_binding"))
+	if err != nil || binding == "" || binding == samltools.HTTPRedirectBinding {
+		return samltools.HTTPPostBinding
+	}
+	return binding
+}
+
+// createArtifactResolver sets up the back-channel to the ArtifactResolutionService of the
+// IdP. ArtifactResolve requests are signed with the SP credential when there is one and
+// artifact_tls_cert/artifact_tls_key authenticate the SP with mutual TLS.
+func createArtifactResolver() (*samltools.ArtifactResolver, error) {
+	var tlsConfig *tls.Config
+	if certFile := viper.GetString("artifact_tls_cert"); certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, viper.GetString("artifact_tls_key"))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if caFile := viper.GetString("artifact_tls_ca"); caFile != "" {
+		ca, err := samltools.ReadCertificateFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AddCert(ca)
+	}
+	resolver := samltools.NewArtifactResolver(viper.GetString("issuer"), spSigningContext, tlsConfig)
+	resolver.ValidationContext = defaultValidationContext
+	return resolver, nil
+}
+
+func createMDQClient(mdqURL string) (*samltools.MDQClient, error) {
+	certFile := viper.GetString("mdq_cert")
+	if certFile == "" {
+		return nil, fmt.Errorf("mdq_cert is required to verify the responses of %s", mdqURL)
+	}
+	validationContext, err := samltools.CreateValidationContextFromCertFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	return samltools.NewMDQClient(mdqURL, validationContext), nil
+}
+
+// idpDescriptor returns the metadata of the IdP, nil when it is configured directly.
+func idpDescriptor() *samltools.IDPSSODescriptor {
+	var idp *samltools.IDPSSODescriptor
+	if idpMetadata != nil {
+		idp, _ = idpMetadata.Index().IDP(viper.GetString("idp_entity_id"))
+	} else if idpMDQ != nil {
+		idp, _ = idpMDQ.IDP(viper.GetString("idp_entity_id"))
+	}
+	return idp
+}
+
 func decodeSAMLRequest(req string) error {
 	data, err := base64.StdEncoding.DecodeString(string(req))
 	if err != nil {
@@ -137,22 +394,3 @@ func decodeSAMLResponse(req string) (string, error) {
 	}
 	return string(data), nil
 }
-
-func encodeSAMLRequest(req []byte) (string, error) {
-	var buf bytes.Buffer
-
-	w, err := flate.NewWriter(&buf, 2)
-	if err != nil {
-		return "", err
-	}
-	_, e := w.Write(req)
-	if e != nil {
-		return "", e
-	}
-	if err := w.Close(); err != nil {
-		fmt.Println(err)
-	}
-	data := base64.StdEncoding.EncodeToString(buf.Bytes())
-
-	return data, nil
-}
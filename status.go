@@ -0,0 +1,97 @@
+package samltools
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/beevik/etree"
+	perrors "github.com/pkg/errors"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// Top-level and second-level status codes of SAML protocol responses.
+const (
+	StatusSuccess         = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	StatusRequester       = "urn:oasis:names:tc:SAML:2.0:status:Requester"
+	StatusResponder       = "urn:oasis:names:tc:SAML:2.0:status:Responder"
+	StatusVersionMismatch = "urn:oasis:names:tc:SAML:2.0:status:VersionMismatch"
+
+	StatusAuthnFailed              = "urn:oasis:names:tc:SAML:2.0:status:AuthnFailed"
+	StatusInvalidNameIDPolicy      = "urn:oasis:names:tc:SAML:2.0:status:InvalidNameIDPolicy"
+	StatusNoAuthnContext           = "urn:oasis:names:tc:SAML:2.0:status:NoAuthnContext"
+	StatusNoPassive                = "urn:oasis:names:tc:SAML:2.0:status:NoPassive"
+	StatusPartialLogout            = "urn:oasis:names:tc:SAML:2.0:status:PartialLogout"
+	StatusRequestDenied            = "urn:oasis:names:tc:SAML:2.0:status:RequestDenied"
+	StatusRequestUnsupported       = "urn:oasis:names:tc:SAML:2.0:status:RequestUnsupported"
+	StatusRequestVersionTooHigh    = "urn:oasis:names:tc:SAML:2.0:status:RequestVersionTooHigh"
+	StatusUnknownPrincipal         = "urn:oasis:names:tc:SAML:2.0:status:UnknownPrincipal"
+	StatusUnsupportedBinding       = "urn:oasis:names:tc:SAML:2.0:status:UnsupportedBinding"
+	StatusRequestVersionDeprecated = "urn:oasis:names:tc:SAML:2.0:status:RequestVersionDeprecated"
+)
+
+// StatusError is a failure to be reported to the sender of a request as the
+// status of a SAML Response.
+type StatusError struct {
+	Code    string
+	SubCode string
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.SubCode != "" {
+		return fmt.Sprintf("%s (%s): %s", e.Code, e.SubCode, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// RequesterError returns a StatusError blaming the sender of the request.
+func RequesterError(subCode string, format string, args ...interface{}) *StatusError {
+	return &StatusError{Code: StatusRequester, SubCode: subCode, Message: fmt.Sprintf(format, args...)}
+}
+
+// ResponderError returns a StatusError for a request the responder failed to process.
+func ResponderError(subCode string, format string, args ...interface{}) *StatusError {
+	return &StatusError{Code: StatusResponder, SubCode: subCode, Message: fmt.Sprintf(format, args...)}
+}
+
+// CreateErrorResponse returns a base64 encoded samlp:Response carrying the status of
+// the error and no assertion. It is signed when signingCtx is set.
+func CreateErrorResponse(issuer string, inResponseTo string, destination string, status *StatusError, signingCtx *dsig.SigningContext) (string, error) {
+	doc := etree.NewDocument()
+	resp := doc.CreateElement("samlp:Response")
+	resp.CreateAttr("xmlns:samlp", ProtocolNamespace)
+	resp.CreateAttr("xmlns:saml", AssertionNamespace)
+	resp.CreateAttr("ID", NewID())
+	resp.CreateAttr("Version", "2.0")
+	resp.CreateAttr("IssueInstant", time.Now().UTC().Format(time.RFC3339))
+	if destination != "" {
+		resp.CreateAttr("Destination", destination)
+	}
+	if inResponseTo != "" {
+		resp.CreateAttr("InResponseTo", inResponseTo)
+	}
+	resp.CreateElement("saml:Issuer").CreateText(issuer)
+	st := resp.CreateElement("samlp:Status")
+	code := st.CreateElement("samlp:StatusCode")
+	code.CreateAttr("Value", status.Code)
+	if status.SubCode != "" {
+		code.CreateElement("samlp:StatusCode").CreateAttr("Value", status.SubCode)
+	}
+	if status.Message != "" {
+		st.CreateElement("samlp:StatusMessage").CreateText(status.Message)
+	}
+
+	if signingCtx != nil {
+		signed, err := signEnvelopedAfter(signingCtx, resp, "Issuer")
+		if err != nil {
+			return "", err
+		}
+		doc.SetRoot(signed)
+	}
+	data, err := doc.WriteToBytes()
+	if err != nil {
+		return "", perrors.Wrap(err, "Failed to write error response")
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}